@@ -0,0 +1,296 @@
+package aperturekv
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/index"
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+)
+
+const BackupManifestFileName = "backup-manifest"
+
+// 备份清单，记录备份时数据目录中的每个文件，以及本次备份拷贝了其中的哪一部分
+type BackupManifest struct {
+	Files	[]BackupFile	`json:"files"`
+}
+
+type BackupFile struct {
+	Name		string	`json:"name"`
+	Size		int64	`json:"size"`		// 备份时文件的大小，活跃文件是当时的 WriteOff
+	Inode		uint64	`json:"inode"`	// 数据文件被 merge 替换之后 inode 会发生变化
+	Offset		int64	`json:"offset"`	// 本次备份从 Offset 开始拷贝，为 0 时是完整的文件，等于 Size 时没有拷贝
+}
+
+// Backup 在不停止写入的情况下把数据库备份到 dir 中，备份出来的目录可以直接 Open
+// 旧的数据文件不会再被修改，优先使用硬链接；活跃文件只拷贝到备份开始时写入的位置
+func (db *DB) Backup(dir string) error {
+	return db.backup(dir, nil)
+}
+
+// IncrementalBackup 只备份 since 之后新增的数据文件，以及已有数据文件新追加的部分
+// 被 merge 替换掉的数据文件会重新完整备份，B+ 树索引不会备份，恢复之后从数据文件重建
+func (db *DB) IncrementalBackup(dir string, since *BackupManifest) error {
+	return db.backup(dir, since)
+}
+
+func (db *DB) backup(dir string, since *BackupManifest) error {
+	if err := prepareBackupDir(dir); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	if db.isMerging {
+		db.mu.Unlock()
+		return ErrMergeInProgress
+	}
+	if db.isBackingUp {
+		db.mu.Unlock()
+		return ErrBackupInProgress
+	}
+	// 备份期间不能 merge，merge 会删除和替换数据文件
+	db.isBackingUp = true
+	defer func() {
+		db.mu.Lock()
+		db.isBackingUp = false
+		db.mu.Unlock()
+	}()
+
+	var activeBlobFileId uint32
+	var blobWriteOff int64
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		activeBlobFileId = db.activeBlobFile.FileId
+		blobWriteOff = db.activeBlobFile.WriteOff
+	}
+	var olderBlobFileIds []uint32
+	for fid := range db.olderBlobFiles {
+		olderBlobFileIds = append(olderBlobFileIds, fid)
+	}
+	var activeFileId uint32
+	var writeOff int64
+	if db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		activeFileId = db.activeFile.FileId
+		writeOff = db.activeFile.WriteOff
+	}
+	var olderFileIds []uint32
+	for fid := range db.olderFiles {
+		olderFileIds = append(olderFileIds, fid)
+	}
+	// B+ 树索引需要和数据文件处于同一时刻，不能包含备份之后写入的数据
+	var checkpoint *index.BPTreeCheckpoint
+	if bpt, ok := db.index.(*index.BPlusTree); ok && since == nil {
+		var err error
+		if checkpoint, err = bpt.Checkpoint(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	db.mu.Unlock()
+
+	manifest := &BackupManifest{}
+	if checkpoint != nil {
+		path := filepath.Join(dir, index.BPTreeIndexFileName)
+		if err := checkpoint.CopyFile(path); err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{Name: index.BPTreeIndexFileName, Size: info.Size()})
+	}
+
+	sort.Slice(olderFileIds, func(i, j int) bool {
+		return olderFileIds[i] < olderFileIds[j]
+	})
+	for _, fid := range olderFileIds {
+		if err := db.backupFile(dir, filepath.Base(data.GetDataFileName("", fid)), -1, since, manifest); err != nil {
+			return err
+		}
+	}
+	if writeOff > 0 {
+		if err := db.backupFile(dir, filepath.Base(data.GetDataFileName("", activeFileId)), writeOff, since, manifest); err != nil {
+			return err
+		}
+	}
+
+	// 数据文件引用的 blob 文件，GCBlobFiles 和备份互斥，旧的 blob 文件不会被修改
+	sort.Slice(olderBlobFileIds, func(i, j int) bool {
+		return olderBlobFileIds[i] < olderBlobFileIds[j]
+	})
+	for _, fid := range olderBlobFileIds {
+		if err := db.backupFile(dir, filepath.Base(data.GetBlobFileName("", fid)), -1, since, manifest); err != nil {
+			return err
+		}
+	}
+	if blobWriteOff > 0 {
+		if err := db.backupFile(dir, filepath.Base(data.GetBlobFileName("", activeBlobFileId)), blobWriteOff, since, manifest); err != nil {
+			return err
+		}
+	}
+
+	// merge 之后生成的 hint 文件和标识文件，只有 merge 才会修改它们
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName, data.MergeRewrittenFileName} {
+		if _, err := os.Stat(filepath.Join(db.options.DirPath, fileName)); os.IsNotExist(err) {
+			continue
+		}
+		if err := db.backupFile(dir, fileName, -1, since, manifest); err != nil {
+			return err
+		}
+	}
+	return writeBackupManifest(dir, manifest)
+}
+
+// 备份数据目录中的一个文件，size 小于 0 时备份整个文件，这样的文件不会再被修改，可以使用硬链接
+func (db *DB) backupFile(dir, name string, size int64, since *BackupManifest, manifest *BackupManifest) error {
+	src := filepath.Join(db.options.DirPath, name)
+	immutable := size < 0
+	if immutable {
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		size = info.Size()
+	}
+	inode, err := utils.FileInode(src)
+	if err != nil {
+		return err
+	}
+
+	// 同一个文件只会在末尾追加数据，只需要拷贝上次备份之后新增的部分
+	var offset int64
+	if prev := since.file(name); prev != nil && prev.Inode == inode && prev.Size <= size {
+		offset = prev.Size
+	}
+	manifest.Files = append(manifest.Files, BackupFile{Name: name, Size: size, Inode: inode, Offset: offset})
+	if offset == size {
+		return nil
+	}
+	dest := filepath.Join(dir, name)
+	if offset == 0 && immutable {
+		return utils.LinkOrCopyFile(src, dest)
+	}
+	return utils.CopyFile(src, dest, offset, size)
+}
+
+func (m *BackupManifest) file(name string) *BackupFile {
+	if m == nil {
+		return nil
+	}
+	for i := range m.Files {
+		if m.Files[i].Name == name {
+			return &m.Files[i]
+		}
+	}
+	return nil
+}
+
+// 读取备份目录中的备份清单
+func LoadBackupManifest(dir string) (*BackupManifest, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, BackupManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(buf, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// 备份清单最后写入，存在备份清单说明备份是完整的
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, BackupManifestFileName+".tmp")
+	if err := os.WriteFile(tmpPath, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, BackupManifestFileName))
+}
+
+// RestoreBackup 依次应用一次完整备份和之后的增量备份，恢复到 dir 中
+func RestoreBackup(dir string, backupDirs ...string) error {
+	if err := prepareBackupDir(dir); err != nil {
+		return err
+	}
+	for _, backupDir := range backupDirs {
+		manifest, err := LoadBackupManifest(backupDir)
+		if err != nil {
+			return err
+		}
+		if err := applyBackup(dir, backupDir, manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyBackup(dir, backupDir string, manifest *BackupManifest) error {
+	names := make(map[string]struct{}, len(manifest.Files))
+	for _, file := range manifest.Files {
+		names[file.Name] = struct{}{}
+		src := filepath.Join(backupDir, file.Name)
+		dest := filepath.Join(dir, file.Name)
+
+		// 增量的部分需要接在上一次备份的末尾
+		if file.Offset > 0 {
+			info, err := os.Stat(dest)
+			if err != nil || info.Size() != file.Offset {
+				return ErrBackupChainBroken
+			}
+			if file.Offset == file.Size {
+				continue
+			}
+			if err := utils.AppendFile(src, dest); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := utils.CopyFile(src, dest, 0, -1); err != nil {
+			return err
+		}
+	}
+
+	// 备份时已经不存在的文件（例如被 merge 掉的数据文件、没有备份的 B+ 树索引）需要删除
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := names[entry.Name()]; !ok {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 备份目录不存在时创建，已经存在时必须是空的
+func prepareBackupDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, os.ModePerm)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrBackupDirNotEmpty
+	}
+	return nil
+}
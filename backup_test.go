@@ -0,0 +1,203 @@
+package aperturekv
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/index"
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// 备份期间不停止写入，备份出来的目录可以直接打开
+func TestDB_Backup(t *testing.T) {
+	for _, typ := range []index.IndexType{index.Btree, index.BPTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-backup-1")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.DataFileMergeRatio = 0
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 1000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			assert.Nil(t, err)
+		}
+		for i := 0; i < 500; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		err = db.Merge()
+		assert.Nil(t, err)
+		for i := 1000; i < 2000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+
+		// 备份的同时继续写入
+		backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 2000; i < 3000; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+			}
+		}()
+		err = db.Backup(backupDir)
+		assert.Nil(t, err)
+		wg.Wait()
+
+		_, err = os.Stat(filepath.Join(backupDir, fileLockName))
+		assert.True(t, os.IsNotExist(err))
+
+		backupOpts := opts
+		backupOpts.DirPath = backupDir
+		backupDB, err := Open(backupOpts)
+		assert.Nil(t, err)
+		_, err = backupDB.Get(utils.GetTestKey(100))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = backupDB.Get(utils.GetTestKey(600))
+		assert.Nil(t, err)
+		for i := 1000; i < 2000; i++ {
+			value, err := backupDB.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), value)
+		}
+		// 备份开始之后的写入可能有一部分在备份中，但是不会有不完整的数据
+		backupKeys := backupDB.ListKeys()
+		assert.True(t, len(backupKeys) >= 1500 && len(backupKeys) <= 2500)
+		err = backupDB.Fold(func(key []byte, value []byte) bool {
+			return true
+		})
+		assert.Nil(t, err)
+
+		destroyDB(backupDB)
+		destroyDB(db)
+	}
+}
+
+func TestDB_Backup_DirNotEmpty(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	err = db.Backup(dir)
+	assert.Equal(t, ErrBackupDirNotEmpty, err)
+}
+
+// 增量备份只拷贝新增的数据，按顺序恢复之后和原来的数据一致
+func TestDB_IncrementalBackup(t *testing.T) {
+	for _, typ := range []index.IndexType{index.Btree, index.BPTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-backup-3")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.DataFileMergeRatio = 0
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 1000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			assert.Nil(t, err)
+		}
+		fullDir, _ := os.MkdirTemp("", "bitcask-go-backup-full")
+		err = db.Backup(fullDir)
+		assert.Nil(t, err)
+		fullManifest, err := LoadBackupManifest(fullDir)
+		assert.Nil(t, err)
+
+		for i := 1000; i < 2000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		incrDir1, _ := os.MkdirTemp("", "bitcask-go-backup-incr")
+		err = db.IncrementalBackup(incrDir1, fullManifest)
+		assert.Nil(t, err)
+		incrManifest1, err := LoadBackupManifest(incrDir1)
+		assert.Nil(t, err)
+		// 没有变化的数据文件不会再拷贝
+		_, err = os.Stat(data.GetDataFileName(incrDir1, 0))
+		assert.True(t, os.IsNotExist(err))
+
+		// merge 替换掉的数据文件重新完整备份
+		for i := 0; i < 500; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		err = db.Merge()
+		assert.Nil(t, err)
+		for i := 2000; i < 2100; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		incrDir2, _ := os.MkdirTemp("", "bitcask-go-backup-incr")
+		err = db.IncrementalBackup(incrDir2, incrManifest1)
+		assert.Nil(t, err)
+
+		restoreDir, _ := os.MkdirTemp("", "bitcask-go-backup-restore")
+		err = RestoreBackup(restoreDir, fullDir, incrDir1, incrDir2)
+		assert.Nil(t, err)
+
+		restoreOpts := opts
+		restoreOpts.DirPath = restoreDir
+		restoreDB, err := Open(restoreOpts)
+		assert.Nil(t, err)
+		assert.Equal(t, 1600, len(restoreDB.ListKeys()))
+		for i := 0; i < 2100; i++ {
+			want, wantErr := db.Get(utils.GetTestKey(i))
+			value, err := restoreDB.Get(utils.GetTestKey(i))
+			assert.Equal(t, wantErr, err)
+			assert.Equal(t, want, value)
+		}
+
+		destroyDB(restoreDB)
+		destroyDB(db)
+		for _, backupDir := range []string{fullDir, incrDir1, incrDir2} {
+			_ = os.RemoveAll(backupDir)
+		}
+	}
+}
+
+func TestRestoreBackup_ChainBroken(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-4")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+	fullDir, _ := os.MkdirTemp("", "bitcask-go-backup-full")
+	defer os.RemoveAll(fullDir)
+	err = db.Backup(fullDir)
+	assert.Nil(t, err)
+	fullManifest, err := LoadBackupManifest(fullDir)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(2), utils.GetTestKey(2))
+	assert.Nil(t, err)
+	incrDir, _ := os.MkdirTemp("", "bitcask-go-backup-incr")
+	defer os.RemoveAll(incrDir)
+	err = db.IncrementalBackup(incrDir, fullManifest)
+	assert.Nil(t, err)
+
+	// 缺少完整备份时不能恢复增量备份
+	restoreDir, _ := os.MkdirTemp("", "bitcask-go-backup-restore")
+	defer os.RemoveAll(restoreDir)
+	err = RestoreBackup(restoreDir, incrDir)
+	assert.Equal(t, ErrBackupChainBroken, err)
+}
@@ -46,9 +46,13 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
-	
-	// 数据不存在直接返回
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	// 数据不存在直接返回，索引可能正在被其他写入修改，需要持有数据库的读锁
+	wb.db.mu.RLock()
 	logRecordPos := wb.db.index.Get(key)
+	wb.db.mu.RUnlock()
 	if logRecordPos == nil {
 		if wb.pendingWrites[string(key)] != nil {	// 索引（数据库）中不存在但是 wb 暂存中存在
 			delete(wb.pendingWrites, string(key))
@@ -77,14 +81,28 @@ func (wb *WriteBatch) Commit() error {
 	
 	// 数据库加锁保证串行化
 	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
+	if err := wb.db.commitRecords(wb.pendingWrites); err != nil {
+		wb.db.mu.Unlock()
+		return err
+	}
 
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	// 清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return wb.db.unlockAndSync(wb.options.SyncWrites || wb.db.options.SyncWrites)
+}
+
+// 以事务的方式写入一批数据，调用方需要持有数据库的锁，需要持久化时释放锁之后等待 sync
+func (db *DB) commitRecords(records map[string]*data.LogRecord) error {
+	if db.replica != nil {
+		return ErrReadOnlyReplica
+	}
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	// 写数据到数据文件中
 	postions := make(map[string]*data.LogRecordPos)
-	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
+	for _, record := range records {
+		logRecordPos, err := db.appendLogRecord(&data.LogRecord{
 			Key:	logRecordKeyWithSeq(record.Key, seqNo),
 			Value: 	record.Value,
 			Type: 	record.Type,
@@ -101,39 +119,42 @@ func (wb *WriteBatch) Commit() error {
 		Type:	data.LogRecordTxnFinished,
 	}
 
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	finishedPos, err := db.appendLogRecord(finishedRecord)
+	if err != nil {
 		return err
 	}
-	
-	// 是否持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
-			return err
-		}
-	}
+	db.addReclaimSize(finishedPos)
 
 	// 更新内存索引
-	for _, record := range wb.pendingWrites {
+	keys := make([][]byte, 0, len(records))
+	undo := make([]*indexUndo, 0, len(records))
+	for _, record := range records {
 		pos := postions[string(record.Key)]
 		var oldPos *data.LogRecordPos
 		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
+			oldPos = db.index.Put(record.Key, pos)
+			db.addToBloomFilter(record.Key)
 		}
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _ = db.index.Delete(record.Key)
+			db.addReclaimSize(pos)
+			pos = nil
 		}
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			db.addReclaimSize(oldPos)
 		}
+		db.setExpire(record.Key, 0)
+		keys = append(keys, record.Key)
+		undo = append(undo, &indexUndo{key: record.Key, pos: pos, oldPos: oldPos})
 	}
-
-	// 清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-
+	if err := db.indexErr(); err != nil {
+		return err
+	}
+	db.recordWrite(keys...)
+	db.pendingUndo = append(db.pendingUndo, undo...)
 	return nil
 }
 
-
 // key+seqNum 编码
 func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	seq := make([]byte, binary.MaxVarintLen64)
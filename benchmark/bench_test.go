@@ -1,8 +1,11 @@
 package benchmark
 
 import (
+	"fmt"
 	"math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -63,4 +66,85 @@ func Benchmark_Delete(b *testing.B) {
 		err := db.Delete(utils.GetTestKey(rand.Int()))
 		assert.Nil(b, err)
 	}
-}
\ No newline at end of file
+}
+
+// 多个协程并发写入，单个 DB 的写入都在同一把锁上串行
+func Benchmark_ParallelPut(b *testing.B) {
+	var i int64
+	value := utils.RandomValue(1024)
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := db.Put(utils.GetTestKey(int(atomic.AddInt64(&i, 1))), value)
+			assert.Nil(b, err)
+		}
+	})
+}
+
+// 和 Benchmark_ParallelPut 相同的写入，按 key 分散到 32 个分片中
+func Benchmark_ShardedParallelPut(b *testing.B) {
+	options := aperture.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bench-sharded")
+	options.DirPath = dir
+	sharded, err := aperture.OpenSharded(options, 32)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = sharded.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	var i int64
+	value := utils.RandomValue(1024)
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := sharded.Put(utils.GetTestKey(int(atomic.AddInt64(&i, 1))), value)
+			assert.Nil(b, err)
+		}
+	})
+}
+
+// SyncWrites 打开时，并发的写入共享一次 sync，写入方越多平均每次写入的耗时越低
+func Benchmark_SyncPut(b *testing.B) {
+	for _, writers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("writers-%d", writers), func(b *testing.B) {
+			options := aperture.DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-bench-sync")
+			options.DirPath = dir
+			options.SyncWrites = true
+			syncDB, err := aperture.Open(options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() {
+				_ = syncDB.Close()
+				_ = os.RemoveAll(dir)
+			}()
+
+			var i int64
+			value := utils.RandomValue(128)
+			b.ResetTimer()
+			b.ReportAllocs()
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						n := atomic.AddInt64(&i, 1)
+						if n > int64(b.N) {
+							return
+						}
+						err := syncDB.Put(utils.GetTestKey(int(n)), value)
+						assert.Nil(b, err)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
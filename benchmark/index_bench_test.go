@@ -0,0 +1,49 @@
+package benchmark
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/index"
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+)
+
+// 每种内存索引保存 indexKeyNum 个 key 之后，平均每个 key 占用的内存(bytes/key)，包括 key 本身
+// go test -bench=Benchmark_IndexMemory -benchtime=1x ./benchmark
+const indexKeyNum = 1000000
+
+func Benchmark_IndexMemory(b *testing.B) {
+	indexes := []struct {
+		name	string
+		typ		index.IndexType
+	}{
+		{"BTree", index.Btree},
+		{"ART", index.ART},
+		{"Compact", index.Compact},
+	}
+	for _, idx := range indexes {
+		b.Run(idx.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				before := heapInUse()
+				indexer, err := index.NewIndexer(idx.typ, "", false, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for i := 0; i < indexKeyNum; i++ {
+					indexer.Put(utils.GetTestKey(i), &data.LogRecordPos{Fid: uint32(i / 10000), Offset: int64(i), Size: 1024})
+				}
+				after := heapInUse()
+				b.ReportMetric(float64(after-before)/indexKeyNum, "bytes/key")
+				runtime.KeepAlive(indexer)
+			}
+		})
+	}
+}
+
+func heapInUse() int64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
@@ -0,0 +1,366 @@
+package aperturekv
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/fio"
+)
+
+// 不小于 BlobThreshold 的 value 单独写到 blob 文件中，数据文件中只保存一条指向 blob 记录的 LogRecordBlobIndex 记录
+// merge 只需要重写这条很小的记录，大的 value 不会被反复拷贝；blob 文件由 GCBlobFiles 单独回收
+// blob 记录和普通的数据记录格式相同，key 用于回收时判断数据是否仍然有效
+
+// 打开 blob 文件，读取加密的数据时使用数据库的 key
+func (db *DB) openBlobFile(fileId uint32) (*data.DataFile, error) {
+	var blobFile *data.DataFile
+	if db.usePooledIO(db.options.DirPath, fio.StandardFIO) {
+		ioManager, err := db.fdPool.Open(data.GetBlobFileName(db.options.DirPath, fileId))
+		if err != nil {
+			return nil, err
+		}
+		blobFile = data.NewDataFile(fileId, ioManager)
+	} else {
+		var err error
+		if blobFile, err = data.OpenBlobFile(db.options.DirPath, fileId, fio.StandardFIO); err != nil {
+			return nil, err
+		}
+	}
+	blobFile.Encryptor = db.encryptor
+	return blobFile, nil
+}
+
+// 调用方需要持有数据库的锁
+func (db *DB) setActiveBlobFile() error {
+	var fileId uint32 = 0
+	if db.activeBlobFile != nil {
+		fileId = db.activeBlobFile.FileId + 1
+	}
+	blobFile, err := db.openBlobFile(fileId)
+	if err != nil {
+		return err
+	}
+	db.activeBlobFile = blobFile
+	return nil
+}
+
+// 调用方需要持有数据库的锁
+func (db *DB) getBlobFile(fileId uint32) *data.DataFile {
+	if db.activeBlobFile != nil && db.activeBlobFile.FileId == fileId {
+		return db.activeBlobFile
+	}
+	return db.olderBlobFiles[fileId]
+}
+
+// 把 value 写到活跃的 blob 文件中，返回 blob 记录的位置，调用方需要持有数据库的锁
+func (db *DB) appendBlob(key []byte, value []byte) (*data.LogRecordPos, error) {
+	if db.activeBlobFile == nil {
+		if err := db.setActiveBlobFile(); err != nil {
+			return nil, err
+		}
+	}
+	encRecord, size, err := db.encodeLogRecord(&data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal})
+	if err != nil {
+		return nil, err
+	}
+	if db.activeBlobFile.WriteOff > 0 && db.activeBlobFile.WriteOff+size > db.options.BlobFileSize {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			db.failSync(err)
+			return nil, err
+		}
+		db.olderBlobFiles[db.activeBlobFile.FileId] = db.activeBlobFile
+		if err := db.setActiveBlobFile(); err != nil {
+			return nil, err
+		}
+	}
+	writeOff := db.activeBlobFile.WriteOff
+	if err := db.activeBlobFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	db.addUnsyncedBytes(size)
+	return &data.LogRecordPos{Fid: db.activeBlobFile.FileId, Offset: writeOff, Size: uint32(size)}, nil
+}
+
+// LogRecordBlobIndex 记录指向的 blob 记录的位置，其他记录返回 nil
+func blobPosOf(logRecord *data.LogRecord) *data.LogRecordPos {
+	if logRecord.Type != data.LogRecordBlobIndex {
+		return nil
+	}
+	return data.DecodeLogRecordPos(logRecord.Value)
+}
+
+func readBlobValue(blobFile *data.DataFile, blobPos *data.LogRecordPos) ([]byte, error) {
+	if blobFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	logRecord, _, err := blobFile.ReadLogRecord(blobPos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return logRecord.Value, nil
+}
+
+// 把 cursor 读到的 LogRecordBlobIndex 记录替换为 blob 中的 value，调用方不能持有数据库的锁
+// blob 文件在 endLogRead 之前不会被关闭；blob 已经被回收时 value 为 nil，只有被覆盖、删除或者过期的数据才会被回收
+func (db *DB) resolveBlob(c *logCursor, logRecord *data.LogRecord) error {
+	blobPos := blobPosOf(logRecord)
+	if blobPos == nil {
+		return nil
+	}
+	db.mu.RLock()
+	blobFile := db.getBlobFile(blobPos.Fid)
+	if blobFile != nil {
+		c.lock.Lock()
+		c.reading = append(c.reading, blobFile)
+		c.lock.Unlock()
+	}
+	db.mu.RUnlock()
+
+	var value []byte
+	if blobFile != nil {
+		var err error
+		if value, err = readBlobValue(blobFile, blobPos); err != nil {
+			return err
+		}
+	}
+	logRecord.Type = data.LogRecordNormal
+	logRecord.Value = value
+	return nil
+}
+
+// 不包含 blob 的位置索引，用于只统计数据文件中的无效数据
+func withoutBlob(pos *data.LogRecordPos) *data.LogRecordPos {
+	if pos.Blob == nil {
+		return pos
+	}
+	stripped := *pos
+	stripped.Blob = nil
+	return &stripped
+}
+
+// 统计 blob 文件中的无效数据，调用方需要持有数据库的锁
+func (db *DB) addBlobReclaimSize(blobPos *data.LogRecordPos) {
+	db.blobReclaimSize[blobPos.Fid] += int64(blobPos.Size)
+}
+
+// 加载 blob 文件，活跃 blob 文件末尾没有写完整的数据会被截断
+func (db *DB) loadBlobFiles() error {
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	var fileIds []int
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.BlobFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.BlobFileNameSuffix))
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Ints(fileIds)
+	for i, fid := range fileIds {
+		blobFile, err := db.openBlobFile(uint32(fid))
+		if err != nil {
+			return err
+		}
+		if i < len(fileIds)-1 {
+			db.olderBlobFiles[uint32(fid)] = blobFile
+			continue
+		}
+		db.activeBlobFile = blobFile
+		if err := db.recoverActiveBlobFile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 找到活跃 blob 文件中完整数据的末尾，之后的数据是写入时崩溃留下的，没有被任何数据记录引用
+func (db *DB) recoverActiveBlobFile() error {
+	blobFile := db.activeBlobFile
+	var offset int64
+	for {
+		_, size, err := blobFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !db.canDropCorrupted(true, err) {
+				return err
+			}
+			break
+		}
+		offset += size
+	}
+	fileSize, err := blobFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if offset < fileSize {
+		if db.options.RecoveryMode == RecoverStrict {
+			return ErrDataDirectoryCorrupted
+		}
+		if err := os.Truncate(data.GetBlobFileName(db.options.DirPath, blobFile.FileId), offset); err != nil {
+			return err
+		}
+	}
+	blobFile.WriteOff = offset
+	return nil
+}
+
+// blob 文件的总大小，调用方需要持有数据库的锁
+func (db *DB) blobFilesSize() (int64, error) {
+	var total int64
+	for _, blobFile := range db.blobFileList() {
+		size, err := blobFile.IoManager.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// 所有的 blob 文件，按文件 id 排序
+func (db *DB) blobFileList() []*data.DataFile {
+	blobFiles := make([]*data.DataFile, 0, len(db.olderBlobFiles)+1)
+	for _, blobFile := range db.olderBlobFiles {
+		blobFiles = append(blobFiles, blobFile)
+	}
+	if db.activeBlobFile != nil {
+		blobFiles = append(blobFiles, db.activeBlobFile)
+	}
+	sort.Slice(blobFiles, func(i, j int) bool {
+		return blobFiles[i].FileId < blobFiles[j].FileId
+	})
+	return blobFiles
+}
+
+// GCBlobFiles 回收无效数据比例达到 BlobGCRatio 的旧 blob 文件
+// 仍然有效的 value 会重新写到活跃的 blob 文件中，并在数据文件中写一条新的索引记录，之后删除旧的 blob 文件
+func (db *DB) GCBlobFiles() error {
+	if db.replica != nil {
+		return ErrReadOnlyReplica
+	}
+	db.mu.Lock()
+	if db.isMerging {
+		db.mu.Unlock()
+		return ErrMergeInProgress
+	}
+	if db.isBackingUp {
+		db.mu.Unlock()
+		return ErrBackupInProgress
+	}
+	db.collectExpired()
+	var gcFiles []*data.DataFile
+	for fid, blobFile := range db.olderBlobFiles {
+		size, err := blobFile.IoManager.Size()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if size > 0 && float32(db.blobReclaimSize[fid])/float32(size) >= db.options.BlobGCRatio {
+			gcFiles = append(gcFiles, blobFile)
+		}
+	}
+	if len(gcFiles) == 0 {
+		db.mu.Unlock()
+		return ErrMergeRatioUnreached
+	}
+	// 和 merge 互斥，merge 期间数据文件中的记录会被重写
+	db.isMerging = true
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.isMerging = false
+		db.mu.Unlock()
+	}()
+
+	for _, blobFile := range gcFiles {
+		if err := db.rewriteBlobFile(blobFile); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 新的位置持久化之后才能删除旧的 blob 文件，等待 sync 的写入也不会再回滚到旧的 blob 中
+	if err := db.syncWithLock(); err != nil {
+		return err
+	}
+	for _, blobFile := range gcFiles {
+		if err := db.retireDataFile(blobFile); err != nil {
+			return err
+		}
+		if err := os.Remove(data.GetBlobFileName(db.options.DirPath, blobFile.FileId)); err != nil {
+			return err
+		}
+		delete(db.olderBlobFiles, blobFile.FileId)
+		delete(db.blobReclaimSize, blobFile.FileId)
+	}
+	return nil
+}
+
+// 把 blob 文件中仍然有效的 value 重写到活跃的 blob 文件中
+// 每条数据单独加锁，写入不会被长时间阻塞
+func (db *DB) rewriteBlobFile(blobFile *data.DataFile) error {
+	var offset int64
+	for {
+		logRecord, size, err := blobFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		if err := db.rewriteBlob(realKey, logRecord.Value, blobFile.FileId, offset); err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+func (db *DB) rewriteBlob(key []byte, value []byte, fileId uint32, offset int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	pos := db.index.Get(key)
+	if pos == nil || pos.Blob == nil || pos.Blob.Fid != fileId || pos.Blob.Offset != offset || isExpired(pos.Expire) {
+		return nil
+	}
+	newPos, err := db.appendLogRecord(&data.LogRecord{
+		Key:	logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:	value,
+		Type:	data.LogRecordNormal,
+		Expire:	pos.Expire,
+	})
+	if err != nil {
+		return err
+	}
+	if oldPos := db.index.Put(key, newPos); oldPos != nil {
+		db.addReclaimSize(oldPos)
+	}
+	return nil
+}
+
+// 持久化活跃的 blob 文件和数据文件，调用方需要持有数据库的锁
+func (db *DB) syncBlobAndActiveFile() error {
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package aperturekv
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_BlobFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob")
+	opts.DirPath = dir
+	opts.BlobThreshold = 1024
+	opts.BlobFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.BlobGCRatio = 0.5
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	// 大的 value 写到 blob 文件中，小的 value 仍然在数据文件中
+	large := func(i int) []byte {
+		return bytes.Repeat(utils.GetTestKey(i), 4096/len(utils.GetTestKey(i)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), large(i)))
+	}
+	assert.Nil(t, db.Put([]byte("small"), []byte("value")))
+	stat := db.Stat()
+	assert.True(t, stat.BlobFileNum > 1)
+	assert.True(t, stat.DataFiles[0].Size < 100*100)
+
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, large(i), val)
+	}
+	val, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// 订阅读到的是真正的 value
+	change := <-sub.Changes()
+	assert.Equal(t, utils.GetTestKey(0), change.Records[0].Key)
+	assert.Equal(t, large(0), change.Records[0].Value)
+
+	// 快照和迭代器
+	snap := db.Snapshot()
+	for i := 0; i < 80; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	val, err = snap.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, large(0), val)
+	it := db.NewIterator(DefaultIteratorOptions)
+	it.Seek(utils.GetTestKey(80))
+	val, err = it.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, large(80), val)
+	it.Close()
+	assert.True(t, db.Stat().BlobReclaimableSize >= 80*4096)
+
+	// merge 只重写数据文件，不会拷贝 blob 文件中的 value
+	before := db.Stat().BlobFileNum
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, before, db.Stat().BlobFileNum)
+	val, err = db.Get(utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.Equal(t, large(99), val)
+
+	// 回收 blob 文件，快照释放之前仍然可以读取被回收的数据
+	assert.Nil(t, db.GCBlobFiles())
+	stat = db.Stat()
+	assert.True(t, stat.BlobFileNum < before)
+	assert.True(t, stat.BlobReclaimableSize < 80*4096)
+	val, err = snap.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, large(0), val)
+	snap.Release()
+	assert.Equal(t, ErrMergeRatioUnreached, db.GCBlobFiles())
+	for i := 80; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, large(i), val)
+	}
+
+	// 重启之后从数据文件和 hint 文件中恢复 blob 的位置
+	sub.Close()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 21, len(db.ListKeys()))
+	for i := 80; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, large(i), val)
+	}
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 副本不会复制 blob 文件
+	_, err = db.ServeReplication("127.0.0.1:0")
+	assert.Equal(t, ErrBlobNotReplicated, err)
+}
@@ -0,0 +1,83 @@
+package aperturekv
+
+import (
+	"sync/atomic"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/index"
+)
+
+// B+ 树索引存储在磁盘上，查询不存在的 key 也需要打开一个 bbolt 的读事务
+// 内存中保存索引里所有 key 的布隆过滤器，过滤器判断 key 不存在时直接返回
+// 布隆过滤器不支持删除，被删除的 key 会一直留在过滤器中，直到启动或者 merge 时重新构建
+
+// 布隆过滤器的最小容量，避免数据库为空时频繁扩容
+const minBloomFilterCapacity = 1024
+
+type BloomFilterStat struct {
+	Keys				int		// 添加到过滤器中的 key 的数量，包括之后被删除的 key
+	MemSize				int64	// 占用的内存大小(Bytes)
+	EstimatedFPRate		float64	// 根据过滤器的填充程度估算的误判率
+	Negatives			uint64	// 过滤器判断 key 不存在，跳过了索引查询的次数
+	FalsePositives		uint64	// 过滤器判断 key 可能存在，查询索引之后发现不存在的次数
+	FalsePositiveRate	float64	// 实际的误判率，FalsePositives / (Negatives + FalsePositives)
+}
+
+// 根据当前的索引重新构建布隆过滤器，调用方需要持有数据库的锁
+func (db *DB) rebuildBloomFilter() {
+	if db.options.IndexType != BPlusTree || db.options.BloomFilterFPRate <= 0 {
+		return
+	}
+	capacity := db.index.Size()
+	if capacity < minBloomFilterCapacity {
+		capacity = minBloomFilterCapacity
+	}
+	bloomFilter := index.NewBloomFilter(capacity, db.options.BloomFilterFPRate)
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		bloomFilter.Add(iterator.Key())
+	}
+	db.bloomFilter = bloomFilter
+}
+
+// 调用方需要持有数据库的锁
+func (db *DB) addToBloomFilter(key []byte) {
+	if db.bloomFilter != nil {
+		db.bloomFilter.Add(key)
+	}
+}
+
+// 先检查布隆过滤器再查询索引，调用方需要持有数据库的锁（读锁即可）
+func (db *DB) lookupIndex(key []byte) *data.LogRecordPos {
+	if db.bloomFilter == nil {
+		return db.index.Get(key)
+	}
+	if !db.bloomFilter.MayContain(key) {
+		atomic.AddUint64(&db.bloomNegatives, 1)
+		return nil
+	}
+	pos := db.index.Get(key)
+	if pos == nil {
+		atomic.AddUint64(&db.bloomFalsePositives, 1)
+	}
+	return pos
+}
+
+// 调用方需要持有数据库的锁
+func (db *DB) bloomFilterStat() *BloomFilterStat {
+	if db.bloomFilter == nil {
+		return nil
+	}
+	stat := &BloomFilterStat{
+		Keys:				db.bloomFilter.Count(),
+		MemSize:			db.bloomFilter.MemSize(),
+		EstimatedFPRate:	db.bloomFilter.EstimatedFPRate(),
+		Negatives:			atomic.LoadUint64(&db.bloomNegatives),
+		FalsePositives:		atomic.LoadUint64(&db.bloomFalsePositives),
+	}
+	if total := stat.Negatives + stat.FalsePositives; total > 0 {
+		stat.FalsePositiveRate = float64(stat.FalsePositives) / float64(total)
+	}
+	return stat
+}
@@ -0,0 +1,74 @@
+package aperturekv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_BloomFilter(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	for i := 0; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// 不存在的 key 大部分被过滤器拦下
+	for i := 2000; i < 4000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	stat := db.Stat().BloomFilter
+	assert.NotNil(t, stat)
+	assert.Equal(t, 2000, stat.Keys)
+	assert.Equal(t, uint64(2000), stat.Negatives+stat.FalsePositives)
+	assert.True(t, stat.FalsePositiveRate < 0.05)
+
+	// 被删除的 key 仍然在过滤器中，merge 之后重新构建
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2000, db.Stat().BloomFilter.Keys)
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, 1000, db.Stat().BloomFilter.Keys)
+	val, err := db.Get(utils.GetTestKey(1500))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 重启时根据索引重新构建
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, db.Stat().BloomFilter.Keys)
+	val, err = db.Get([]byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 其他索引类型不使用布隆过滤器
+	opts2 := DefaultOptions
+	dir2, _ := os.MkdirTemp("", "bitcask-go-bloom-btree")
+	opts2.DirPath = dir2
+	db2, err := Open(opts2)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Nil(t, db2.Stat().BloomFilter)
+}
@@ -0,0 +1,180 @@
+package aperturekv
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+)
+
+// 热点 value 的 LRU 缓存，命中时不需要读取数据文件和校验 CRC
+// 数据文件只会追加写，同一个 (Fid, Offset) 上的数据不会改变；但是 merge 之后的数据文件会复用旧的文件 id，
+// 所以缓存中同时记录了读取的数据文件，只有是同一个文件时才算命中，被 merge 替换掉的文件的缓存会被清除
+
+// 每条缓存除了 value 之外的内存开销的估计值
+const valueCacheEntryOverhead = 128
+
+type valueCacheKey struct {
+	fid		uint32
+	offset	int64
+	blob	bool	// 是否是 blob 文件，blob 文件和数据文件的 id 是分开的
+}
+
+type valueCacheEntry struct {
+	key			valueCacheKey
+	dataFile	*data.DataFile
+	value		[]byte
+}
+
+type valueCache struct {
+	lock		sync.Mutex
+	capacity	int64
+	size		int64
+	lru			*list.List	// 最近使用的在前面
+	entries		map[valueCacheKey]*list.Element
+	fileOffsets	map[valueCacheKey]map[int64]struct{}	// 每个文件中被缓存的位置，key 中的 offset 为 0
+	hits		uint64
+	misses		uint64
+}
+
+type ValueCacheStat struct {
+	Entries	int		// 缓存的 value 数量
+	Size	int64	// 缓存占用的内存大小(Bytes)
+	Hits	uint64	// 命中的次数
+	Misses	uint64	// 没有命中的次数
+}
+
+// capacity 为 0 时不缓存，返回 nil
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{
+		capacity:		capacity,
+		lru:			list.New(),
+		entries:		make(map[valueCacheKey]*list.Element),
+		fileOffsets:	make(map[valueCacheKey]map[int64]struct{}),
+	}
+}
+
+// 先从缓存中读取 dataFile 在 offset 上的 value，没有命中时调用 read 读取并放入缓存
+// 返回的 value 是拷贝，调用方可以修改；c 为 nil 时直接调用 read
+func (c *valueCache) getOrRead(dataFile *data.DataFile, offset int64, blob bool, read func() ([]byte, error)) ([]byte, error) {
+	if c == nil || dataFile == nil {
+		return read()
+	}
+	key := valueCacheKey{fid: dataFile.FileId, offset: offset, blob: blob}
+	if value, ok := c.get(key, dataFile); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return value, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+	value, err := read()
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, dataFile, value)
+	return copyValue(value), nil
+}
+
+func (c *valueCache) get(key valueCacheKey, dataFile *data.DataFile) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*valueCacheEntry)
+	if entry.dataFile != dataFile {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return copyValue(entry.value), true
+}
+
+func (c *valueCache) put(key valueCacheKey, dataFile *data.DataFile, value []byte) {
+	size := int64(len(value)) + valueCacheEntryOverhead
+	if size > c.capacity {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	elem := c.lru.PushFront(&valueCacheEntry{key: key, dataFile: dataFile, value: value})
+	c.entries[key] = elem
+	fileKey := valueCacheKey{fid: key.fid, blob: key.blob}
+	if c.fileOffsets[fileKey] == nil {
+		c.fileOffsets[fileKey] = make(map[int64]struct{})
+	}
+	c.fileOffsets[fileKey][key.offset] = struct{}{}
+	c.size += size
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// 调用方需要持有缓存的锁
+func (c *valueCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*valueCacheEntry)
+	delete(c.entries, entry.key)
+	fileKey := valueCacheKey{fid: entry.key.fid, blob: entry.key.blob}
+	delete(c.fileOffsets[fileKey], entry.key.offset)
+	if len(c.fileOffsets[fileKey]) == 0 {
+		delete(c.fileOffsets, fileKey)
+	}
+	c.size -= int64(len(entry.value)) + valueCacheEntryOverhead
+}
+
+// 清除 dataFile 的所有缓存，数据文件被 merge 替换或者 blob 文件被回收时调用
+func (c *valueCache) removeFile(dataFile *data.DataFile) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, blob := range []bool{false, true} {
+		fileKey := valueCacheKey{fid: dataFile.FileId, blob: blob}
+		for offset := range c.fileOffsets[fileKey] {
+			elem := c.entries[valueCacheKey{fid: dataFile.FileId, offset: offset, blob: blob}]
+			if elem.Value.(*valueCacheEntry).dataFile == dataFile {
+				c.remove(elem)
+			}
+		}
+	}
+}
+
+func (c *valueCache) stat() *ValueCacheStat {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &ValueCacheStat{
+		Entries:	len(c.entries),
+		Size:		c.size,
+		Hits:		atomic.LoadUint64(&c.hits),
+		Misses:		atomic.LoadUint64(&c.misses),
+	}
+}
+
+// 读取数据文件中的 value，优先从缓存中读取
+func (db *DB) readCachedValue(dataFile *data.DataFile, logRecordPos *data.LogRecordPos) ([]byte, error) {
+	return db.valueCache.getOrRead(dataFile, logRecordPos.Offset, false, func() ([]byte, error) {
+		return readValue(dataFile, logRecordPos)
+	})
+}
+
+func (db *DB) readCachedBlobValue(blobFile *data.DataFile, blobPos *data.LogRecordPos) ([]byte, error) {
+	return db.valueCache.getOrRead(blobFile, blobPos.Offset, true, func() ([]byte, error) {
+		return readBlobValue(blobFile, blobPos)
+	})
+}
+
+func copyValue(value []byte) []byte {
+	buf := make([]byte, len(value))
+	copy(buf, value)
+	return buf
+}
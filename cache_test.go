@@ -0,0 +1,79 @@
+package aperturekv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ValueCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-value-cache")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.ValueCacheSize = 64 * 1024
+	opts.BlobThreshold = 512
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(100)))
+	}
+	assert.Nil(t, db.Put([]byte("blob"), utils.RandomValue(1024)))
+
+	// 第一次读取没有命中，之后都命中缓存
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		cached, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, val, cached)
+	}
+	blobVal, err := db.Get([]byte("blob"))
+	assert.Nil(t, err)
+	cached, err := db.Get([]byte("blob"))
+	assert.Nil(t, err)
+	assert.Equal(t, blobVal, cached)
+	stat := db.Stat().ValueCache
+	assert.Equal(t, uint64(11), stat.Hits)
+	assert.Equal(t, uint64(2), stat.Misses)
+	assert.Equal(t, 2, stat.Entries)
+
+	// 修改返回的 value 不影响缓存
+	cached[0]++
+	cached, err = db.Get([]byte("blob"))
+	assert.Nil(t, err)
+	assert.Equal(t, blobVal, cached)
+
+	// 缓存的大小不超过上限
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, db.Stat().ValueCache.Size <= opts.ValueCacheSize)
+
+	// merge 之后数据文件的 id 被复用，旧文件的缓存被清除
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+	}
+	values := make(map[int][]byte)
+	for i := 1; i < 1000; i += 2 {
+		values[i], _ = db.Get(utils.GetTestKey(i))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 1; i < 1000; i += 2 {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
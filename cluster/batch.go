@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"sync"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+)
+
+var (
+	batchPut	= []byte{'p'}
+	batchDelete	= []byte{'d'}
+)
+
+// 集群中的批量写入，Commit 时作为一条命令写入 raft 日志，在每个节点上通过 WriteBatch 原子地应用
+type WriteBatch struct {
+	options	aperturekv.WriteBatchOptions
+	mu		sync.Mutex
+	node	*Node
+	args	[][]byte	// 按顺序排列的 (类型, key, value)
+	count	uint
+}
+
+func (n *Node) NewWriteBatch(opts aperturekv.WriteBatchOptions) *WriteBatch {
+	return &WriteBatch{options: opts, node: n}
+}
+
+func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return aperturekv.ErrKeyIsEmpty
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.args = append(wb.args, batchPut, key, value)
+	wb.count++
+	return nil
+}
+
+func (wb *WriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return aperturekv.ErrKeyIsEmpty
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.args = append(wb.args, batchDelete, key, nil)
+	wb.count++
+	return nil
+}
+
+func (wb *WriteBatch) Commit() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if wb.count == 0 {
+		return nil
+	}
+	if wb.count > wb.options.MaxBatchNum {
+		return aperturekv.ErrExceedMaxBatchNum
+	}
+	if _, err := wb.node.Propose(OpBatch, wb.args...); err != nil {
+		return err
+	}
+	wb.args, wb.count = nil, 0
+	return nil
+}
+
+func applyBatch(db *aperturekv.DB, args [][]byte) ([]byte, error) {
+	if len(args)%3 != 0 {
+		return nil, ErrInvalidArgs
+	}
+	// 提交之前已经检查过数量，应用时不能因为配置不同而失败
+	wb := db.NewWriteBatch(aperturekv.WriteBatchOptions{MaxBatchNum: uint(len(args) / 3), SyncWrites: true})
+	for i := 0; i < len(args); i += 3 {
+		var err error
+		switch string(args[i]) {
+		case string(batchPut):
+			err = wb.Put(args[i+1], args[i+2])
+		case string(batchDelete):
+			err = wb.Delete(args[i+1])
+		default:
+			err = ErrInvalidArgs
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, wb.Commit()
+}
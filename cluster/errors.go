@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"errors"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+)
+
+var (
+	ErrNotLeader		= errors.New("the node is not the leader of the cluster")
+	ErrNoLeader			= errors.New("the cluster has no leader, try again later")
+	ErrLeadershipLost	= errors.New("the leadership was lost before the command was committed")
+	ErrProposalTimeout	= errors.New("timeout waiting for the command to be committed")
+	ErrNodeClosed		= errors.New("the node has been closed")
+	ErrUnknownCommand	= errors.New("unknown command in raft log")
+	ErrInvalidArgs		= errors.New("invalid arguments for the command")
+	ErrPeerUnreachable	= errors.New("the peer is unreachable")
+)
+
+// 通过 RPC 返回的错误只剩下错误信息，转换回调用方可以比较的错误
+var knownErrors = []error{
+	ErrNotLeader,
+	ErrNoLeader,
+	ErrLeadershipLost,
+	ErrProposalTimeout,
+	ErrNodeClosed,
+	ErrUnknownCommand,
+	ErrInvalidArgs,
+	ErrPeerUnreachable,
+	aperturekv.ErrKeyIsEmpty,
+	aperturekv.ErrKeyNotFound,
+	aperturekv.ErrExceedMaxBatchNum,
+}
+
+func decodeError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, err := range knownErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+func encodeError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,448 @@
+package cluster
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+)
+
+const (
+	dataDirName	= "data"
+	raftDirName	= "raft"
+
+	// 发送一个快照分片的超时时间
+	snapshotTimeout = time.Second * 10
+)
+
+// 内置的命令
+const (
+	OpPut		= "put"
+	OpDelete	= "delete"
+	OpBatch		= "batch"
+)
+
+// 在状态机的数据库上执行一条命令，所有节点按相同的顺序执行相同的命令，实现必须是确定性的
+type ApplyFunc func(db *aperturekv.DB, args [][]byte) ([]byte, error)
+
+type Config struct {
+	Dir					string				// 节点的目录，包含状态机的数据库、raft 日志和快照
+	RaftAddr			string				// 节点之间通信的地址，同时也是节点的 id
+	DBOptions			aperturekv.Options	// 状态机数据库的配置项，DirPath 会被忽略
+	ElectionTimeout		time.Duration		// 选举超时，实际的超时时间在 [ElectionTimeout, 2*ElectionTimeout) 之间随机
+	HeartbeatInterval	time.Duration		// leader 发送心跳的间隔
+	SnapshotThreshold	uint64				// 应用了多少条日志之后生成快照，为 0 时不生成快照
+	ProposeTimeout		time.Duration		// 等待命令提交的超时时间
+	Commands			map[string]ApplyFunc	// 自定义的命令，所有节点上需要一致
+}
+
+var DefaultConfig = Config{
+	RaftAddr:			"127.0.0.1:0",
+	DBOptions:			aperturekv.DefaultOptions,
+	ElectionTimeout:	time.Millisecond * 300,
+	HeartbeatInterval:	time.Millisecond * 50,
+	SnapshotThreshold:	10000,
+	ProposeTimeout:		time.Second * 5,
+}
+
+// Node 是集群中的一个节点，写入经过 raft 日志复制到所有节点之后，应用到每个节点自己的数据库上
+// 读取直接访问本地的数据库，follower 上可能读到稍旧的数据
+type Node struct {
+	cfg			Config
+	id			string
+	peers		[]string
+	transport	*transport
+	store		*raftStore
+	commands	map[string]ApplyFunc
+
+	installMu	sync.Mutex		// 串行接收快照
+	snapMu		sync.RWMutex	// 保护快照目录
+	dbMu		sync.RWMutex	// 安装快照时会替换数据库
+	db			*aperturekv.DB
+
+	mu					sync.Mutex
+	state				nodeState
+	currentTerm			uint64
+	votedFor			string
+	leaderId			string
+	log					[]LogEntry	// log[0] 是快照中最后一条日志的位置，之后是快照之后的日志
+	commitIndex			uint64
+	lastApplied			uint64
+	nextIndex			map[string]uint64
+	matchIndex			map[string]uint64
+	electionDeadline	time.Time
+	applyCond			*sync.Cond
+	waiters				map[uint64]*proposal
+	replicateChs		map[string]chan struct{}
+	started				bool
+	closed				bool
+	closeCh				chan struct{}
+	wg					sync.WaitGroup
+}
+
+// 等待提交的命令
+type proposal struct {
+	term	uint64
+	doneCh	chan proposalResult
+}
+
+type proposalResult struct {
+	value	[]byte
+	err		error
+}
+
+// NewNode 加载节点的状态并开始监听 RaftAddr，调用 Start 之后加入集群
+// 状态机的数据库从快照恢复，之后重新应用快照之后的日志
+func NewNode(cfg Config) (*Node, error) {
+	if err := os.MkdirAll(cfg.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:			cfg,
+		commands:		map[string]ApplyFunc{
+			OpPut:		applyPut,
+			OpDelete:	applyDelete,
+			OpBatch:	applyBatch,
+		},
+		nextIndex:		make(map[string]uint64),
+		matchIndex:		make(map[string]uint64),
+		waiters:		make(map[uint64]*proposal),
+		replicateChs:	make(map[string]chan struct{}),
+		closeCh:		make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	for op, fn := range cfg.Commands {
+		n.commands[op] = fn
+	}
+	if err := n.load(); err != nil {
+		if n.store != nil {
+			_ = n.store.close()
+		}
+		return nil, err
+	}
+
+	transport, err := newTransport(cfg.RaftAddr, &rpcService{n: n})
+	if err != nil {
+		_ = n.db.Close()
+		_ = n.store.close()
+		return nil, err
+	}
+	n.transport = transport
+	n.id = transport.addr()
+	return n, nil
+}
+
+func (n *Node) load() error {
+	store, err := openRaftStore(n.path(raftDirName))
+	if err != nil {
+		return err
+	}
+	n.store = store
+	if n.currentTerm, n.votedFor, err = store.loadState(); err != nil {
+		return err
+	}
+
+	base := LogEntry{}
+	meta, err := readSnapshotMeta(n.path(snapshotDirName))
+	if err == nil {
+		base.Index, base.Term = meta.Index, meta.Term
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	entries, err := store.loadEntries()
+	if err != nil {
+		return err
+	}
+	n.log = []LogEntry{base}
+	for _, entry := range entries {
+		if entry.Index == n.lastEntry().Index+1 {
+			n.log = append(n.log, entry)
+		}
+	}
+	n.commitIndex, n.lastApplied = base.Index, base.Index
+
+	db, err := n.restoreDB()
+	if err != nil {
+		return err
+	}
+	n.db = db
+	return nil
+}
+
+// Start 和 peers 组成集群，peers 是其他节点的 RaftAddr
+func (n *Node) Start(peers []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.started || n.closed {
+		return
+	}
+	n.started = true
+	for _, peer := range peers {
+		if peer == n.id {
+			continue
+		}
+		n.peers = append(n.peers, peer)
+		n.replicateChs[peer] = make(chan struct{}, 1)
+	}
+	n.resetElectionTimer()
+
+	n.wg.Add(len(n.peers) + 2)
+	for _, peer := range n.peers {
+		go n.runReplicator(peer)
+	}
+	go n.runElectionTimer()
+	go n.runApplier()
+}
+
+// 节点的 id，也就是实际监听的 raft 地址
+func (n *Node) Addr() string {
+	return n.id
+}
+
+// 当前的 leader，不知道时返回空字符串
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderId
+}
+
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == leader
+}
+
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.closeCh)
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+
+	n.transport.close()
+	n.wg.Wait()
+
+	n.dbMu.Lock()
+	defer n.dbMu.Unlock()
+	if err := n.db.Close(); err != nil {
+		_ = n.store.close()
+		return err
+	}
+	return n.store.close()
+}
+
+func (n *Node) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return aperturekv.ErrKeyIsEmpty
+	}
+	_, err := n.Propose(OpPut, key, value)
+	return err
+}
+
+func (n *Node) Delete(key []byte) error {
+	if len(key) == 0 {
+		return aperturekv.ErrKeyIsEmpty
+	}
+	_, err := n.Propose(OpDelete, key)
+	return err
+}
+
+// 读取本地数据库中的数据
+func (n *Node) Get(key []byte) ([]byte, error) {
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	return n.db.Get(key)
+}
+
+func (n *Node) ListKeys() [][]byte {
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	return n.db.ListKeys()
+}
+
+func (n *Node) Stat() *aperturekv.Stat {
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	return n.db.Stat()
+}
+
+// 在本地数据库上执行只读的操作，fn 返回之前数据库不会被快照替换
+func (n *Node) View(fn func(db *aperturekv.DB) error) error {
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	return fn(n.db)
+}
+
+// Propose 把命令写入 raft 日志，等到它在本节点上应用之后返回 ApplyFunc 的结果
+// follower 会把命令转发给 leader
+func (n *Node) Propose(op string, args ...[]byte) ([]byte, error) {
+	p, leaderId, err := n.appendProposal(op, args)
+	if err == ErrNotLeader {
+		if leaderId == "" {
+			return nil, ErrNoLeader
+		}
+		return n.forward(leaderId, op, args)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n.waitProposal(p)
+}
+
+func (n *Node) appendProposal(op string, args [][]byte) (*proposal, string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, "", ErrNodeClosed
+	}
+	if n.state != leader {
+		return nil, n.leaderId, ErrNotLeader
+	}
+	if _, ok := n.commands[op]; !ok {
+		return nil, n.leaderId, ErrUnknownCommand
+	}
+	// 日志会一直留在内存中，不能引用调用方的 buffer
+	entryArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		entryArgs[i] = append([]byte(nil), arg...)
+	}
+	entry := LogEntry{
+		Index:	n.lastEntry().Index + 1,
+		Term:	n.currentTerm,
+		Op:		op,
+		Args:	entryArgs,
+	}
+	if err := n.store.appendEntries([]LogEntry{entry}); err != nil {
+		return nil, n.leaderId, err
+	}
+	n.log = append(n.log, entry)
+
+	p := &proposal{term: entry.Term, doneCh: make(chan proposalResult, 1)}
+	n.waiters[entry.Index] = p
+	n.advanceCommitIndex()
+	n.triggerReplication()
+	return p, n.leaderId, nil
+}
+
+func (n *Node) waitProposal(p *proposal) ([]byte, error) {
+	timer := time.NewTimer(n.cfg.ProposeTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-p.doneCh:
+		return result.value, result.err
+	case <-timer.C:
+		return nil, ErrProposalTimeout
+	case <-n.closeCh:
+		return nil, ErrNodeClosed
+	}
+}
+
+func (n *Node) forward(leaderId, op string, args [][]byte) ([]byte, error) {
+	forwardArgs := &ForwardArgs{From: n.id, Op: op, Args: args}
+	reply := &ForwardReply{}
+	timeout := n.cfg.ProposeTimeout + n.cfg.ElectionTimeout
+	if err := n.transport.call(leaderId, "Forward", forwardArgs, reply, timeout); err != nil {
+		return nil, decodeError(err.Error())
+	}
+	return reply.Result, decodeError(reply.Err)
+}
+
+func (n *Node) runElectionTimer() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closeCh:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		if n.state != leader && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// 按顺序把提交的日志应用到数据库上
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for !n.closed && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		closed := n.closed
+		n.mu.Unlock()
+		if closed {
+			return
+		}
+		n.applyCommitted()
+		n.maybeSnapshot()
+	}
+}
+
+func (n *Node) applyCommitted() {
+	// 持有读锁期间数据库不会被快照替换，lastApplied 也不会跳过
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	for {
+		n.mu.Lock()
+		if n.closed || n.lastApplied >= n.commitIndex {
+			n.mu.Unlock()
+			return
+		}
+		entry := n.entry(n.lastApplied + 1)
+		n.mu.Unlock()
+
+		value, err := n.apply(entry)
+
+		n.mu.Lock()
+		n.lastApplied = entry.Index
+		if p, ok := n.waiters[entry.Index]; ok {
+			delete(n.waiters, entry.Index)
+			// 同一个位置上提交的是其他 leader 写入的日志
+			if p.term != entry.Term {
+				value, err = nil, ErrLeadershipLost
+			}
+			p.doneCh <- proposalResult{value: value, err: err}
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) apply(entry LogEntry) ([]byte, error) {
+	if entry.Op == "" {
+		return nil, nil
+	}
+	fn, ok := n.commands[entry.Op]
+	if !ok {
+		return nil, ErrUnknownCommand
+	}
+	return fn(n.db, entry.Args)
+}
+
+func (n *Node) path(name string) string {
+	return filepath.Join(n.cfg.Dir, name)
+}
+
+func applyPut(db *aperturekv.DB, args [][]byte) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, ErrInvalidArgs
+	}
+	return nil, db.Put(args[0], args[1])
+}
+
+func applyDelete(db *aperturekv.DB, args [][]byte) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, ErrInvalidArgs
+	}
+	return nil, db.Delete(args[0])
+}
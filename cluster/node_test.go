@@ -0,0 +1,277 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig(dir string) Config {
+	cfg := DefaultConfig
+	cfg.Dir = dir
+	cfg.ElectionTimeout = time.Millisecond * 150
+	cfg.HeartbeatInterval = time.Millisecond * 30
+	cfg.ProposeTimeout = time.Second
+	cfg.SnapshotThreshold = 100
+	cfg.DBOptions.DataFileSize = 64 * 1024
+	return cfg
+}
+
+// 在本地回环地址上启动一个 size 个节点的集群
+func startCluster(t *testing.T, size int) ([]*Node, []string) {
+	var nodes []*Node
+	var dirs, addrs []string
+	for i := 0; i < size; i++ {
+		dir, _ := os.MkdirTemp("", fmt.Sprintf("bitcask-go-cluster-%d", i))
+		node, err := NewNode(testConfig(dir))
+		assert.Nil(t, err)
+		nodes = append(nodes, node)
+		dirs = append(dirs, dir)
+		addrs = append(addrs, node.Addr())
+	}
+	for _, node := range nodes {
+		node.Start(addrs)
+	}
+	return nodes, dirs
+}
+
+func destroyCluster(nodes []*Node, dirs []string) {
+	for _, node := range nodes {
+		_ = node.Close()
+	}
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// 等待 nodes 选出一个所有节点都认可的 leader
+func waitForLeader(t *testing.T, nodes ...*Node) *Node {
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if !node.IsLeader() {
+				continue
+			}
+			agreed := true
+			for _, other := range nodes {
+				if other.Leader() != node.Addr() {
+					agreed = false
+				}
+			}
+			if agreed {
+				return node
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// 断开 node 和其他节点之间的通信
+func isolate(node *Node, others ...*Node) {
+	for _, other := range others {
+		node.transport.block(other.Addr())
+		other.transport.block(node.Addr())
+	}
+}
+
+func heal(node *Node, others ...*Node) {
+	for _, other := range others {
+		node.transport.unblock(other.Addr())
+		other.transport.unblock(node.Addr())
+	}
+}
+
+// 等待所有节点应用了 leader 已经提交的日志，并且数据一致
+func waitForSync(t *testing.T, leader *Node, nodes ...*Node) {
+	leader.mu.Lock()
+	commitIndex := leader.commitIndex
+	leader.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for _, node := range nodes {
+		for {
+			node.mu.Lock()
+			applied := node.lastApplied
+			node.mu.Unlock()
+			if applied >= commitIndex {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %s did not catch up, applied %d, commit %d", node.Addr(), applied, commitIndex)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Equal(t, leader.ListKeys(), node.ListKeys())
+	}
+}
+
+func others(nodes []*Node, node *Node) []*Node {
+	var result []*Node
+	for _, other := range nodes {
+		if other != node {
+			result = append(result, other)
+		}
+	}
+	return result
+}
+
+func TestCluster_Replicate(t *testing.T) {
+	nodes, dirs := startCluster(t, 3)
+	defer destroyCluster(nodes, dirs)
+
+	leader := waitForLeader(t, nodes...)
+	follower := others(nodes, leader)[0]
+
+	// 写入 follower 的数据转发给 leader
+	for i := 0; i < 50; i++ {
+		err := follower.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err := leader.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	err = follower.Put(nil, []byte("value"))
+	assert.Equal(t, aperturekv.ErrKeyIsEmpty, err)
+
+	wb := follower.NewWriteBatch(aperturekv.DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(100), []byte("batch"))
+	_ = wb.Delete(utils.GetTestKey(1))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	waitForSync(t, leader, nodes...)
+	for _, node := range nodes {
+		_, err := node.Get(utils.GetTestKey(0))
+		assert.Equal(t, aperturekv.ErrKeyNotFound, err)
+		_, err = node.Get(utils.GetTestKey(1))
+		assert.Equal(t, aperturekv.ErrKeyNotFound, err)
+		val, err := node.Get(utils.GetTestKey(100))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("batch"), val)
+		assert.Equal(t, 49, len(node.ListKeys()))
+	}
+}
+
+func TestCluster_LeaderPartition(t *testing.T) {
+	nodes, dirs := startCluster(t, 3)
+	defer destroyCluster(nodes, dirs)
+
+	oldLeader := waitForLeader(t, nodes...)
+	err := oldLeader.Put([]byte("before"), []byte("partition"))
+	assert.Nil(t, err)
+
+	// leader 被隔离之后，剩下的多数派选出新的 leader 并继续写入
+	majority := others(nodes, oldLeader)
+	isolate(oldLeader, majority...)
+	newLeader := waitForLeader(t, majority...)
+	assert.NotEqual(t, oldLeader.Addr(), newLeader.Addr())
+	for i := 0; i < 20; i++ {
+		err := majority[0].Put(utils.GetTestKey(i), []byte("majority"))
+		assert.Nil(t, err)
+	}
+
+	// 少数派上的写入无法提交
+	err = oldLeader.Put([]byte("minority"), []byte("lost"))
+	assert.NotNil(t, err)
+
+	// 恢复之后旧 leader 丢弃没有提交的日志，追上新 leader
+	heal(oldLeader, majority...)
+	leader := waitForLeader(t, nodes...)
+	err = leader.Put([]byte("after"), []byte("heal"))
+	assert.Nil(t, err)
+	waitForSync(t, leader, nodes...)
+	for _, node := range nodes {
+		_, err := node.Get([]byte("minority"))
+		assert.Equal(t, aperturekv.ErrKeyNotFound, err)
+		val, err := node.Get([]byte("before"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("partition"), val)
+		assert.Equal(t, 22, len(node.ListKeys()))
+	}
+}
+
+func TestCluster_InstallSnapshot(t *testing.T) {
+	nodes, dirs := startCluster(t, 3)
+	defer destroyCluster(nodes, dirs)
+
+	leader := waitForLeader(t, nodes...)
+	lagging := others(nodes, leader)[0]
+	isolate(lagging, others(nodes, lagging)...)
+
+	// 写入超过 SnapshotThreshold 的数据，leader 生成快照并删除旧的日志
+	for i := 0; i < 500; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	leader.mu.Lock()
+	snapshotIndex := leader.log[0].Index
+	leader.mu.Unlock()
+	assert.True(t, snapshotIndex > 0)
+
+	// 落后的节点需要的日志已经不存在了，通过快照追上
+	heal(lagging, others(nodes, lagging)...)
+	leader = waitForLeader(t, nodes...)
+	waitForSync(t, leader, nodes...)
+	lagging.mu.Lock()
+	assert.True(t, lagging.log[0].Index >= snapshotIndex)
+	lagging.mu.Unlock()
+	for i := 0; i < 500; i++ {
+		expected, err := leader.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		val, err := lagging.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+}
+
+func TestCluster_Restart(t *testing.T) {
+	nodes, dirs := startCluster(t, 3)
+	defer destroyCluster(nodes, dirs)
+
+	leader := waitForLeader(t, nodes...)
+	for i := 0; i < 250; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	waitForSync(t, leader, nodes...)
+
+	// 重启一个 follower，从快照和之后的日志恢复数据库
+	follower := others(nodes, leader)[0]
+	addr := follower.Addr()
+	err := follower.Close()
+	assert.Nil(t, err)
+	for i := 250; i < 300; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	var peers []string
+	for _, node := range nodes {
+		peers = append(peers, node.Addr())
+	}
+	cfg := testConfig(dirs[indexOf(nodes, follower)])
+	cfg.RaftAddr = addr
+	restarted, err := NewNode(cfg)
+	assert.Nil(t, err)
+	nodes[indexOf(nodes, follower)] = restarted
+	restarted.Start(peers)
+
+	leader = waitForLeader(t, nodes...)
+	waitForSync(t, leader, nodes...)
+	assert.Equal(t, 300, len(restarted.ListKeys()))
+}
+
+func indexOf(nodes []*Node, node *Node) int {
+	for i, n := range nodes {
+		if n == node {
+			return i
+		}
+	}
+	return -1
+}
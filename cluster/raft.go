@@ -0,0 +1,488 @@
+package cluster
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 一次 AppendEntries 最多携带的日志数量
+const maxEntriesPerAppend = 256
+
+type nodeState = int8
+
+const (
+	follower nodeState = iota
+	candidate
+	leader
+)
+
+// raft 日志中的一条命令，应用时调用 Op 对应的 ApplyFunc
+type LogEntry struct {
+	Index	uint64
+	Term	uint64
+	Op		string		// 为空时是 leader 当选之后写入的空日志
+	Args	[][]byte
+}
+
+type RequestVoteArgs struct {
+	From			string
+	Term			uint64
+	LastLogIndex	uint64
+	LastLogTerm		uint64
+}
+
+type RequestVoteReply struct {
+	Term		uint64
+	VoteGranted	bool
+}
+
+type AppendEntriesArgs struct {
+	From			string
+	Term			uint64
+	PrevLogIndex	uint64
+	PrevLogTerm		uint64
+	Entries			[]LogEntry
+	LeaderCommit	uint64
+}
+
+type AppendEntriesReply struct {
+	Term			uint64
+	Success			bool
+	ConflictIndex	uint64	// 失败时 leader 下一次从这个位置开始发送
+}
+
+// 快照按文件分片发送，First 标识第一片，Done 标识最后一片
+type InstallSnapshotArgs struct {
+	From				string
+	Term				uint64
+	LastIncludedIndex	uint64
+	LastIncludedTerm	uint64
+	FileName			string
+	Offset				int64
+	Data				[]byte
+	First				bool
+	Done				bool
+}
+
+type InstallSnapshotReply struct {
+	Term	uint64
+}
+
+// follower 收到的写入转发给 leader
+type ForwardArgs struct {
+	From	string
+	Op		string
+	Args	[][]byte
+}
+
+type ForwardReply struct {
+	Result	[]byte
+	Err		string
+}
+
+// 注册到 net/rpc 上的方法
+type rpcService struct {
+	n	*Node
+}
+
+func (s *rpcService) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	if s.n.transport.isBlocked(args.From) {
+		return ErrPeerUnreachable
+	}
+	return s.n.handleRequestVote(args, reply)
+}
+
+func (s *rpcService) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if s.n.transport.isBlocked(args.From) {
+		return ErrPeerUnreachable
+	}
+	return s.n.handleAppendEntries(args, reply)
+}
+
+func (s *rpcService) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if s.n.transport.isBlocked(args.From) {
+		return ErrPeerUnreachable
+	}
+	return s.n.handleInstallSnapshot(args, reply)
+}
+
+func (s *rpcService) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	if s.n.transport.isBlocked(args.From) {
+		return ErrPeerUnreachable
+	}
+	p, _, err := s.n.appendProposal(args.Op, args.Args)
+	if err == nil {
+		reply.Result, err = s.n.waitProposal(p)
+	}
+	reply.Err = encodeError(err)
+	return nil
+}
+
+func (n *Node) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.currentTerm {
+		if err := n.stepDown(args.Term); err != nil {
+			return err
+		}
+	}
+	reply.Term = n.currentTerm
+	if args.Term < n.currentTerm {
+		return nil
+	}
+	if n.votedFor != "" && n.votedFor != args.From {
+		return nil
+	}
+	// 只投票给日志至少和自己一样新的节点
+	last := n.lastEntry()
+	if args.LastLogTerm < last.Term || (args.LastLogTerm == last.Term && args.LastLogIndex < last.Index) {
+		return nil
+	}
+	if err := n.store.saveState(n.currentTerm, args.From); err != nil {
+		return err
+	}
+	n.votedFor = args.From
+	n.resetElectionTimer()
+	reply.VoteGranted = true
+	return nil
+}
+
+func (n *Node) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply.Term = n.currentTerm
+	if args.Term < n.currentTerm {
+		return nil
+	}
+	if args.Term > n.currentTerm || n.state != follower {
+		if err := n.stepDown(args.Term); err != nil {
+			return err
+		}
+	}
+	reply.Term = n.currentTerm
+	n.leaderId = args.From
+	n.resetElectionTimer()
+
+	base := n.log[0]
+	prevIndex, prevTerm, entries := args.PrevLogIndex, args.PrevLogTerm, args.Entries
+	// 快照中的日志都已经提交了，一定和 leader 一致
+	if prevIndex < base.Index {
+		skip := base.Index - prevIndex
+		if uint64(len(entries)) <= skip {
+			reply.Success = true
+			return nil
+		}
+		entries = entries[skip:]
+		prevIndex, prevTerm = base.Index, base.Term
+	}
+	last := n.lastEntry()
+	if prevIndex > last.Index {
+		reply.ConflictIndex = last.Index + 1
+		return nil
+	}
+	if term := n.entry(prevIndex).Term; term != prevTerm {
+		// 跳过整个冲突的任期，减少来回的次数
+		index := prevIndex
+		for index > base.Index+1 && n.entry(index-1).Term == term {
+			index--
+		}
+		reply.ConflictIndex = index
+		return nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= last.Index {
+			if n.entry(entry.Index).Term == entry.Term {
+				continue
+			}
+			// 和 leader 冲突的日志一定没有提交，删除它和之后的所有日志
+			if err := n.store.deleteEntries(entry.Index, last.Index); err != nil {
+				return err
+			}
+			n.log = n.log[:entry.Index-base.Index]
+		}
+		if err := n.store.appendEntries(entries[i:]); err != nil {
+			return err
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		commitIndex := prevIndex + uint64(len(entries))
+		if args.LeaderCommit < commitIndex {
+			commitIndex = args.LeaderCommit
+		}
+		if commitIndex > n.commitIndex {
+			n.commitIndex = commitIndex
+			n.applyCond.Broadcast()
+		}
+	}
+	reply.Success = true
+	return nil
+}
+
+func (n *Node) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n.installMu.Lock()
+	defer n.installMu.Unlock()
+
+	n.mu.Lock()
+	reply.Term = n.currentTerm
+	if args.Term < n.currentTerm {
+		n.mu.Unlock()
+		return nil
+	}
+	if args.Term > n.currentTerm || n.state != follower {
+		if err := n.stepDown(args.Term); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+	reply.Term = n.currentTerm
+	n.leaderId = args.From
+	n.resetElectionTimer()
+	n.mu.Unlock()
+
+	incomingDir := n.path(snapshotIncomingDirName)
+	if args.First {
+		if err := os.RemoveAll(incomingDir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(incomingDir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(filepath.Join(incomingDir, filepath.Base(args.FileName)), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(args.Data, args.Offset); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if !args.Done {
+		return nil
+	}
+	return n.installSnapshot(args.LastIncludedIndex, args.LastIncludedTerm)
+}
+
+// 开始新一轮选举，调用方需要持有 n.mu
+func (n *Node) startElection() {
+	if err := n.store.saveState(n.currentTerm+1, n.id); err != nil {
+		n.resetElectionTimer()
+		return
+	}
+	n.currentTerm++
+	n.votedFor = n.id
+	n.state = candidate
+	n.leaderId = ""
+	n.resetElectionTimer()
+
+	last := n.lastEntry()
+	args := &RequestVoteArgs{
+		From:			n.id,
+		Term:			n.currentTerm,
+		LastLogIndex:	last.Index,
+		LastLogTerm:	last.Term,
+	}
+	votes := 1
+	if n.isQuorum(votes) {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			reply := &RequestVoteReply{}
+			if err := n.transport.call(peer, "RequestVote", args, reply, n.cfg.ElectionTimeout); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.currentTerm {
+				_ = n.stepDown(reply.Term)
+				return
+			}
+			if n.state != candidate || n.currentTerm != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if n.isQuorum(votes) {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// 调用方需要持有 n.mu
+func (n *Node) becomeLeader() {
+	n.state = leader
+	n.leaderId = n.id
+	last := n.lastEntry()
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = last.Index + 1
+		n.matchIndex[peer] = 0
+	}
+	// 当选之后写入一条空日志，提交它的同时提交之前任期的日志
+	entry := LogEntry{Index: last.Index + 1, Term: n.currentTerm}
+	if err := n.store.appendEntries([]LogEntry{entry}); err == nil {
+		n.log = append(n.log, entry)
+	}
+	n.advanceCommitIndex()
+	n.triggerReplication()
+}
+
+// 发现更大的任期或者其他的 leader 时转为 follower，调用方需要持有 n.mu
+func (n *Node) stepDown(term uint64) error {
+	if term > n.currentTerm {
+		if err := n.store.saveState(term, ""); err != nil {
+			return err
+		}
+		n.currentTerm = term
+		n.votedFor = ""
+		n.leaderId = ""
+	}
+	if n.state != follower {
+		n.state = follower
+		n.resetElectionTimer()
+	}
+	return nil
+}
+
+// 调用方需要持有 n.mu
+func (n *Node) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// 超过一半的节点，包括自己
+func (n *Node) isQuorum(count int) bool {
+	return count*2 > len(n.peers)+1
+}
+
+// 超过一半的节点复制了当前任期的日志之后提交，调用方需要持有 n.mu
+func (n *Node) advanceCommitIndex() {
+	for index := n.lastEntry().Index; index > n.commitIndex; index-- {
+		// 之前任期的日志不能通过计数提交
+		if n.entry(index).Term != n.currentTerm {
+			return
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if n.isQuorum(count) {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// 通知所有的复制协程发送日志，调用方需要持有 n.mu
+func (n *Node) triggerReplication() {
+	for _, peer := range n.peers {
+		n.triggerPeer(peer)
+	}
+}
+
+func (n *Node) triggerPeer(peer string) {
+	select {
+	case n.replicateChs[peer] <- struct{}{}:
+	default:
+	}
+}
+
+// 每个节点一个复制协程，leader 通过它发送日志和心跳
+func (n *Node) runReplicator(peer string) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closeCh:
+			return
+		case <-ticker.C:
+		case <-n.replicateChs[peer]:
+		}
+		n.replicateTo(peer)
+	}
+}
+
+func (n *Node) replicateTo(peer string) {
+	n.mu.Lock()
+	if n.state != leader {
+		n.mu.Unlock()
+		return
+	}
+	next := n.nextIndex[peer]
+	base := n.log[0]
+	// 需要的日志已经被快照删除了，发送快照
+	if next <= base.Index {
+		n.mu.Unlock()
+		n.sendSnapshot(peer)
+		return
+	}
+	prev := n.entry(next - 1)
+	args := &AppendEntriesArgs{
+		From:			n.id,
+		Term:			n.currentTerm,
+		PrevLogIndex:	prev.Index,
+		PrevLogTerm:	prev.Term,
+		LeaderCommit:	n.commitIndex,
+	}
+	entries := n.log[next-base.Index:]
+	if len(entries) > maxEntriesPerAppend {
+		entries = entries[:maxEntriesPerAppend]
+	}
+	args.Entries = append([]LogEntry(nil), entries...)
+	n.mu.Unlock()
+
+	reply := &AppendEntriesReply{}
+	if err := n.transport.call(peer, "AppendEntries", args, reply, n.cfg.ElectionTimeout); err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.currentTerm {
+		_ = n.stepDown(reply.Term)
+		return
+	}
+	if n.state != leader || n.currentTerm != args.Term {
+		return
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommitIndex()
+	} else if reply.ConflictIndex > n.matchIndex[peer] {
+		n.nextIndex[peer] = reply.ConflictIndex
+	} else {
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+	}
+	if n.nextIndex[peer] <= n.lastEntry().Index {
+		n.triggerPeer(peer)
+	}
+}
+
+// 调用方需要持有 n.mu
+func (n *Node) lastEntry() LogEntry {
+	return n.log[len(n.log)-1]
+}
+
+// 调用方需要持有 n.mu，index 不能小于快照的位置
+func (n *Node) entry(index uint64) LogEntry {
+	return n.log[index-n.log[0].Index]
+}
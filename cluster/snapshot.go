@@ -0,0 +1,278 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+)
+
+const (
+	snapshotDirName			= "snapshot"
+	snapshotTmpDirName		= "snapshot-tmp"
+	snapshotIncomingDirName	= "snapshot-incoming"
+	snapshotMetaFileName	= "raft-snapshot"
+
+	// 发送快照时一个分片的大小
+	snapshotChunkSize = 1024 * 1024
+)
+
+// 快照是状态机数据库的一次完整备份，加上它包含的最后一条日志的位置
+type snapshotMeta struct {
+	Index	uint64	`json:"index"`
+	Term	uint64	`json:"term"`
+}
+
+func readSnapshotMeta(dir string) (*snapshotMeta, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, snapshotMetaFileName))
+	if err != nil {
+		return nil, err
+	}
+	meta := &snapshotMeta{}
+	if err := json.Unmarshal(buf, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func writeSnapshotMeta(dir string, meta *snapshotMeta) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, snapshotMetaFileName), buf, 0644)
+}
+
+// 应用的日志超过 SnapshotThreshold 时生成快照，并删除快照之前的日志
+func (n *Node) maybeSnapshot() {
+	if n.cfg.SnapshotThreshold == 0 {
+		return
+	}
+	n.mu.Lock()
+	need := n.lastApplied-n.log[0].Index >= n.cfg.SnapshotThreshold
+	n.mu.Unlock()
+	if need {
+		_ = n.takeSnapshot()
+	}
+}
+
+func (n *Node) takeSnapshot() error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	// 只有应用日志的协程会写入数据库，持有 dbMu 的读锁时数据库停在 lastApplied 的状态
+	n.dbMu.RLock()
+	n.mu.Lock()
+	meta := &snapshotMeta{Index: n.lastApplied}
+	if meta.Index <= n.log[0].Index {
+		n.mu.Unlock()
+		n.dbMu.RUnlock()
+		return nil
+	}
+	meta.Term = n.entry(meta.Index).Term
+	n.mu.Unlock()
+
+	tmpDir := n.path(snapshotTmpDirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		n.dbMu.RUnlock()
+		return err
+	}
+	// 旧的数据文件通过硬链接备份，不需要拷贝
+	err := n.db.Backup(tmpDir)
+	n.dbMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshotMeta(tmpDir, meta); err != nil {
+		return err
+	}
+	if err := n.replaceSnapshot(tmpDir); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.compactLog(meta.Index, meta.Term)
+}
+
+// 用 dir 替换当前的快照，调用方需要持有 snapMu
+func (n *Node) replaceSnapshot(dir string) error {
+	snapshotDir := n.path(snapshotDirName)
+	if err := os.RemoveAll(snapshotDir); err != nil {
+		return err
+	}
+	return os.Rename(dir, snapshotDir)
+}
+
+// 删除 index 之前的日志，调用方需要持有 n.mu
+func (n *Node) compactLog(index, term uint64) error {
+	base, last := n.log[0], n.lastEntry()
+	if index <= base.Index {
+		return nil
+	}
+	var entries []LogEntry
+	// 快照之后的日志和快照一致时保留，否则全部丢弃
+	if index <= last.Index && n.entry(index).Term == term {
+		entries = n.log[index-base.Index+1:]
+	} else {
+		if err := n.store.deleteEntries(index+1, last.Index); err != nil {
+			return err
+		}
+	}
+	end := index
+	if last.Index < end {
+		end = last.Index
+	}
+	if err := n.store.deleteEntries(base.Index+1, end); err != nil {
+		return err
+	}
+	n.log = append([]LogEntry{{Index: index, Term: term}}, entries...)
+	return nil
+}
+
+// 用收到的快照替换状态机的数据库
+func (n *Node) installSnapshot(index, term uint64) error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	n.mu.Lock()
+	installed := index <= n.log[0].Index
+	n.mu.Unlock()
+	if installed {
+		return nil
+	}
+	if err := n.replaceSnapshot(n.path(snapshotIncomingDirName)); err != nil {
+		return err
+	}
+
+	n.dbMu.Lock()
+	defer n.dbMu.Unlock()
+	if err := n.db.Close(); err != nil {
+		return err
+	}
+	db, err := n.restoreDB()
+	if err != nil {
+		return err
+	}
+	n.db = db
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.compactLog(index, term); err != nil {
+		return err
+	}
+	if index > n.commitIndex {
+		n.commitIndex = index
+	}
+	n.lastApplied = index
+	return nil
+}
+
+// 从快照恢复状态机的数据库，没有快照时从空的数据库开始，之后重新应用快照之后的日志
+func (n *Node) restoreDB() (*aperturekv.DB, error) {
+	dataDir := n.path(dataDirName)
+	if err := os.RemoveAll(dataDir); err != nil {
+		return nil, err
+	}
+	snapshotDir := n.path(snapshotDirName)
+	if _, err := os.Stat(snapshotDir); err == nil {
+		if err := aperturekv.RestoreBackup(dataDir, snapshotDir); err != nil {
+			return nil, err
+		}
+	}
+	options := n.cfg.DBOptions
+	options.DirPath = dataDir
+	return aperturekv.Open(options)
+}
+
+// 把当前的快照按分片发送给 peer
+func (n *Node) sendSnapshot(peer string) {
+	n.snapMu.RLock()
+	defer n.snapMu.RUnlock()
+
+	snapshotDir := n.path(snapshotDirName)
+	meta, err := readSnapshotMeta(snapshotDir)
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	n.mu.Lock()
+	if n.state != leader {
+		n.mu.Unlock()
+		return
+	}
+	term := n.currentTerm
+	n.mu.Unlock()
+
+	buf := make([]byte, snapshotChunkSize)
+	first := true
+	for i, name := range names {
+		file, err := os.Open(filepath.Join(snapshotDir, name))
+		if err != nil {
+			return
+		}
+		var offset int64
+		for {
+			size, err := io.ReadFull(file, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				_ = file.Close()
+				return
+			}
+			fileDone := size < len(buf)
+			args := &InstallSnapshotArgs{
+				From:				n.id,
+				Term:				term,
+				LastIncludedIndex:	meta.Index,
+				LastIncludedTerm:	meta.Term,
+				FileName:			name,
+				Offset:				offset,
+				Data:				buf[:size],
+				First:				first,
+				Done:				fileDone && i == len(names)-1,
+			}
+			reply := &InstallSnapshotReply{}
+			if err := n.transport.call(peer, "InstallSnapshot", args, reply, snapshotTimeout); err != nil {
+				_ = file.Close()
+				return
+			}
+			if reply.Term > term {
+				_ = file.Close()
+				n.mu.Lock()
+				_ = n.stepDown(reply.Term)
+				n.mu.Unlock()
+				return
+			}
+			first = false
+			offset += int64(size)
+			if fileDone {
+				break
+			}
+		}
+		_ = file.Close()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != leader || n.currentTerm != term {
+		return
+	}
+	if meta.Index > n.matchIndex[peer] {
+		n.matchIndex[peer] = meta.Index
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.triggerPeer(peer)
+}
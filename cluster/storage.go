@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+)
+
+var (
+	termKey		= []byte("raft-term")
+	voteKey		= []byte("raft-vote")
+	logPrefix	= []byte("raft-log/")
+)
+
+// raft 需要持久化的状态：当前任期、投票给了谁以及日志，保存在单独的一个数据库中
+type raftStore struct {
+	db	*aperturekv.DB
+}
+
+func openRaftStore(dir string) (*raftStore, error) {
+	options := aperturekv.DefaultOptions
+	options.DirPath = dir
+	options.SyncWrites = true
+	db, err := aperturekv.Open(options)
+	if err != nil {
+		return nil, err
+	}
+	return &raftStore{db: db}, nil
+}
+
+func (s *raftStore) close() error {
+	return s.db.Close()
+}
+
+func (s *raftStore) loadState() (uint64, string, error) {
+	var term uint64
+	buf, err := s.db.Get(termKey)
+	if err == nil {
+		term, _ = binary.Uvarint(buf)
+	} else if err != aperturekv.ErrKeyNotFound {
+		return 0, "", err
+	}
+	vote, err := s.db.Get(voteKey)
+	if err != nil && err != aperturekv.ErrKeyNotFound {
+		return 0, "", err
+	}
+	return term, string(vote), nil
+}
+
+func (s *raftStore) saveState(term uint64, vote string) error {
+	wb := s.db.NewWriteBatch(aperturekv.DefaultWriteBatchOptions)
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, term)
+	_ = wb.Put(termKey, buf[:n])
+	if vote == "" {
+		_ = wb.Delete(voteKey)
+	} else {
+		_ = wb.Put(voteKey, []byte(vote))
+	}
+	return wb.Commit()
+}
+
+// 按 index 顺序读取所有的日志
+func (s *raftStore) loadEntries() ([]LogEntry, error) {
+	iterOpts := aperturekv.DefaultIteratorOptions
+	iterOpts.Prefix = logPrefix
+	iter := s.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var entries []LogEntry
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		buf, err := iter.Value()
+		if err != nil {
+			return nil, err
+		}
+		var entry LogEntry
+		if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *raftStore) appendEntries(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	wb := s.db.NewWriteBatch(aperturekv.DefaultWriteBatchOptions)
+	for _, entry := range entries {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&entry); err != nil {
+			return err
+		}
+		if err := wb.Put(logKey(entry.Index), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// 删除 [from, to] 之间的日志
+func (s *raftStore) deleteEntries(from, to uint64) error {
+	if from > to {
+		return nil
+	}
+	wb := s.db.NewWriteBatch(aperturekv.WriteBatchOptions{MaxBatchNum: uint(to - from + 1), SyncWrites: true})
+	for index := from; index <= to; index++ {
+		if err := wb.Delete(logKey(index)); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// 日志的 key 使用大端序，保证按 index 排序
+func logKey(index uint64) []byte {
+	key := make([]byte, len(logPrefix)+8)
+	copy(key, logPrefix)
+	binary.BigEndian.PutUint64(key[len(logPrefix):], index)
+	return key
+}
@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// 节点之间通过 net/rpc 通信，节点的 id 就是它的 raft 地址
+type transport struct {
+	listener	net.Listener
+	server		*rpc.Server
+	mu			sync.Mutex
+	clients		map[string]*rpc.Client
+	conns		map[net.Conn]struct{}
+	blocked		map[string]bool	// 无法连通的节点，用于模拟网络分区
+	closed		bool
+	wg			sync.WaitGroup
+}
+
+func newTransport(addr string, service interface{}) (*transport, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", service); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &transport{
+		listener:	listener,
+		server:		server,
+		clients:	make(map[string]*rpc.Client),
+		conns:		make(map[net.Conn]struct{}),
+		blocked:	make(map[string]bool),
+	}
+	t.wg.Add(1)
+	go t.serve()
+	return t, nil
+}
+
+func (t *transport) addr() string {
+	return t.listener.Addr().String()
+}
+
+func (t *transport) serve() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.mu.Unlock()
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.server.ServeConn(conn)
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+// 调用 peer 上的方法，超时或者连接出错时丢弃连接，下一次调用重新建立
+func (t *transport) call(peer, method string, args, reply interface{}, timeout time.Duration) error {
+	client, err := t.client(peer, timeout)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	call := client.Go("Raft."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown {
+			t.dropClient(peer, client)
+		}
+		return call.Error
+	case <-timer.C:
+		t.dropClient(peer, client)
+		return ErrPeerUnreachable
+	}
+}
+
+func (t *transport) client(peer string, timeout time.Duration) (*rpc.Client, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrNodeClosed
+	}
+	if t.blocked[peer] {
+		t.mu.Unlock()
+		return nil, ErrPeerUnreachable
+	}
+	if client, ok := t.clients[peer]; ok {
+		t.mu.Unlock()
+		return client, nil
+	}
+	t.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", peer, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		_ = client.Close()
+		return nil, ErrNodeClosed
+	}
+	if exist, ok := t.clients[peer]; ok {
+		_ = client.Close()
+		return exist, nil
+	}
+	t.clients[peer] = client
+	return client, nil
+}
+
+func (t *transport) dropClient(peer string, client *rpc.Client) {
+	t.mu.Lock()
+	if t.clients[peer] == client {
+		delete(t.clients, peer)
+	}
+	t.mu.Unlock()
+	_ = client.Close()
+}
+
+// 断开和 peers 之间的通信，发出和收到的请求都会失败
+func (t *transport) block(peers ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, peer := range peers {
+		t.blocked[peer] = true
+	}
+}
+
+func (t *transport) unblock(peers ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, peer := range peers {
+		delete(t.blocked, peer)
+	}
+}
+
+func (t *transport) isBlocked(peer string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.blocked[peer]
+}
+
+func (t *transport) close() {
+	t.mu.Lock()
+	t.closed = true
+	_ = t.listener.Close()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	for peer, client := range t.clients {
+		_ = client.Close()
+		delete(t.clients, peer)
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+)
+
+// 在本机上用两个进程运行主节点和副本，例如：
+// replication -dir /tmp/primary -listen 127.0.0.1:6390
+// replication -dir /tmp/replica -primary 127.0.0.1:6390
+// 之后在标准输入中执行 put <key> <value>、del <key>、get <key>、stat
+// 复制连接没有认证和加密，-listen 只应该监听本机或者可信网络中的地址
+func main() {
+	dir := flag.String("dir", "", "the data directory")
+	listen := flag.String("listen", "", "serve replication on this address as the primary")
+	primary := flag.String("primary", "", "replicate from the primary on this address as a read-only replica")
+	flag.Parse()
+	if *dir == "" || (*listen == "") == (*primary == "") {
+		fmt.Fprintf(os.Stderr, "usage: %s -dir <dir> (-listen <addr> | -primary <addr>)\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	options := aperturekv.DefaultOptions
+	options.DirPath = *dir
+	options.ReplicaOf = *primary
+	db, err := aperturekv.Open(options)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	if *listen != "" {
+		srv, err := db.ServeReplication(*listen)
+		if err != nil {
+			log.Fatalf("failed to serve replication: %v", err)
+		}
+		log.Printf("serving replication on %v", srv.Addr())
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch {
+		case args[0] == "put" && len(args) == 3:
+			err = db.Put([]byte(args[1]), []byte(args[2]))
+		case args[0] == "del" && len(args) == 2:
+			err = db.Delete([]byte(args[1]))
+		case args[0] == "get" && len(args) == 2:
+			var value []byte
+			if value, err = db.Get([]byte(args[1])); err == nil {
+				fmt.Println(string(value))
+			}
+		case args[0] == "stat":
+			stat := db.Stat()
+			fmt.Printf("keys: %d\n", stat.KeyNum)
+			if stat.Replica != nil {
+				fmt.Printf("replica: %+v\n", *stat.Replica)
+			}
+		default:
+			err = fmt.Errorf("unknown command: %s", scanner.Text())
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			err = nil
+		}
+	}
+}
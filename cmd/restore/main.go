@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+)
+
+// 按顺序应用一次完整备份和之后的增量备份，例如：
+// restore -dest /data/aperture /backup/full /backup/incr-1 /backup/incr-2
+func main() {
+	dest := flag.String("dest", "", "the empty directory to restore the database into")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -dest <dir> <full-backup-dir> [incremental-backup-dir...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *dest == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := aperturekv.RestoreBackup(*dest, flag.Args()...); err != nil {
+		log.Fatalf("failed to restore backup: %v", err)
+	}
+	log.Printf("restored %d backup(s) into %s", flag.NArg(), *dest)
+}
@@ -0,0 +1,136 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	ErrUnknownCodec	= errors.New("unknown compression codec")
+)
+
+// 压缩算法的 id 记录在 LogRecord 的 type 字段中，最多 8 种
+type CodecType = byte
+
+const (
+	CodecNone	CodecType = iota	// 不压缩
+	CodecFlate						// 标准库的 flate (DEFLATE)
+)
+
+const maxCodecType CodecType = 7
+
+// type 字段的第 4~6 位是 value 的压缩算法，低 3 位是日志类型
+const (
+	logRecordCodecShift	= 4
+	logRecordCodecMask	= byte(maxCodecType) << logRecordCodecShift
+	logRecordTypeMask	= byte(0x07)
+)
+
+// Codec 压缩和解压 value，实现需要是并发安全的
+type Codec interface {
+	Compress(value []byte) ([]byte, error)
+	Decompress(buf []byte) ([]byte, error)
+}
+
+var (
+	codecsLock	sync.RWMutex
+	codecs		= map[CodecType]Codec{
+		CodecFlate:	flateCodec{},
+	}
+)
+
+// 注册压缩算法，例如 snappy、zstd 等第三方实现
+// 已经写入数据文件的 id 不能再对应其他的算法，否则无法解压
+func RegisterCodec(typ CodecType, codec Codec) error {
+	if typ == CodecNone || typ > maxCodecType {
+		return fmt.Errorf("codec type must be between 1 and %d", maxCodecType)
+	}
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[typ] = codec
+	return nil
+}
+
+func GetCodec(typ CodecType) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecs[typ]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+// 压缩 LogRecord 的 value，压缩之后没有变小时保持原样
+// 返回的 LogRecord 是新的对象，不会修改传入的数据
+func CompressLogRecord(logRecord *LogRecord, typ CodecType) (*LogRecord, error) {
+	if typ == CodecNone || logRecord.Codec != CodecNone {
+		return logRecord, nil
+	}
+	codec, err := GetCodec(typ)
+	if err != nil {
+		return nil, err
+	}
+	value, err := codec.Compress(logRecord.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) >= len(logRecord.Value) {
+		return logRecord, nil
+	}
+	compressed := *logRecord
+	compressed.Value = value
+	compressed.Codec = typ
+	return &compressed, nil
+}
+
+// 解压读取到的 LogRecord 的 value，解压之后 Codec 为 CodecNone
+func decompressLogRecord(logRecord *LogRecord) error {
+	if logRecord.Codec == CodecNone {
+		return nil
+	}
+	codec, err := GetCodec(logRecord.Codec)
+	if err != nil {
+		return err
+	}
+	value, err := codec.Decompress(logRecord.Value)
+	if err != nil {
+		return err
+	}
+	logRecord.Value = value
+	logRecord.Codec = CodecNone
+	return nil
+}
+
+type flateCodec struct{}
+
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+func (flateCodec) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(buf []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(buf))
+	defer r.Close()
+	return io.ReadAll(r)
+}
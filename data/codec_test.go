@@ -0,0 +1,68 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/fio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressLogRecord(t *testing.T) {
+	rec := &LogRecord{
+		Key:	[]byte("name"),
+		Value:	bytes.Repeat([]byte(`{"name":"bitcask-go"}`), 100),
+		Type:	LogRecordNormal,
+		Expire:	1700000000000000000,
+	}
+	compressed, err := CompressLogRecord(rec, CodecFlate)
+	assert.Nil(t, err)
+	assert.Equal(t, CodecFlate, compressed.Codec)
+	assert.True(t, len(compressed.Value) < len(rec.Value)/5)
+	// 不修改传入的数据
+	assert.Equal(t, CodecNone, rec.Codec)
+
+	res, n := EncodeLogRecord(compressed)
+	assert.Equal(t, LogRecordNormal, res[4]&logRecordTypeMask)
+	assert.NotZero(t, res[4]&logRecordExpireFlag)
+	decoded, size, err := DecodeLogRecord(res, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, n, size)
+	assert.Equal(t, rec, decoded)
+
+	// 压缩之后没有变小的数据保持原样
+	small := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")}
+	compressed, err = CompressLogRecord(small, CodecFlate)
+	assert.Nil(t, err)
+	assert.Equal(t, small, compressed)
+
+	_, err = CompressLogRecord(rec, 5)
+	assert.Equal(t, ErrUnknownCodec, err)
+	assert.NotNil(t, RegisterCodec(CodecNone, flateCodec{}))
+}
+
+func TestDataFileReadLogRecord_Compressed(t *testing.T) {
+	dataFile, err := OpenDataFile(os.TempDir(), 2222, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer os.Remove(GetDataFileName(os.TempDir(), 2222))
+
+	// 同一个文件中混合压缩和没有压缩的数据
+	rec1 := &LogRecord{Key: []byte("k1"), Value: bytes.Repeat([]byte("a"), 1024)}
+	rec2 := &LogRecord{Key: []byte("k2"), Value: []byte("bitcask-go")}
+	compressed, err := CompressLogRecord(rec1, CodecFlate)
+	assert.Nil(t, err)
+	enc1, size1 := EncodeLogRecord(compressed)
+	enc2, size2 := EncodeLogRecord(rec2)
+	assert.Nil(t, dataFile.Write(enc1))
+	assert.Nil(t, dataFile.Write(enc2))
+
+	readRec, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size1, readSize)
+	assert.Equal(t, rec1, readRec)
+	readRec, readSize, err = dataFile.ReadLogRecord(size1)
+	assert.Nil(t, err)
+	assert.Equal(t, size2, readSize)
+	assert.Equal(t, rec2, readRec)
+}
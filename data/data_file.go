@@ -16,28 +16,37 @@ var (
 
 const (
 	DataFileNameSuffix		= ".data"
+	BlobFileNameSuffix		= ".blob"
 	HintFileName			= "hint-index"
 	MergeFinishedFileName	= "merge-finished"
+	MergeRewrittenFileName	= "merge-rewritten"
 )
 
 type DataFile struct {
 	FileId		uint32			// 文件 ID
 	WriteOff	int64			// 文件写到了哪个位置(offset)
 	IoManager	fio.IOManager	// io 读写接口
+	Encryptor	*Encryptor		// 读取加密的数据和写 hint 记录时使用，为 nil 时不加密
 }
 
-func OpenDataFile(dirPath string, fileId uint32) (*DataFile, error) {
-	fileName := filepath.Join(dirPath, fmt.Sprintf("%09d", fileId) + DataFileNameSuffix)
-	// 初始化 IOManager 管理器接口
-	ioManager, err := fio.NewFileIOManager(fileName)
-	if err != nil {
-		return nil, err
-	}
-	return &DataFile{
-		FileId: fileId,
-		WriteOff: 0,
-		IoManager: ioManager,
-	}, nil
+func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	fileName := GetDataFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, ioType)
+}
+
+// 获取数据文件的完整路径
+func GetDataFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId) + DataFileNameSuffix)
+}
+
+// 打开存储大 value 的 blob 文件，blob 文件的 id 和数据文件是分开的
+func OpenBlobFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	fileName := GetBlobFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, ioType)
+}
+
+func GetBlobFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId) + BlobFileNameSuffix)
 }
 
 func OpenHintFile(dirPath string) (*DataFile, error) {
@@ -50,6 +59,11 @@ func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.StandardFIO)
 }
 
+func OpenMergeRewrittenFile(dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, MergeRewrittenFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO)
+}
+
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.IoManager.Write(buf)
 	if err != nil {
@@ -64,6 +78,13 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 		Key:	key,
 		Value:	EncodeLogRecordPos(pos),
 	}
+	if df.Encryptor != nil {
+		encrypted, err := df.Encryptor.EncryptLogRecord(record)
+		if err != nil {
+			return err
+		}
+		record = encrypted
+	}
 	encRecord, _ := EncodeLogRecord(record)
 	return df.Write(encRecord)
 }
@@ -87,6 +108,10 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	}
 
 	header, headerSize := decodeLogRecordHeader(headerBuf)
+	// header 只写了一部分，数据不完整
+	if headerSize < 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
 	// 读取到了文件末尾，直接返回 EOF 错误
 	if header == nil {
 		return nil, 0, io.EOF
@@ -97,8 +122,12 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	recordSize := headerSize + keySize + valueSize
+	// 记录超出了文件的末尾，说明写入时被中断了
+	if offset + recordSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
 
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{Type: header.recordType, Expire: header.expire, Codec: header.codec, KeyId: header.keyId}
 	// 读取用户实际存储的 kv 数据
 	if keySize > 0 || valueSize > 0 {
 		kvBuf, err := df.ReadNBytes(keySize+valueSize, offset+headerSize)
@@ -114,9 +143,29 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	if crc != header.crc {
 		return nil, 0, ErrInvalidCRC
 	}
+	// 同一个文件中可能同时有压缩和没有压缩的数据，按每条记录的 header 解密、解压
+	if err := df.Encryptor.decryptLogRecord(logRecord); err != nil {
+		return nil, 0, err
+	}
+	if err := decompressLogRecord(logRecord); err != nil {
+		return nil, 0, err
+	}
 	return logRecord, recordSize, nil
 }
 
+// 切换数据文件的 IO 类型，例如启动时用 mmap 加载完索引之后切换回标准文件 IO
+func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
+	if err := df.IoManager.Close(); err != nil {
+		return err
+	}
+	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType)
+	if err != nil {
+		return err
+	}
+	df.IoManager = ioManager
+	return nil
+}
+
 func (df *DataFile) Sync() error {
 	return df.IoManager.Sync()
 }
@@ -136,9 +185,14 @@ func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFi
 	if err != nil {
 		return nil, err
 	}
+	return NewDataFile(fileId, ioManager), nil
+}
+
+// 使用已经打开的 IOManager 创建数据文件，例如通过 fio.FDPool 打开的文件
+func NewDataFile(fileId uint32, ioManager fio.IOManager) *DataFile {
 	return &DataFile{
 		FileId:    fileId,
 		WriteOff:  0,
 		IoManager: ioManager,
-	}, nil
+	}
 }
\ No newline at end of file
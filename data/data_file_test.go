@@ -1,28 +1,31 @@
 package data
 
 import (
+	"io"
 	"os"
 	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/fio"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestOpenDataFile(t *testing.T) {
-	dataFile1, err := OpenDataFile(os.TempDir(), 0)
+	dataFile1, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
-	dataFile2, err := OpenDataFile(os.TempDir(), 111)
+	dataFile2, err := OpenDataFile(os.TempDir(), 111, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile2)
 
-	dataFile3, err := OpenDataFile(os.TempDir(), 111)
+	dataFile3, err := OpenDataFile(os.TempDir(), 111, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile3)
 }
 
 
 func TestDataFileWrite(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 0)
+	dataFile, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -34,7 +37,7 @@ func TestDataFileWrite(t *testing.T) {
 }
 
 func TestDataFileClose(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 123)
+	dataFile, err := OpenDataFile(os.TempDir(), 123, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -47,7 +50,7 @@ func TestDataFileClose(t *testing.T) {
 
 
 func TestDataFileSync(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 456)
+	dataFile, err := OpenDataFile(os.TempDir(), 456, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -59,7 +62,7 @@ func TestDataFileSync(t *testing.T) {
 }
 
 func TestDataFileReadLogRecord(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 222)
+	dataFile, err := OpenDataFile(os.TempDir(), 222, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -107,4 +110,28 @@ func TestDataFileReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 
-}
\ No newline at end of file
+}
+func TestDataFileReadLogRecord_Torn(t *testing.T) {
+	dataFile, err := OpenDataFile(os.TempDir(), 333, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+	defer os.Remove(GetDataFileName(os.TempDir(), 333))
+
+	rec := &LogRecord{
+		Key:	[]byte("name"),
+		Value:	[]byte("bitcask kv go"),
+	}
+	enc, size := EncodeLogRecord(rec)
+	err = dataFile.Write(enc)
+	assert.Nil(t, err)
+	// 第二条记录只写入了一部分
+	err = dataFile.Write(enc[:size-3])
+	assert.Nil(t, err)
+
+	_, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+
+	_, _, err = dataFile.ReadLogRecord(size)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,222 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrEncryptionKeyNotFound	= errors.New("the encryption key of the data is not found")
+	ErrInvalidEncryptionKey		= errors.New("failed to decrypt the data, the encryption key is wrong")
+)
+
+// KeyProvider 提供加密使用的 AES key（16、24 或 32 字节）
+// 新写入的数据使用 CurrentKeyId 对应的 key 加密，key id 和数据一起保存，轮换之后旧的 key 仍然需要能够获取到，
+// 直到 merge 把旧数据用新的 key 重新加密
+type KeyProvider interface {
+	CurrentKeyId() uint32					// 当前使用的 key id，不能为 0
+	GetKey(id uint32) ([]byte, error)		// 不存在时返回 ErrEncryptionKeyNotFound
+}
+
+// 固定的一组 key
+type StaticKeyProvider struct {
+	CurrentId	uint32
+	Keys		map[uint32][]byte
+}
+
+func (p *StaticKeyProvider) CurrentKeyId() uint32 {
+	return p.CurrentId
+}
+
+func (p *StaticKeyProvider) GetKey(id uint32) ([]byte, error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+// Encryptor 使用 AES-GCM 加密数据，缓存每个 key id 对应的 AEAD
+type Encryptor struct {
+	provider	KeyProvider
+	lock		sync.RWMutex
+	aeads		map[uint32]cipher.AEAD
+	hashKeys	map[uint32][]byte
+}
+
+func NewEncryptor(provider KeyProvider) (*Encryptor, error) {
+	e := &Encryptor{
+		provider:	provider,
+		aeads:		make(map[uint32]cipher.AEAD),
+		hashKeys:	make(map[uint32][]byte),
+	}
+	if provider.CurrentKeyId() == 0 {
+		return nil, errors.New("the current encryption key id must not be 0")
+	}
+	// 提前检查当前的 key 是否可用
+	if _, err := e.aead(provider.CurrentKeyId()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Encryptor) CurrentKeyId() uint32 {
+	return e.provider.CurrentKeyId()
+}
+
+func (e *Encryptor) aead(id uint32) (cipher.AEAD, error) {
+	e.lock.RLock()
+	aead, ok := e.aeads[id]
+	e.lock.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := e.provider.GetKey(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	e.aeads[id] = aead
+	e.lock.Unlock()
+	return aead, nil
+}
+
+// 用 id 对应的 key 加密，返回 nonce + 密文
+func (e *Encryptor) seal(id uint32, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := e.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, buf, plaintext, additionalData), nil
+}
+
+func (e *Encryptor) open(id uint32, buf, additionalData []byte) ([]byte, error) {
+	aead, err := e.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidEncryptionKey
+	}
+	plaintext, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrInvalidEncryptionKey
+	}
+	return plaintext, nil
+}
+
+// 用当前的 key 加密，返回的数据中带有 key id，用于加密数据文件之外的数据
+func (e *Encryptor) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	return e.EncryptWithKey(e.CurrentKeyId(), plaintext, additionalData)
+}
+
+// 用 id 对应的 key 加密，返回的数据中带有 key id
+func (e *Encryptor) EncryptWithKey(id uint32, plaintext, additionalData []byte) ([]byte, error) {
+	buf := make([]byte, binary.MaxVarintLen32)
+	n := binary.PutUvarint(buf, uint64(id))
+	sealed, err := e.seal(id, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf[:n], sealed...), nil
+}
+
+func (e *Encryptor) Decrypt(buf, additionalData []byte) ([]byte, error) {
+	id, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	return e.open(uint32(id), buf[n:], additionalData)
+}
+
+// 用 id 对应的 key 派生出的 HMAC key 计算 data 的摘要，相同的数据总是得到相同的摘要
+func (e *Encryptor) Hash(id uint32, data []byte) ([]byte, error) {
+	e.lock.RLock()
+	hashKey, ok := e.hashKeys[id]
+	e.lock.RUnlock()
+	if !ok {
+		key, err := e.provider.GetKey(id)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("aperturekv-hash-key"))
+		hashKey = mac.Sum(nil)
+		e.lock.Lock()
+		e.hashKeys[id] = hashKey
+		e.lock.Unlock()
+	}
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// 加密 LogRecord 的 key 和 value，返回新的 LogRecord，不会修改传入的数据
+// key 和 value 拼在一起加密，加密之后的数据按原来 key 的长度拆分到 Key 和 Value 中
+func (e *Encryptor) EncryptLogRecord(logRecord *LogRecord) (*LogRecord, error) {
+	encrypted := *logRecord
+	encrypted.KeyId = e.CurrentKeyId()
+	plaintext := make([]byte, len(logRecord.Key)+len(logRecord.Value))
+	copy(plaintext, logRecord.Key)
+	copy(plaintext[len(logRecord.Key):], logRecord.Value)
+	sealed, err := e.seal(encrypted.KeyId, plaintext, logRecordAdditionalData(&encrypted))
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Key = sealed[:len(logRecord.Key)]
+	encrypted.Value = sealed[len(logRecord.Key):]
+	return &encrypted, nil
+}
+
+// 解密读取到的 LogRecord，解密之后 KeyId 为 0
+// 没有加密的数据不需要处理，所以 e 为 nil 时也可以调用
+func (e *Encryptor) decryptLogRecord(logRecord *LogRecord) error {
+	if logRecord.KeyId == 0 {
+		return nil
+	}
+	if e == nil {
+		return ErrEncryptionKeyNotFound
+	}
+	keySize := len(logRecord.Key)
+	sealed := make([]byte, keySize+len(logRecord.Value))
+	copy(sealed, logRecord.Key)
+	copy(sealed[keySize:], logRecord.Value)
+	plaintext, err := e.open(logRecord.KeyId, sealed, logRecordAdditionalData(logRecord))
+	if err != nil {
+		return err
+	}
+	logRecord.Key = plaintext[:keySize]
+	logRecord.Value = plaintext[keySize:]
+	logRecord.KeyId = 0
+	return nil
+}
+
+// header 中的字段作为附加数据参与认证，防止 header 被修改（例如把正常的记录改为删除）
+func logRecordAdditionalData(logRecord *LogRecord) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64+binary.MaxVarintLen32*2)
+	buf[0] = logRecord.Type | logRecord.Codec<<logRecordCodecShift
+	index := 1
+	index += binary.PutVarint(buf[index:], logRecord.Expire)
+	index += binary.PutUvarint(buf[index:], uint64(logRecord.KeyId))
+	index += binary.PutUvarint(buf[index:], uint64(len(logRecord.Key)))
+	return buf[:index]
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/fio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptor_LogRecord(t *testing.T) {
+	provider := &StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32)},
+	}
+	encryptor, err := NewEncryptor(provider)
+	assert.Nil(t, err)
+
+	rec := &LogRecord{
+		Key:	[]byte("name"),
+		Value:	[]byte("bitcask-go"),
+		Type:	LogRecordNormal,
+		Expire:	1700000000000000000,
+	}
+	encrypted, err := encryptor.EncryptLogRecord(rec)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), encrypted.KeyId)
+	assert.Equal(t, uint32(0), rec.KeyId)
+	res, n := EncodeLogRecord(encrypted)
+	assert.False(t, bytes.Contains(res, rec.Key))
+	assert.False(t, bytes.Contains(res, rec.Value))
+
+	decoded, size, err := DecodeLogRecord(res, encryptor)
+	assert.Nil(t, err)
+	assert.Equal(t, n, size)
+	assert.Equal(t, rec, decoded)
+
+	// 没有 key 或者 key 不对
+	_, _, err = DecodeLogRecord(res, nil)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+	wrongKey, err := NewEncryptor(&StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: bytes.Repeat([]byte("x"), 32)},
+	})
+	assert.Nil(t, err)
+	_, _, err = DecodeLogRecord(res, wrongKey)
+	assert.Equal(t, ErrInvalidEncryptionKey, err)
+
+	// header 被修改之后无法解密，即使 crc 是对的
+	tampered := *encrypted
+	tampered.Type = LogRecordDeleted
+	res, _ = EncodeLogRecord(&tampered)
+	_, _, err = DecodeLogRecord(res, encryptor)
+	assert.Equal(t, ErrInvalidEncryptionKey, err)
+}
+
+func TestDataFileReadLogRecord_Encrypted(t *testing.T) {
+	provider := &StaticKeyProvider{
+		CurrentId:	2,
+		Keys:		map[uint32][]byte{
+			1:	bytes.Repeat([]byte("a"), 16),
+			2:	bytes.Repeat([]byte("b"), 32),
+		},
+	}
+	encryptor, err := NewEncryptor(provider)
+	assert.Nil(t, err)
+	dataFile, err := OpenDataFile(os.TempDir(), 3333, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer os.Remove(GetDataFileName(os.TempDir(), 3333))
+	dataFile.Encryptor = encryptor
+
+	// 同一个文件中有不同 key 加密的数据和压缩之后加密的数据
+	rec1 := &LogRecord{Key: []byte("k1"), Value: []byte("v1")}
+	rec2 := &LogRecord{Key: []byte("k2"), Value: bytes.Repeat([]byte("v"), 1024)}
+	provider.CurrentId = 1
+	encrypted, err := encryptor.EncryptLogRecord(rec1)
+	assert.Nil(t, err)
+	enc1, size1 := EncodeLogRecord(encrypted)
+	provider.CurrentId = 2
+	compressed, err := CompressLogRecord(rec2, CodecFlate)
+	assert.Nil(t, err)
+	encrypted, err = encryptor.EncryptLogRecord(compressed)
+	assert.Nil(t, err)
+	enc2, _ := EncodeLogRecord(encrypted)
+	assert.Nil(t, dataFile.Write(enc1))
+	assert.Nil(t, dataFile.Write(enc2))
+
+	readRec, _, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec)
+	readRec, _, err = dataFile.ReadLogRecord(size1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2, readRec)
+
+	// 旧的 key 没有了
+	delete(provider.Keys, 1)
+	dataFile.Encryptor, err = NewEncryptor(provider)
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 )
 
 
@@ -12,23 +13,35 @@ const (
 	LogRecordNormal	LogRecordType = iota // 正常的日志
 	LogRecordDeleted
 	LogRecordTxnFinished
+	// value 单独存储在 blob 文件中，记录的 value 是 blob 记录的位置
+	LogRecordBlobIndex
 )
 
-/* A complete LogRecord consists of 6 parts: 
-+------------------------------------+
-|	|    |		 |		   |   |	 |
-|crc|type|keySize|valueSize|key|value|
-| 4 |  1 |	 5	 |	  5	   |   |	 |
-+------------------------------------+
-the max length of header is 15
+// type 字段的最高位是标志位，置位时 header 中带有过期时间
+const logRecordExpireFlag byte = 1 << 7
+
+// type 字段的第 3 位置位时数据是加密的，header 中带有加密使用的 key id
+const logRecordEncryptedFlag byte = 1 << 3
+
+/* A complete LogRecord consists of 8 parts: 
+type: expire flag(1 bit) | codec(3 bits) | encrypted flag(1 bit) | record type(3 bits)
++---------------------------------------------------+
+|	|    |		 |		   |	  |	    |   |	    |
+|crc|type|keySize|valueSize|expire|keyId|key|value|
+| 4 |  1 |	 5	 |	  5	   |  10  |  5  |   |	    |
++---------------------------------------------------+
+expire and keyId are optional, the max length of header is 30
 */
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5 // 15
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*3 + binary.MaxVarintLen64 + 5 // 30
 
 // 一个 LogRecord 磁盘上的一条数据
 type LogRecord struct {
 	Key		[]byte
 	Value	[]byte
 	Type	LogRecordType
+	Expire	int64	// 过期时间（UnixNano），0 表示永不过期
+	Codec	CodecType	// value 的压缩算法，读取出来的 LogRecord 已经解压
+	KeyId	uint32		// 加密使用的 key id，0 表示没有加密，读取出来的 LogRecord 已经解密
 }
 
 // LogRecord 头部
@@ -37,6 +50,9 @@ type logRecordHeader struct {
 	recordType	LogRecordType
 	keySize		uint32
 	valueSize	uint32
+	expire		int64
+	codec		CodecType
+	keyId		uint32
 }
 
 // LogRecordPos 数据内存索引，主要描述数据在磁盘上的位置（参考 bitcask 论文）
@@ -44,6 +60,8 @@ type LogRecordPos struct {
 	Fid		uint32 	// 文件 id，数据存在了哪个文件上
 	Offset	int64 	// 存储在一个文件上的具体位置
 	Size	uint32 	// 标识数据在磁盘上的大小
+	Expire	int64	// 数据的过期时间（UnixNano），0 表示永不过期
+	Blob	*LogRecordPos	// value 单独存储在 blob 文件中时 blob 记录的位置
 }
 
 // 暂存的事务相关的数据
@@ -56,18 +74,30 @@ type TransactionRecord struct {
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	header := make([]byte, maxLogRecordHeaderSize)
 
-	header[4] = logRecord.Type
+	header[4] = logRecord.Type | logRecord.Codec<<logRecordCodecShift
+	if logRecord.Expire != 0 {
+		header[4] |= logRecordExpireFlag
+	}
+	if logRecord.KeyId != 0 {
+		header[4] |= logRecordEncryptedFlag
+	}
 	index := 5
 
 	// PutVarint 存储变长的数据
-	// crc + type + keySize + valueSize
+	// crc + type + keySize + valueSize (+ expire)
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	if logRecord.Expire != 0 {
+		index += binary.PutVarint(header[index:], logRecord.Expire)
+	}
+	if logRecord.KeyId != 0 {
+		index += binary.PutUvarint(header[index:], uint64(logRecord.KeyId))
+	}
 	size := index + len(logRecord.Key)+ len(logRecord.Value)
 
 	encBytes := make([]byte, size)
 	// header 部分拷贝过来
-	copy(encBytes[:index], header[:index]) // header(crc + type + keySize + valueSize)
+	copy(encBytes[:index], header[:index]) // header(crc + type + keySize + valueSize + expire)
 	copy(encBytes[index:], logRecord.Key)
 	copy(encBytes[index+len(logRecord.Key):], logRecord.Value)
 
@@ -80,11 +110,20 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 }
 
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*4+binary.MaxVarintLen64*3)
 	idx := 0
 	idx += binary.PutVarint(buf[idx:], int64(pos.Fid))
 	idx += binary.PutVarint(buf[idx:], pos.Offset)
 	idx += binary.PutVarint(buf[idx:], int64(pos.Size))
+	// 没有过期时间的位置索引和之前的编码保持一致
+	if pos.Expire != 0 || pos.Blob != nil {
+		idx += binary.PutVarint(buf[idx:], pos.Expire)
+	}
+	if pos.Blob != nil {
+		idx += binary.PutVarint(buf[idx:], int64(pos.Blob.Fid))
+		idx += binary.PutVarint(buf[idx:], pos.Blob.Offset)
+		idx += binary.PutVarint(buf[idx:], int64(pos.Blob.Size))
+	}
 	return buf[:idx]
 }
 
@@ -94,8 +133,22 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	idx += n
 	offset, n := binary.Varint(buf[idx:])
 	idx += n
-	size, _ := binary.Varint(buf[idx:])
-	return &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	size, n := binary.Varint(buf[idx:])
+	idx += n
+	pos := &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	if idx < len(buf) {
+		pos.Expire, n = binary.Varint(buf[idx:])
+		idx += n
+	}
+	if idx < len(buf) {
+		blobFid, n := binary.Varint(buf[idx:])
+		idx += n
+		blobOffset, n := binary.Varint(buf[idx:])
+		idx += n
+		blobSize, _ := binary.Varint(buf[idx:])
+		pos.Blob = &LogRecordPos{Fid: uint32(blobFid), Offset: blobOffset, Size: uint32(blobSize)}
+	}
+	return pos
 }
 
 // 解码 Header 信息
@@ -105,16 +158,41 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	}
 	header := &logRecordHeader{
 		crc: 		binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		recordType: buf[4] & logRecordTypeMask,
+		codec:		(buf[4] & logRecordCodecMask) >> logRecordCodecShift,
 	}
 	index := 5
 	keySize, n := binary.Varint(buf[index:])
+	// header 没有写完整，返回 -1 标识数据损坏
+	if n <= 0 {
+		return nil, -1
+	}
 	header.keySize = uint32(keySize)
 	index += n
 	
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, -1
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
+
+	if buf[4]&logRecordExpireFlag != 0 {
+		expire, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, -1
+		}
+		header.expire = expire
+		index += n
+	}
+	if buf[4]&logRecordEncryptedFlag != 0 {
+		keyId, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, -1
+		}
+		header.keyId = uint32(keyId)
+		index += n
+	}
 	
 	return header, int64(index)
 }
@@ -124,9 +202,9 @@ func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
 		return 0
 	}
 	/*
-	+----------------------------+
-	| type | keySize | valueSize |
-	+----------------------------+
+	+-------------------------------------+
+	| type | keySize | valueSize | expire |
+	+-------------------------------------+
 	without field `crc`.
 	*/
 	crc := crc32.ChecksumIEEE(header[:])
@@ -134,3 +212,38 @@ func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
 	crc = crc32.Update(crc, crc32.IEEETable, lr.Value)
 	return crc
 }
+
+// 从 buf 的开头解码一条 LogRecord，返回 LogRecord 和它的长度，加密的数据使用 encryptor 解密
+// buf 为空时返回 io.EOF，buf 中的数据不完整时返回 io.ErrUnexpectedEOF
+func DecodeLogRecord(buf []byte, encryptor *Encryptor) (*LogRecord, int64, error) {
+	if len(buf) == 0 {
+		return nil, 0, io.EOF
+	}
+	header, headerSize := decodeLogRecordHeader(buf)
+	if header == nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	recordSize := headerSize + int64(header.keySize) + int64(header.valueSize)
+	if int64(len(buf)) < recordSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	logRecord := &LogRecord{Type: header.recordType, Expire: header.expire, Codec: header.codec, KeyId: header.keyId}
+	if header.keySize > 0 || header.valueSize > 0 {
+		kvBuf := make([]byte, recordSize-headerSize)
+		copy(kvBuf, buf[headerSize:recordSize])
+		logRecord.Key = kvBuf[:header.keySize]
+		logRecord.Value = kvBuf[header.keySize:]
+	}
+	if getLogRecordCRC(logRecord, buf[crc32.Size:headerSize]) != header.crc {
+		return nil, 0, ErrInvalidCRC
+	}
+	// crc 是按磁盘上加密、压缩之后的数据计算的，校验之后再解密、解压
+	if err := encryptor.decryptLogRecord(logRecord); err != nil {
+		return nil, 0, err
+	}
+	if err := decompressLogRecord(logRecord); err != nil {
+		return nil, 0, err
+	}
+	return logRecord, recordSize, nil
+}
@@ -2,6 +2,7 @@ package data
 
 import (
 	"hash/crc32"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -96,4 +97,72 @@ func TestGetLogRecordCRC(t *testing.T) {
 	headerBuf3 := []byte{43, 153, 86, 17, 1, 8, 20}
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
-}
\ No newline at end of file
+}
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	rec := &LogRecord{
+		Key:	[]byte("name"),
+		Value:	[]byte("bitcask-go"),
+		Type:	LogRecordNormal,
+		Expire:	1700000000000000000,
+	}
+	res, n := EncodeLogRecord(rec)
+	assert.Equal(t, LogRecordNormal|logRecordExpireFlag, res[4])
+
+	header, headerSize := decodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+	assert.Equal(t, rec.Expire, header.expire)
+	assert.Equal(t, n, headerSize+int64(len(rec.Key)+len(rec.Value)))
+	assert.Equal(t, header.crc, getLogRecordCRC(rec, res[crc32.Size:headerSize]))
+
+	// 没有过期时间的记录编码保持不变
+	res2, n2 := EncodeLogRecord(&LogRecord{Key: rec.Key, Value: rec.Value})
+	assert.Equal(t, LogRecordNormal, res2[4])
+	assert.Equal(t, n-int64(len(res)-len(res2)), n2)
+}
+
+func TestEncodeLogRecordPos(t *testing.T) {
+	pos := &LogRecordPos{Fid: 1, Offset: 100, Size: 20}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+
+	pos.Expire = 1700000000000000000
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+
+	// value 在 blob 文件中
+	pos.Blob = &LogRecordPos{Fid: 3, Offset: 4096, Size: 1 << 20}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+	pos.Expire = 0
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+}
+
+func TestDecodeLogRecord(t *testing.T) {
+	rec := &LogRecord{
+		Key:	[]byte("name"),
+		Value:	[]byte("bitcask-go"),
+		Type:	LogRecordNormal,
+		Expire:	1700000000000000000,
+	}
+	res, n := EncodeLogRecord(rec)
+	res2, n2 := EncodeLogRecord(&LogRecord{Key: []byte("name"), Type: LogRecordDeleted})
+	buf := append(res, res2...)
+
+	decoded, size, err := DecodeLogRecord(buf, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, n, size)
+	assert.Equal(t, rec, decoded)
+	decoded, size, err = DecodeLogRecord(buf[n:], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, n2, size)
+	assert.Equal(t, LogRecordDeleted, decoded.Type)
+
+	_, _, err = DecodeLogRecord(nil, nil)
+	assert.Equal(t, io.EOF, err)
+	// 数据不完整
+	for _, l := range []int64{3, 6, n - 1} {
+		_, _, err = DecodeLogRecord(buf[:l], nil)
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+	buf[n-1] ^= 0xff
+	_, _, err = DecodeLogRecord(buf, nil)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
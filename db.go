@@ -4,17 +4,24 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/gofrs/flock"
 	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/fio"
 	"github.com/minimAluminiumalism/ApertureKV/index"
 	"github.com/minimAluminiumalism/ApertureKV/utils"
 )
 
+const fileLockName = "flock"
+
 type DB struct {
 	options		Options
 	mu			*sync.RWMutex
@@ -24,7 +31,48 @@ type DB struct {
 	index		index.Indexer				// 内存索引
 	seqNo		uint64						// 事务序列号，全局递增
 	reclaimSize	int64						// 当前有多少数据需要被 merge 掉/是无效数据
+	fileReclaimSize	map[uint32]int64		// 每个数据文件中的无效数据量
 	isMerging	bool						// 数据库正在 merge 中_
+	isBackingUp	bool						// 数据库正在备份中，备份期间不能 merge
+	fileLock	*flock.Flock				// 文件锁，保证多进程之间的互斥
+	corrupted	[]CorruptedData				// 启动时因为损坏被丢弃的数据
+	snapshots	map[*Snapshot]struct{}		// 还没有释放的快照
+	retiredFiles	[]*data.DataFile		// 已经被 merge 替换掉，但仍然被快照使用的数据文件
+	activeTxns	map[*Txn]struct{}			// 还没有提交或回滚的乐观事务
+	txnWrites	[]*committedWrite			// 乐观事务运行期间提交的写入，用于冲突检测
+	expires		expireHeap					// 设置了过期时间的 key，按过期时间排序
+	expireItems	map[string]*expireItem		// 每个 key 在 expires 中的一项
+	subscriptions	map[*Subscription]struct{}	// 变更订阅
+	logCursors		map[*logCursor]struct{}		// 正在读取新写入数据的订阅和复制
+	compactedSeq	uint64					// 这个位置之前的变更已经被 merge 掉了
+	rewrittenFids	map[uint32]struct{}		// merge 重写生成的数据文件
+	replicationServers	map[*ReplicationServer]struct{}	// 主节点上的复制服务
+	replica			*replica				// 以只读副本的方式打开时从主节点接收数据
+	encryptor		*data.Encryptor			// 加密数据文件、hint 文件和 B+ 树索引，没有配置 key 时为 nil
+	activeBlobFile	*data.DataFile				// 当前写入大 value 的 blob 文件
+	olderBlobFiles	map[uint32]*data.DataFile	// 旧的 blob 文件，只能用于读
+	blobReclaimSize	map[uint32]int64			// 每个 blob 文件中的无效数据量
+	bloomFilter		*index.BloomFilter			// 索引中所有 key 的布隆过滤器，只在使用 B+ 树索引时开启
+	bloomNegatives	uint64						// 布隆过滤器判断 key 不存在的次数
+	bloomFalsePositives	uint64					// 布隆过滤器判断 key 可能存在但实际不存在的次数
+	valueCache		*valueCache					// 热点 value 的缓存，没有配置时为 nil
+	fdPool			*fio.FDPool					// 限制打开的数据文件数量，没有配置时为 nil
+	lastMerge	*mergeResult				// 上一次 merge 的结果
+	autoMergeCloseCh	chan struct{}		// 通知后台自动 merge 退出
+	autoMergeWg			sync.WaitGroup
+	syncMu		sync.Mutex					// 保护下面 group commit 的状态
+	syncCond	*sync.Cond
+	syncing		bool						// 有写入方正在 sync 活跃文件
+	syncedSeq	uint64						// 这个位置之前的数据已经持久化了
+	syncErr		error						// sync 失败的错误，之后的 sync 都返回这个错误
+	syncingFile	*data.DataFile				// 正在 sync 的数据文件，由数据库的锁保护
+	syncingBlobFile	*data.DataFile			// 正在 sync 的 blob 文件，由数据库的锁保护
+	unsyncedBytes	int64					// 上一次 sync 之后写入的数据量
+	unsyncedSince	time.Time				// 最早一条还没有 sync 的写入的时间
+	pendingUndo		[]*indexUndo			// 当前写入对索引的修改
+	unsyncedUndo	[]*indexUndo			// 等待 sync 的写入对索引的修改，按写入的顺序排列
+	syncCloseCh		chan struct{}			// 通知后台定时 sync 退出
+	syncWg			sync.WaitGroup
 }
 
 type Stat struct {
@@ -32,6 +80,32 @@ type Stat struct {
 	DataFileNum		uint	// 数据文件的数量
 	ReclaimableSize	int64	// 可以 merge 回收的数据量(Bytes)
 	DiskSize		int64	// 数据目录所占磁盘大小
+	UnsyncedBytes	int64		// 还没有持久化的数据量，崩溃时最多丢失这么多数据
+	UnsyncedSince	time.Time	// 最早一条还没有持久化的写入的时间，全部持久化之后为零值
+	CorruptedData	[]CorruptedData	// 启动时因为损坏被丢弃的数据
+	LastMergeTime		time.Time		// 上一次 merge 开始的时间，没有 merge 过时为零值
+	LastMergeDuration	time.Duration	// 上一次 merge 的耗时
+	LastMergeErr		string			// 上一次 merge 的错误信息，成功时为空
+	DataFiles			[]DataFileStat	// 每个数据文件的统计信息，按文件 id 排序
+	Replica				*ReplicaStatus	// 副本的复制状态，不是副本时为 nil
+	BloomFilter			*BloomFilterStat	// 布隆过滤器的统计信息，没有开启时为 nil
+	ValueCache			*ValueCacheStat		// value 缓存的统计信息，没有开启时为 nil
+	BlobFileNum			uint			// blob 文件的数量
+	BlobReclaimableSize	int64			// blob 文件中可以被 GCBlobFiles 回收的数据量(Bytes)
+}
+
+type DataFileStat struct {
+	Fid				uint32
+	Size			int64	// 数据文件的大小
+	ReclaimableSize	int64	// 数据文件中可以 merge 回收的数据量(Bytes)
+}
+
+// 启动加载索引时被丢弃的损坏数据
+type CorruptedData struct {
+	Fid		uint32	// 数据文件 id
+	Offset	int64	// 损坏数据在文件中的起始位置
+	Size	int64	// 被丢弃的数据大小(Bytes)
+	Reason	string	// 读取数据时遇到的错误
 }
 
 
@@ -47,30 +121,157 @@ func Open(options Options) (*DB, error) {
 			return nil, err
 		}
 	}
+
+	// 判断当前数据目录是否正在被其他进程使用
+	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+	// 副本全量同步替换数据文件时崩溃，需要在打开索引之前完成替换
+	if err := recoverResync(options); err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+
+	var encryptor *data.Encryptor
+	if options.EncryptionKeys != nil {
+		if encryptor, err = data.NewEncryptor(options.EncryptionKeys); err != nil {
+			_ = fileLock.Unlock()
+			return nil, err
+		}
+	}
+	indexer, err := index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites, encryptor)
+	if err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+
 	db := &DB{
 		options: 	options,
 		mu:			new(sync.RWMutex),
 		olderFiles: make(map[uint32]*data.DataFile),
-		index:		index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
+		fileReclaimSize: make(map[uint32]int64),
+		snapshots:	make(map[*Snapshot]struct{}),
+		activeTxns:	make(map[*Txn]struct{}),
+		expireItems:	make(map[string]*expireItem),
+		subscriptions:	make(map[*Subscription]struct{}),
+		logCursors:		make(map[*logCursor]struct{}),
+		rewrittenFids:	make(map[uint32]struct{}),
+		olderBlobFiles:	make(map[uint32]*data.DataFile),
+		blobReclaimSize:	make(map[uint32]int64),
+		valueCache:		newValueCache(options.ValueCacheSize),
+		fdPool:			newFDPool(options.MaxOpenFiles),
+		replicationServers:	make(map[*ReplicationServer]struct{}),
+		index:		indexer,
+		fileLock:	fileLock,
+		encryptor:	encryptor,
 	}
-	if err := db.loadDataFiles(); err != nil {
+	db.syncCond = sync.NewCond(&db.syncMu)
+	if options.ReplicaOf != "" {
+		db.replica = newReplica(db, options.ReplicaOf)
+	}
+	// 加载数据文件并构建索引，失败时释放已经打开的文件和文件锁
+	if err := db.load(); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
 
+	// 启动后台自动 merge，副本只 merge 已经接收完的旧数据文件
+	if db.replica != nil {
+		db.replica.start()
+	} else {
+		db.startSyncTicker()
+	}
+	db.startAutoMerge()
+	return db, nil
+}
+
+func (db *DB) load() error {
+	// 加载 merge 数据目录，用 merge 后的文件替换掉旧的数据文件
+	if err := db.loadMergeFiles(); err != nil {
+		return err
+	}
+
+	if err := db.loadDataFiles(); err != nil {
+		return err
+	}
+
+	if err := db.loadBlobFiles(); err != nil {
+		return err
+	}
+
+	// 从 hint 文件中加载被 merge 过的数据文件的索引
+	if err := db.loadIndexFromHintFile(); err != nil {
+		return err
+	}
+
 	// 从数据文件加载索引
 	if err := db.loadIndexFromDataFiles(); err != nil {
-		return nil, err
+		return err
 	}
-	
-	return db, nil
+	if err := db.loadMergeRewrittenFile(); err != nil {
+		return err
+	}
+
+	// 索引加载完成之后再构建布隆过滤器，被删除的 key 不会留在过滤器中
+	db.rebuildBloomFilter()
+	if err := db.indexErr(); err != nil {
+		return err
+	}
+
+	// 加载完索引之后，数据文件切换回标准文件 IO 以支持追加写
+	if db.options.MMapAtStartup {
+		if err := db.resetIoType(); err != nil {
+			return err
+		}
+	}
+
+	// 删除重启期间过期的数据，需要写删除记录，所以在切换回标准文件 IO 之后
+	db.collectExpired()
+	return nil
 }
 
-func (db *DB) Close() error {
-	if db.activeFile != nil {
-		return nil
+func (db *DB) Close() (err error) {
+	defer func() {
+		// 释放文件锁，其他进程才可以打开这个数据目录；关闭文件失败时也需要释放，优先返回关闭文件的错误
+		if unlockErr := db.fileLock.Unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+	// 先停止后台 merge、定时 sync、变更订阅和复制，它们都需要获取锁
+	db.stopAutoMerge()
+	db.stopSyncTicker()
+	db.closeSubscriptions()
+	db.closeReplicationServers()
+	if db.replica != nil {
+		db.replica.stop()
 	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
+
+	// 释放还没有释放的快照，关闭之后快照和它上面的迭代器都不能再读取索引
+	for s := range db.snapshots {
+		s.release()
+	}
+	db.closeRetiredFiles()
+
+	// 关闭索引
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+	for _, blobFile := range db.blobFileList() {
+		if err := blobFile.Close(); err != nil {
+			return err
+		}
+	}
+	if db.activeFile == nil {
+		return nil
+	}
 	if err := db.activeFile.Close(); err != nil {
 		return err
 	}
@@ -83,17 +284,28 @@ func (db *DB) Close() error {
 }
 
 func (db *DB) Sync() error {
-	if db.activeFile != nil {
+	if db.activeFile == nil {
 		return nil
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	return db.syncWithLock()
 }
 
 func (db *DB) Stat() *Stat {
+	// 只读取统计信息，过期但是还没有删除的数据按已经删除统计
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	expired := db.expiredPositions()
+	fileExpiredSize := make(map[uint32]int64)
+	var expiredSize, blobExpiredSize int64
+	for _, pos := range expired {
+		expiredSize += int64(pos.Size)
+		fileExpiredSize[pos.Fid] += int64(pos.Size)
+		if pos.Blob != nil {
+			blobExpiredSize += int64(pos.Blob.Size)
+		}
+	}
 
 	var dataFiles = uint(len(db.olderFiles))
 	if db.activeFile != nil {
@@ -104,27 +316,87 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Sprintf("failed to count dir size: %v", err))
 	}
-	return &Stat{
-		KeyNum:				uint(db.index.Size()),
+	stat := &Stat{
+		KeyNum:				uint(db.index.Size() - len(expired)),
 		DataFileNum: 		dataFiles,
-		ReclaimableSize: 	db.reclaimSize,
+		ReclaimableSize: 	db.reclaimSize + expiredSize,
 		DiskSize: 			dirSize,
+		UnsyncedBytes:		db.unsyncedBytes,
+		UnsyncedSince:		db.unsyncedSince,
+		CorruptedData:		db.corrupted,
+	}
+	if db.replica != nil {
+		status := db.replica.status
+		stat.Replica = &status
 	}
+	for _, dataFile := range db.dataFiles() {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			panic(fmt.Sprintf("failed to get data file size: %v", err))
+		}
+		stat.DataFiles = append(stat.DataFiles, DataFileStat{
+			Fid:				dataFile.FileId,
+			Size:				size,
+			ReclaimableSize:	db.fileReclaimSize[dataFile.FileId] + fileExpiredSize[dataFile.FileId],
+		})
+	}
+	stat.BloomFilter = db.bloomFilterStat()
+	stat.ValueCache = db.valueCache.stat()
+	stat.BlobFileNum = uint(len(db.blobFileList()))
+	stat.BlobReclaimableSize = blobExpiredSize
+	for _, size := range db.blobReclaimSize {
+		stat.BlobReclaimableSize += size
+	}
+	if db.lastMerge != nil {
+		stat.LastMergeTime = db.lastMerge.startTime
+		stat.LastMergeDuration = db.lastMerge.duration
+		if db.lastMerge.err != nil {
+			stat.LastMergeErr = db.lastMerge.err.Error()
+		}
+	}
+	return stat
+}
+
+// 按文件 id 排序的所有数据文件，调用前必须加锁
+func (db *DB) dataFiles() []*data.DataFile {
+	var dataFiles []*data.DataFile
+	for _, dataFile := range db.olderFiles {
+		dataFiles = append(dataFiles, dataFile)
+	}
+	if db.activeFile != nil {
+		dataFiles = append(dataFiles, db.activeFile)
+	}
+	sort.Slice(dataFiles, func(i, j int) bool {
+		return dataFiles[i].FileId < dataFiles[j].FileId
+	})
+	return dataFiles
 }
 
 // 写入 Key/Value 数据
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.put(key, value, 0)
+}
+
+func (db *DB) put(key []byte, value []byte, expire int64) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if db.replica != nil {
+		return ErrReadOnlyReplica
+	}
 	log_record := &data.LogRecord{
 		Key:	logRecordKeyWithSeq(key, nonTransactionSeqNo),
 		Value:	value,
 		Type: 	data.LogRecordNormal,
+		Expire:	expire,
 	}
+	// 写文件和更新索引需要在同一把锁内完成，否则后台 merge 可能看到不一致的索引
+	db.mu.Lock()
+
 	// 追加写入文件到当前活跃文件中
-	pos, err := db.appendLogRecordWithLock(log_record)
+	pos, err := db.appendLogRecord(log_record)
 	if err != nil {
+		db.mu.Unlock()
 		return err
 	}
 
@@ -132,10 +404,20 @@ func (db *DB) Put(key []byte, value []byte) error {
 	/* 这里返回的是上一个在 oldPos 索引位置的元素，如果原来没有元素那就是 nil，
 		如果有那就说明在 Put 之后被覆盖了，这里是一个无效的数据需要更新 reclaimSize。
 	*/
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+	oldPos := db.index.Put(key, pos)
+	if err := db.indexErr(); err != nil {
+		db.mu.Unlock()
+		return err
 	}
-	return nil
+	if oldPos != nil {
+		db.addReclaimSize(oldPos)
+	}
+	db.addToBloomFilter(key)
+	db.setExpire(key, expire)
+	db.recordWrite(key)
+	db.recordUndo(key, pos, oldPos)
+	db.collectExpired()
+	return db.unlockAndSync(db.options.SyncWrites)
 }
 
 
@@ -143,40 +425,63 @@ func (db *DB) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
-	if pos := db.index.Get(key); pos == nil {
-		return nil
+	if db.replica != nil {
+		return ErrReadOnlyReplica
+	}
+	db.mu.Lock()
+
+	if pos := db.lookupIndex(key); pos == nil {
+		db.mu.Unlock()
+		return db.indexErr()
 	}
 	logRecord := &data.LogRecord{
 		Key: logRecordKeyWithSeq(key, nonTransactionSeqNo),
 		Type: data.LogRecordDeleted,
 	}
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
+		db.mu.Unlock()
 		return err
 	}
-	db.reclaimSize += int64(pos.Size)	// 	删除了一条**数据记录**，所以这条数据是无效的，后面需要 merge
+	db.addReclaimSize(pos)	// 	删除了一条**数据记录**，所以这条数据是无效的，后面需要 merge
 
 	oldPos, ok := db.index.Delete(key)
-
+	if err := db.indexErr(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
 	if !ok {
+		db.mu.Unlock()
 		return ErrIndexUpdateFailed
 	}
 	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+		db.addReclaimSize(oldPos)
 	}
-	return nil
+	db.setExpire(key, 0)
+	db.recordWrite(key)
+	db.recordUndo(key, nil, oldPos)
+	db.collectExpired()
+	return db.unlockAndSync(db.options.SyncWrites)
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
+	// 读取期间数据文件不能被 merge 替换
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	
 	// 从内存数据中读出 Key 对应的索引信息
-	logRecordPos := db.index.Get(key)
+	logRecordPos := db.lookupIndex(key)
 
-	// key 不在内存索引中，说明 key 不存在
 	if logRecordPos == nil {
+		if err := db.indexErr(); err != nil {
+			return nil, err
+		}
+	}
+	// key 不在内存索引中或者已经过期，说明 key 不存在
+	if logRecordPos == nil || isExpired(logRecordPos.Expire) {
 		return nil, ErrKeyNotFound
 	}
 
@@ -186,11 +491,13 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 
 func (db *DB) ListKeys() [][]byte {
 	iterator := db.index.Iterator(false)
-	keys := make([][]byte, db.index.Size())
-	idx := 0
+	defer iterator.Close()
+	keys := make([][]byte, 0, db.index.Size())
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		if isExpired(iterator.Value().Expire) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
@@ -204,6 +511,9 @@ func (db *DB) Fold(fn func(key []byte, value []byte)bool) error {
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if isExpired(iterator.Value().Expire) {
+			continue
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -216,6 +526,10 @@ func (db *DB) Fold(fn func(key []byte, value []byte)bool) error {
 }
 
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	// value 在 blob 文件中时不需要读取数据文件中的记录
+	if logRecordPos.Blob != nil {
+		return db.readCachedBlobValue(db.getBlobFile(logRecordPos.Blob.Fid), logRecordPos.Blob)
+	}
 	var dataFile *data.DataFile
 	if db.activeFile.FileId == logRecordPos.Fid {
 		dataFile = db.activeFile
@@ -225,6 +539,18 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
+	return db.readCachedValue(dataFile, logRecordPos)
+}
+
+// B+ 树索引读写索引文件失败时记录的错误，其他类型的索引不会失败
+func (db *DB) indexErr() error {
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		return bpt.Err()
+	}
+	return nil
+}
+
+func readValue(dataFile *data.DataFile, logRecordPos *data.LogRecordPos) ([]byte, error) {
 	// 根据偏移获取对应的数据
 	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
 	if err != nil {
@@ -238,10 +564,25 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 	return logRecord.Value, nil
 } 
 
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+// 编码写入数据文件的 LogRecord，value 达到阈值时按配置的算法压缩，配置了 key 时压缩之后再加密
+func (db *DB) encodeLogRecord(logRecord *data.LogRecord) ([]byte, int64, error) {
+	if db.options.Compression != CodecNone && logRecord.Type == data.LogRecordNormal &&
+		len(logRecord.Value) >= db.options.CompressThreshold {
+		compressed, err := data.CompressLogRecord(logRecord, db.options.Compression)
+		if err != nil {
+			return nil, 0, err
+		}
+		logRecord = compressed
+	}
+	if db.encryptor != nil {
+		encrypted, err := db.encryptor.EncryptLogRecord(logRecord)
+		if err != nil {
+			return nil, 0, err
+		}
+		logRecord = encrypted
+	}
+	encRecord, size := data.EncodeLogRecord(logRecord)
+	return encRecord, size, nil
 }
 
 // 追加写数据到活跃文件中
@@ -252,12 +593,30 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 	}
 
-	encRecord, size := data.EncodeLogRecord(logRecord)
+	// 大的 value 先写到 blob 文件中，数据文件中只记录 blob 的位置
+	if db.options.BlobThreshold > 0 && logRecord.Type == data.LogRecordNormal &&
+		len(logRecord.Value) >= db.options.BlobThreshold {
+		blobPos, err := db.appendBlob(logRecord.Key, logRecord.Value)
+		if err != nil {
+			return nil, err
+		}
+		logRecord = &data.LogRecord{
+			Key:	logRecord.Key,
+			Value:	data.EncodeLogRecordPos(blobPos),
+			Type:	data.LogRecordBlobIndex,
+			Expire:	logRecord.Expire,
+		}
+	}
+
+	encRecord, size, err := db.encodeLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
 
 	// 如果写入数据已经达到了活跃文件的阈值，关闭当前的活跃文件，打开新的文件
 	if db.activeFile.WriteOff+size > db.options.DataFileSize {
-		// 持久化磁盘防止数据丢失
-		if err := db.activeFile.Sync(); err != nil {
+		// 持久化磁盘防止数据丢失，数据文件引用的 blob 需要先持久化
+		if err := db.syncWithLock(); err != nil {
 			return nil, err
 		}
 		// 当前活跃文件转换为旧的数据文件
@@ -272,14 +631,13 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	if err := db.activeFile.Write(encRecord); err != nil {
 		return nil, err
 	}
-	if db.options.SyncWrites {
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-	}
+	db.addUnsyncedBytes(size)
+
+	db.notifyLogCursors()
 
 	// 构造内存索引信息
-	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size)}
+	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size), Expire: logRecord.Expire}
+	pos.Blob = blobPosOf(logRecord)
 	return pos, nil
 }
 
@@ -291,7 +649,7 @@ func (db *DB) setActiveDataFile() error {
 	if db.activeFile != nil {
 		initialFileId = db.activeFile.FileId + 1
 	}
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId)
+	dataFile, err := db.openDataFile(db.options.DirPath, initialFileId, fio.StandardFIO)
 	if err != nil {
 		return err
 	}
@@ -299,6 +657,34 @@ func (db *DB) setActiveDataFile() error {
 	return nil
 }
 
+// 打开数据文件，读取加密的数据时使用数据库的 key
+func (db *DB) openDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*data.DataFile, error) {
+	var dataFile *data.DataFile
+	if db.usePooledIO(dirPath, ioType) {
+		ioManager, err := db.fdPool.Open(data.GetDataFileName(dirPath, fileId))
+		if err != nil {
+			return nil, err
+		}
+		dataFile = data.NewDataFile(fileId, ioManager)
+	} else {
+		var err error
+		if dataFile, err = data.OpenDataFile(dirPath, fileId, ioType); err != nil {
+			return nil, err
+		}
+	}
+	dataFile.Encryptor = db.encryptor
+	return dataFile, nil
+}
+
+func (db *DB) openHintFile(dirPath string) (*data.DataFile, error) {
+	hintFile, err := data.OpenHintFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	hintFile.Encryptor = db.encryptor
+	return hintFile, nil
+}
+
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
 		return errors.New("Database dir path is empty")
@@ -306,9 +692,56 @@ func checkOptions(options Options) error {
 	if options.DataFileSize <= 0 {
 		return errors.New("Database data size must be an interger larger than 0")
 	}
+	// 变更订阅的 Seq 中只有 32 位用来表示文件中的偏移
+	if options.DataFileSize > math.MaxUint32 {
+		return errors.New("Database data size must be less than 4GB")
+	}
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio which is must between 0 ansd 1")
 	}
+	if options.RecoveryMode < RecoverTruncateTail || options.RecoveryMode > RecoverSkipCorrupted {
+		return errors.New("invalid recovery mode")
+	}
+	if options.BytesPerSync < 0 || options.SyncInterval < 0 {
+		return errors.New("sync bytes and interval must not be negative")
+	}
+	if options.Compression != CodecNone {
+		if _, err := data.GetCodec(options.Compression); err != nil {
+			return err
+		}
+	}
+	if options.CompressThreshold < 0 {
+		return errors.New("compress threshold must not be negative")
+	}
+	if options.BlobThreshold < 0 {
+		return errors.New("blob threshold must not be negative")
+	}
+	if options.BlobThreshold > 0 && options.BlobFileSize <= 0 {
+		return errors.New("blob file size must be larger than 0")
+	}
+	// 复制只同步数据文件，副本上不能有 blob 文件
+	if options.BlobThreshold > 0 && options.ReplicaOf != "" {
+		return ErrBlobNotReplicated
+	}
+	if options.BlobGCRatio < 0 || options.BlobGCRatio > 1 {
+		return errors.New("blob gc ratio must be between 0 and 1")
+	}
+	if options.BloomFilterFPRate < 0 || options.BloomFilterFPRate >= 1 {
+		return errors.New("bloom filter false positive rate must be between 0 and 1")
+	}
+	if options.ValueCacheSize < 0 {
+		return errors.New("value cache size must not be negative")
+	}
+	if options.MaxOpenFiles < 0 {
+		return errors.New("max open files must not be negative")
+	}
+	if options.AutoMergeInterval < 0 {
+		return errors.New("auto merge interval must not be negative")
+	}
+	window := options.AutoMergeWindow
+	if window.StartHour < 0 || window.StartHour > 23 || window.EndHour < 0 || window.EndHour > 23 {
+		return errors.New("auto merge window hours must be between 0 and 23")
+	}
 	return nil
 }
 
@@ -331,8 +764,12 @@ func (db *DB) loadDataFiles() error {
 	}
 	sort.Ints(fileIds)
 	db.fileIds = fileIds
+	ioType := fio.StandardFIO
+	if db.options.MMapAtStartup {
+		ioType = fio.MemoryMap
+	}
 	for i, fid := range fileIds {
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid))
+		dataFile, err := db.openDataFile(db.options.DirPath, uint32(fid), ioType)
 		if err != nil {
 			return err
 		}
@@ -345,6 +782,37 @@ func (db *DB) loadDataFiles() error {
 	return nil
 }
 
+// 将数据文件的 IO 类型重置为标准文件 IO
+func (db *DB) resetIoType() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	if err := db.resetDataFileIoType(db.activeFile); err != nil {
+		return err
+	}
+	for _, dataFile := range db.olderFiles {
+		if err := db.resetDataFileIoType(dataFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) resetDataFileIoType(dataFile *data.DataFile) error {
+	if !db.usePooledIO(db.options.DirPath, fio.StandardFIO) {
+		return dataFile.SetIOManager(db.options.DirPath, fio.StandardFIO)
+	}
+	if err := dataFile.IoManager.Close(); err != nil {
+		return err
+	}
+	ioManager, err := db.fdPool.Open(data.GetDataFileName(db.options.DirPath, dataFile.FileId))
+	if err != nil {
+		return err
+	}
+	dataFile.IoManager = ioManager
+	return nil
+}
+
 // 从数据文件中加载索引
 // 遍历所有文件中的记录，并更新到内存索引中
 func (db *DB) loadIndexFromDataFiles() error {
@@ -353,27 +821,28 @@ func (db *DB) loadIndexFromDataFiles() error {
 		return nil
 	}
 
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(oldPos.Size)
-		} else {
-			oldPos = db.index.Put(key, pos)
-		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
+	// 查看是否发生过 merge，被 merge 过的数据文件的索引已经从 hint 文件中加载了
+	hasMerge, nonMergeFileId := false, uint32(0)
+	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinFileName); err == nil {
+		fid, err := db.getNonMergeFileId(db.options.DirPath)
+		if err != nil {
+			return err
 		}
+		hasMerge = true
+		nonMergeFileId = fid
+		db.compactedSeq = changeSeq(fid, 0)
 	}
 
-	// 暂存事务数据
-	transactionRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo = nonTransactionSeqNo
-
+	replayer := newLogReplayer(db)
 
 	// 遍历所有文件 id，处理文件中的记录
 	for i, fid := range db.fileIds {
 		var fileId = uint32(fid)
+		// 比 nonMergeFileId 小的文件已经从 hint 文件中加载过索引了
+		if hasMerge && fileId < nonMergeFileId {
+			continue
+		}
 		var dataFile *data.DataFile
 		
 		if db.activeFile.FileId == fileId {
@@ -382,7 +851,9 @@ func (db *DB) loadIndexFromDataFiles() error {
 			dataFile = db.olderFiles[fileId]
 		}
 
+		var isActiveFile = i == len(db.fileIds)-1
 		var offset int64 = 0
+		var dropped bool
 		for {
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
@@ -390,45 +861,194 @@ func (db *DB) loadIndexFromDataFiles() error {
 				if err == io.EOF {
 					break
 				}
-				// 其他错误返回
-				return err
+				// 数据损坏，根据恢复策略决定是否丢弃从 offset 开始的数据
+				if !db.canDropCorrupted(isActiveFile, err) {
+					return err
+				}
+				if err := db.dropCorrupted(dataFile, offset, err); err != nil {
+					return err
+				}
+				dropped = true
+				break
 			}
 			// 构建内存索引并保存
 			logRecordPos := &data.LogRecordPos{
 				Fid: 	fileId,
 				Offset: offset,
 				Size:	uint32(size),
+				Expire:	logRecord.Expire,
 			}
 
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo { // 非事务操作
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 事务完成，对于 seqNo 的数据可以更新到内存索引中
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos: 	logRecordPos,
-					})
+			replayer.replay(logRecord, logRecordPos)
+			offset += size
+		}
+		if isActiveFile {
+			// 活跃文件末尾可能还有无法识别的数据（例如只写了一部分的 header），不截断的话后续追加写的位置就不对了
+			fileSize, err := dataFile.IoManager.Size()
+			if err != nil {
+				return err
+			}
+			if !dropped && offset < fileSize {
+				if db.options.RecoveryMode == RecoverStrict {
+					return ErrDataDirectoryCorrupted
+				}
+				if err := db.dropCorrupted(dataFile, offset, ErrDataDirectoryCorrupted); err != nil {
+					return err
 				}
 			}
-			
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
+			db.activeFile.WriteOff = offset
+		}
+	}
+	// 副本之后收到的数据可能会提交这些事务
+	if db.replica != nil {
+		db.replica.replayer = replayer
+	} else {
+		replayer.discardUnfinished()
+	}
+	// hint 文件中的索引可能指向已经不存在的数据文件，这部分无效数据不需要统计
+	for fid := range db.fileReclaimSize {
+		if _, ok := db.olderFiles[fid]; !ok && fid != db.activeFile.FileId {
+			db.removeReclaimSize(fid)
+		}
+	}
+	for fid := range db.blobReclaimSize {
+		if db.getBlobFile(fid) == nil {
+			delete(db.blobReclaimSize, fid)
+		}
+	}
+	db.seqNo = replayer.seqNo
+	return nil
+}
+
+// 按照写入的顺序重放数据记录并更新内存索引，事务的数据在读到事务完成的标识之后才会生效
+type logReplayer struct {
+	db					*DB
+	transactionRecords	map[uint64][]*data.TransactionRecord	// 暂存事务数据
+	seqNo				uint64									// 读到的最大事务序列号
+}
+
+func newLogReplayer(db *DB) *logReplayer {
+	return &logReplayer{
+		db:					db,
+		transactionRecords:	make(map[uint64][]*data.TransactionRecord),
+		seqNo:				nonTransactionSeqNo,
+	}
+}
+
+// 调用前必须加锁
+func (r *logReplayer) replay(logRecord *data.LogRecord, pos *data.LogRecordPos) {
+	pos.Blob = blobPosOf(logRecord)
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+	if seqNo == nonTransactionSeqNo { // 非事务操作
+		r.updateIndex(realKey, logRecord.Type, pos)
+	} else {
+		// 事务完成，对于 seqNo 的数据可以更新到内存索引中
+		if logRecord.Type == data.LogRecordTxnFinished {
+			for _, txnRecord := range r.transactionRecords[seqNo] {
+				r.updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
 			}
-			offset += size
+			delete(r.transactionRecords, seqNo)
+			// 事务完成的标识不会被索引引用
+			r.db.addReclaimSize(pos)
+		} else {
+			logRecord.Key = realKey
+			r.transactionRecords[seqNo] = append(r.transactionRecords[seqNo], &data.TransactionRecord{
+				Record: logRecord,
+				Pos: 	pos,
+			})
 		}
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+	}
+
+	if seqNo > r.seqNo {
+		r.seqNo = seqNo
+	}
+}
+
+func (r *logReplayer) updateIndex(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	db := r.db
+	var oldPos *data.LogRecordPos
+	if typ == data.LogRecordDeleted {
+		oldPos, _ = db.index.Delete(key)
+		// 删除记录本身也是无效数据；merge 之后被删除的 key 可能已经不在索引中了
+		db.addReclaimSize(pos)
+		db.setExpire(key, 0)
+	} else {
+		oldPos = db.index.Put(key, pos)
+		db.addToBloomFilter(key)
+		db.setExpire(key, pos.Expire)
+	}
+	if oldPos != nil {
+		db.addReclaimSize(oldPos)
+	}
+}
+
+// 没有提交的事务数据都是无效的
+func (r *logReplayer) discardUnfinished() {
+	for _, txnRecords := range r.transactionRecords {
+		for _, txnRecord := range txnRecords {
+			r.db.addReclaimSize(txnRecord.Pos)
+		}
+	}
+	r.transactionRecords = make(map[uint64][]*data.TransactionRecord)
+}
+
+// 记录一条无效数据，调用前必须加锁
+func (db *DB) addReclaimSize(pos *data.LogRecordPos) {
+	db.reclaimSize += int64(pos.Size)
+	db.fileReclaimSize[pos.Fid] += int64(pos.Size)
+	if pos.Blob != nil {
+		db.addBlobReclaimSize(pos.Blob)
+	}
+}
+
+// 无效数据重新生效，调用前必须加锁
+func (db *DB) subReclaimSize(pos *data.LogRecordPos) {
+	db.reclaimSize -= int64(pos.Size)
+	db.fileReclaimSize[pos.Fid] -= int64(pos.Size)
+	if pos.Blob != nil {
+		db.blobReclaimSize[pos.Blob.Fid] -= int64(pos.Blob.Size)
+	}
+}
+
+// 数据文件被删除时，移除它的无效数据统计，调用前必须加锁
+func (db *DB) removeReclaimSize(fid uint32) {
+	db.reclaimSize -= db.fileReclaimSize[fid]
+	delete(db.fileReclaimSize, fid)
+}
+
+// 判断加载索引时遇到的损坏数据是否可以丢弃
+func (db *DB) canDropCorrupted(isActiveFile bool, err error) bool {
+	if err != data.ErrInvalidCRC && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	switch db.options.RecoveryMode {
+	case RecoverTruncateTail:
+		return isActiveFile
+	case RecoverSkipCorrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// 丢弃数据文件从 offset 开始的数据，并记录下来
+// 活跃文件会被截断到 offset，旧的数据文件只是不再读取后面的数据
+func (db *DB) dropCorrupted(dataFile *data.DataFile, offset int64, reason error) error {
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if dataFile.FileId == db.activeFile.FileId {
+		if err := os.Truncate(data.GetDataFileName(db.options.DirPath, dataFile.FileId), offset); err != nil {
+			return err
 		}
 	}
-	db.seqNo = currentSeqNo
+	db.corrupted = append(db.corrupted, CorruptedData{
+		Fid:	dataFile.FileId,
+		Offset:	offset,
+		Size:	fileSize - offset,
+		Reason:	reason.Error(),
+	})
 	return nil
 }
 
@@ -1,11 +1,21 @@
 package aperturekv
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/index"
 	"github.com/minimAluminiumalism/ApertureKV/utils"
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
 )
 
 
@@ -325,4 +335,456 @@ func TestDB_Stat(t *testing.T) {
 	stat := db.Stat()
 	t.Log(stat)
 	assert.NotNil(t, stat)
-}
\ No newline at end of file
+}
+func TestDB_FileLock(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-filelock")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 数据目录已经被使用，不能重复打开
+	_, err = Open(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	// 关闭之后释放了文件锁，可以重新打开
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db2)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_OpenMMap(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024 * 1024
+	opts.MMapAtStartup = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 使用 mmap 加载索引，加载完成后可以继续写入
+	opts.MMapAtStartup = true
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 50000, len(db2.ListKeys()))
+	err = db2.Put(utils.GetTestKey(50000), []byte("value after mmap"))
+	assert.Nil(t, err)
+	val, err := db2.Get(utils.GetTestKey(50000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value after mmap"), val)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	val, err = db3.Get(utils.GetTestKey(50000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value after mmap"), val)
+	err = db3.Close()
+	assert.Nil(t, err)
+}
+
+// 写入时崩溃，活跃文件末尾只写了一部分数据
+func TestDB_RecoverTornWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recover-torn")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	activeFileId, writeOff := db.activeFile.FileId, db.activeFile.WriteOff
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 模拟只写了一半的记录
+	encRecord, size := data.EncodeLogRecord(&data.LogRecord{
+		Key:	logRecordKeyWithSeq(utils.GetTestKey(100), nonTransactionSeqNo),
+		Value:	utils.RandomValue(128),
+	})
+	fileName := data.GetDataFileName(dir, activeFileId)
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(encRecord[:size/2])
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	// 严格模式下不能打开
+	strictOpts := opts
+	strictOpts.RecoveryMode = RecoverStrict
+	_, err = Open(strictOpts)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// 默认截断末尾损坏的数据，没有设置 RecoveryMode 的 Options 也是一样
+	db2, err := Open(Options{
+		DirPath:			dir,
+		DataFileSize:		opts.DataFileSize,
+		IndexType:			BTree,
+		DataFileMergeRatio:	opts.DataFileMergeRatio,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db2.ListKeys()))
+	stat := db2.Stat()
+	assert.Equal(t, 1, len(stat.CorruptedData))
+	assert.Equal(t, activeFileId, stat.CorruptedData[0].Fid)
+	assert.Equal(t, writeOff, stat.CorruptedData[0].Offset)
+	assert.Equal(t, size/2, stat.CorruptedData[0].Size)
+	fileInfo, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, fileInfo.Size())
+
+	// 截断之后可以继续正常写入
+	err = db2.Put(utils.GetTestKey(100), []byte("value after recovery"))
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	val, err := db3.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value after recovery"), val)
+	assert.Equal(t, 0, len(db3.Stat().CorruptedData))
+	err = db3.Close()
+	assert.Nil(t, err)
+}
+
+// 旧的数据文件中有损坏的数据
+func TestDB_RecoverCorruptedOlderFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recover-older")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 1)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 修改第一个数据文件中的一个字节
+	file, err := os.OpenFile(data.GetDataFileName(dir, 0), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("#"), 1000)
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+
+	// 跳过旧数据文件中损坏的部分
+	opts.RecoveryMode = RecoverSkipCorrupted
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	stat := db2.Stat()
+	assert.Equal(t, 1, len(stat.CorruptedData))
+	assert.Equal(t, uint32(0), stat.CorruptedData[0].Fid)
+	assert.Less(t, len(db2.ListKeys()), 20000)
+	val, err := db2.Get(utils.GetTestKey(19999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	opts.DataFileSize = 256 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	jsonValue := func(i int) []byte {
+		var items []string
+		for j := 0; j < 10; j++ {
+			items = append(items, fmt.Sprintf(`{"id":%d,"name":"bitcask-go","tags":["kv","storage","log"]}`, i*10+j))
+		}
+		return []byte("[" + strings.Join(items, ",") + "]")
+	}
+	// 先写入没有压缩的数据
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), jsonValue(i)))
+	}
+	rawSize := db.Stat().DiskSize
+	assert.Nil(t, db.Close())
+
+	// 打开压缩之后写入的数据和之前没有压缩的数据混在一起
+	opts.Compression = CodecFlate
+	opts.CompressThreshold = 64
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 2000; i < 4000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), jsonValue(i)))
+	}
+	// 小于阈值的数据不压缩
+	assert.Nil(t, db.Put([]byte("small"), []byte("value")))
+	assert.True(t, db.Stat().DiskSize-rawSize < rawSize)
+	for _, i := range []int{0, 1999, 2000, 3999} {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), val)
+	}
+	val, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// merge 之后所有的数据都被压缩
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 3001, len(db.ListKeys()))
+	assert.True(t, db.Stat().DiskSize < rawSize)
+	for _, i := range []int{1000, 1999, 3999} {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), val)
+	}
+
+	assert.Nil(t, db.Close())
+
+	// 没有注册的压缩算法无法打开
+	opts.Compression = 6
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrUnknownCodec, err)
+}
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = BPlusTree
+	opts.DataFileMergeRatio = 0
+	opts.EncryptionKeys = &StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: []byte("0123456789abcdef0123456789abcdef")},
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("secret-value-%d", i))))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// 数据文件、hint 文件和 B+ 树索引中都没有明文的 key 和 value
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		buf, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(buf, []byte("bitcask-go-key")), entry.Name())
+		assert.False(t, bytes.Contains(buf, []byte("secret-value")), entry.Name())
+	}
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	val, err := db.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret-value-1999"), val)
+	assert.Nil(t, db.Close())
+
+	// key 不对或者没有 key 时无法打开
+	opts.EncryptionKeys = &StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: []byte("fedcba9876543210fedcba9876543210")},
+	}
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidEncryptionKey, err)
+	opts.IndexType = BTree
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidEncryptionKey, err)
+	opts.EncryptionKeys = nil
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrEncryptionKeyNotFound, err)
+}
+
+// 加密的 B+ 树索引中保存的是 key 的摘要，迭代器仍然按 key 的顺序返回数据
+func TestDB_Encryption_BPTreeIterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-bptree-iterator")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.EncryptionKeys = &StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: []byte("0123456789abcdef0123456789abcdef")},
+	}
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for _, i := range rand.Perm(200) {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i))))
+	}
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	collect := func(opts IteratorOptions, seek string) []string {
+		iter := db.NewIterator(opts)
+		defer iter.Close()
+		var keys []string
+		for iter.Seek([]byte(seek)); iter.Valid(); iter.Next() {
+			value, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, "value"+string(iter.Key())[3:], string(value))
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+	keys := collect(IteratorOptions{}, "key-150")
+	assert.Equal(t, 50, len(keys))
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Equal(t, "key-150", keys[0])
+
+	keys = collect(IteratorOptions{Reverse: true}, "key-0495")
+	assert.Equal(t, 50, len(keys))
+	assert.Equal(t, "key-049", keys[0])
+	assert.Equal(t, "key-000", keys[49])
+	for i := 1; i < len(keys); i++ {
+		assert.True(t, keys[i-1] > keys[i])
+	}
+
+	keys = collect(IteratorOptions{Prefix: []byte("key-12")}, "")
+	assert.Equal(t, []string{"key-120", "key-121", "key-122", "key-123", "key-124",
+		"key-125", "key-126", "key-127", "key-128", "key-129"}, keys)
+
+	// 事务的迭代器把快照和自己的写入按 key 的顺序合并
+	txn := db.NewTxn(DefaultTxnOptions)
+	assert.Nil(t, txn.Put([]byte("key-1000"), []byte("value-1000")))
+	assert.Nil(t, txn.Delete([]byte("key-101")))
+	iter := txn.NewIterator(IteratorOptions{Prefix: []byte("key-10")})
+	keys = nil
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	txn.Rollback()
+	assert.Equal(t, []string{"key-100", "key-1000", "key-102", "key-103", "key-104",
+		"key-105", "key-106", "key-107", "key-108", "key-109"}, keys)
+}
+
+// B+ 树索引中的数据无法解密时 Open 返回错误
+func TestDB_Encryption_BPTreeIndexError(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.EncryptionKeys = &StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: []byte("0123456789abcdef0123456789abcdef")},
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 破坏索引文件中加密的位置索引
+	tree, err := bbolt.Open(filepath.Join(dir, index.BPTreeIndexFileName), 0644, nil)
+	assert.Nil(t, err)
+	err = tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("bitcask-index"))
+		var keys [][]byte
+		_ = bucket.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		for _, k := range keys {
+			if err := bucket.Put(k, []byte{1, 0, 0, 0}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Close())
+
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidEncryptionKey, err)
+}
+
+func TestDB_Encryption_KeyRotation(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-rotation")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	provider := &StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: []byte("0123456789abcdef")},
+	}
+	opts.EncryptionKeys = provider
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 轮换 key 之后新写入的数据使用新的 key，旧的数据仍然可以读取
+	provider.CurrentId = 2
+	provider.Keys[2] = []byte("fedcba9876543210fedcba9876543210")
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 1000; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	val, err := db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(0), val)
+
+	// merge 用新的 key 重新加密旧数据，之后不再需要旧的 key
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	delete(provider.Keys, 1)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(db.ListKeys()))
+	for _, i := range []int{0, 999, 1000, 1999} {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
@@ -13,4 +13,19 @@ var (
 	ErrMergeInProgress			= errors.New("merge is in progress, try again later")
 	ErrMergeRatioUnreached		= errors.New("the merge ratio do not reach the option")
 	ErrNoEnoughSpaceForMerge	= errors.New("no enough disk space for merge")
+	ErrDatabaseIsUsing			= errors.New("the database directory is used by another process")
+	ErrSnapshotReleased			= errors.New("the snapshot has been released")
+	ErrTxnConflict				= errors.New("transaction conflicts with a concurrent write, try again")
+	ErrTxnClosed				= errors.New("the transaction has been committed or rolled back")
+	ErrBackupInProgress			= errors.New("backup is in progress, try again later")
+	ErrBackupDirNotEmpty		= errors.New("the backup directory is not empty")
+	ErrBackupChainBroken		= errors.New("the backup does not continue the previous one")
+	ErrChangesCompacted			= errors.New("the changes have been compacted by merge, resubscribe from the beginning")
+	ErrReadOnlyReplica			= errors.New("the database is a read-only replica")
+	ErrReplicaDiverged			= errors.New("the data received from the primary does not match the replica")
+	ErrShardNumMismatch			= errors.New("the shard number does not match the existing sharded database")
+	ErrBatchSpansShards			= errors.New("the write batch contains keys from more than one shard")
+	ErrBlobNotReplicated		= errors.New("values stored in blob files can not be replicated")
+	ErrResyncPending			= errors.New("the replica must be reopened to finish the full resync")
+	ErrMergeFilesOverflow		= errors.New("the merged data needs more data files than it replaces, use a larger DataFileSize")
 )
\ No newline at end of file
@@ -0,0 +1,19 @@
+package aperturekv
+
+import "github.com/minimAluminiumalism/ApertureKV/fio"
+
+// 数据文件很小、数量很多时，全部打开会超过进程的文件描述符上限
+// 配置了 MaxOpenFiles 时，数据目录中的数据文件和 blob 文件通过文件描述符池按需打开，长时间没有读取的文件会被关闭
+
+// limit 为 0 时不限制，返回 nil
+func newFDPool(limit int) *fio.FDPool {
+	if limit <= 0 {
+		return nil
+	}
+	return fio.NewFDPool(limit)
+}
+
+// 只有数据目录中使用标准文件 IO 的文件放到文件描述符池中，merge 目录中的文件会被移动，不能重新打开
+func (db *DB) usePooledIO(dirPath string, ioType fio.FileIOType) bool {
+	return db.fdPool != nil && ioType == fio.StandardFIO && dirPath == db.options.DirPath
+}
@@ -0,0 +1,69 @@
+package aperturekv
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_MaxOpenFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-open-files")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.MaxOpenFiles = 4
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.True(t, db.Stat().DataFileNum > 20)
+
+	// 并发读取所有的数据文件，打开的文件数量不超过上限
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 2000; i += 8 {
+				_, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.True(t, db.fdPool.OpenFiles() <= opts.MaxOpenFiles)
+
+	// 快照仍然可以读取被 merge 替换掉的数据文件
+	snap := db.Snapshot()
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 2000; i += 100 {
+		_, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap.Release()
+	for i := 1000; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 重启之后启动时用 mmap 加载，之后切换到文件描述符池
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, db.fdPool.OpenFiles() <= opts.MaxOpenFiles)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 1000; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,193 @@
+package fio
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// FDPool 限制同时打开的文件描述符数量，超过上限时关闭最近最少使用的空闲文件，之后再使用时重新打开
+// 正在读写、写入之后还没有 sync 以及被 Pin 的文件不会被关闭，这时打开的文件数量可以暂时超过上限
+type FDPool struct {
+	lock	sync.Mutex
+	limit	int
+	open	int			// 当前打开的文件数量
+	idle	*list.List	// 可以被关闭的文件，最近使用的在前面
+}
+
+// PooledFile 通过 FDPool 打开的文件，实现了 IOManager
+type PooledFile struct {
+	pool		*FDPool
+	fileName	string
+	fd			*os.File		// 没有打开时为 nil
+	refs		int				// 正在使用文件描述符的操作数量
+	writes		uint64			// 写入的次数
+	syncedWrites	uint64		// sync 之前的写入次数，小于 writes 时有写入还没有 sync，重新打开之后无法得知之前写入的错误
+	pinned		bool
+	closed		bool
+	elem		*list.Element	// 在 idle 中的位置
+}
+
+func NewFDPool(limit int) *FDPool {
+	return &FDPool{limit: limit, idle: list.New()}
+}
+
+// 打开文件，文件不存在时创建
+func (p *FDPool) Open(fileName string) (*PooledFile, error) {
+	f := &PooledFile{pool: p, fileName: fileName}
+	if _, err := f.acquire(); err != nil {
+		return nil, err
+	}
+	f.release()
+	return f, nil
+}
+
+// 当前打开的文件数量
+func (p *FDPool) OpenFiles() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.open
+}
+
+// 关闭空闲的文件直到不超过上限，调用方需要持有锁
+func (p *FDPool) evict() {
+	for p.open > p.limit && p.idle.Len() > 0 {
+		f := p.idle.Remove(p.idle.Back()).(*PooledFile)
+		f.elem = nil
+		_ = f.fd.Close()
+		f.fd = nil
+		p.open--
+	}
+}
+
+// 获取文件描述符，使用完之后需要调用 release
+func (f *PooledFile) acquire() (*os.File, error) {
+	p := f.pool
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	if f.fd == nil {
+		fd, err := os.OpenFile(f.fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, DateFilePerm)
+		if err != nil {
+			return nil, err
+		}
+		f.fd = fd
+		p.open++
+		p.evict()
+	}
+	if f.elem != nil {
+		p.idle.Remove(f.elem)
+		f.elem = nil
+	}
+	f.refs++
+	return f.fd, nil
+}
+
+func (f *PooledFile) release() {
+	p := f.pool
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f.refs--
+	f.markIdle()
+}
+
+// 文件不再被使用时放到 idle 中，调用方需要持有锁
+func (f *PooledFile) markIdle() {
+	p := f.pool
+	if f.closed || f.fd == nil || f.refs > 0 || f.writes != f.syncedWrites || f.pinned || f.elem != nil {
+		return
+	}
+	f.elem = p.idle.PushFront(f)
+	p.evict()
+}
+
+// Pin 打开文件并且不再关闭，直到调用 Close
+// 文件在磁盘上被删除或者替换之前需要 Pin，之后仍然可以通过打开的文件描述符读取
+func (f *PooledFile) Pin() error {
+	if _, err := f.acquire(); err != nil {
+		return err
+	}
+	f.pool.lock.Lock()
+	f.pinned = true
+	f.pool.lock.Unlock()
+	f.release()
+	return nil
+}
+
+func (f *PooledFile) Read(b []byte, offset int64) (int, error) {
+	fd, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer f.release()
+	return fd.ReadAt(b, offset)
+}
+
+func (f *PooledFile) Write(b []byte) (int, error) {
+	fd, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer f.release()
+	f.pool.lock.Lock()
+	f.writes++
+	f.pool.lock.Unlock()
+	return fd.Write(b)
+}
+
+func (f *PooledFile) Sync() error {
+	fd, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer f.release()
+	// sync 期间新的写入不一定被持久化了
+	f.pool.lock.Lock()
+	writes := f.writes
+	f.pool.lock.Unlock()
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	f.pool.lock.Lock()
+	if writes > f.syncedWrites {
+		f.syncedWrites = writes
+	}
+	f.pool.lock.Unlock()
+	return nil
+}
+
+func (f *PooledFile) Close() error {
+	p := f.pool
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.elem != nil {
+		p.idle.Remove(f.elem)
+		f.elem = nil
+	}
+	if f.fd == nil {
+		return nil
+	}
+	err := f.fd.Close()
+	f.fd = nil
+	p.open--
+	return err
+}
+
+func (f *PooledFile) Size() (int64, error) {
+	fd, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer f.release()
+	stat, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
@@ -0,0 +1,73 @@
+package fio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFDPool(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "fd-pool")
+	defer destroyFile(dir)
+	pool := NewFDPool(2)
+
+	var files []*PooledFile
+	for i := 0; i < 5; i++ {
+		f, err := pool.Open(filepath.Join(dir, fmt.Sprintf("%d.data", i)))
+		assert.Nil(t, err)
+		files = append(files, f)
+		_, err = f.Write([]byte(fmt.Sprintf("file-%d", i)))
+		assert.Nil(t, err)
+	}
+	// 还没有 sync 的文件不会被关闭
+	assert.Equal(t, 5, pool.OpenFiles())
+	for _, f := range files {
+		assert.Nil(t, f.Sync())
+	}
+	assert.Equal(t, 2, pool.OpenFiles())
+
+	// 被关闭的文件读取时重新打开
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				f := files[i%len(files)]
+				b := make([]byte, 6)
+				n, err := f.Read(b, 0)
+				assert.Nil(t, err)
+				assert.Equal(t, 6, n)
+				assert.Equal(t, []byte(fmt.Sprintf("file-%d", i%len(files))), b)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, pool.OpenFiles())
+	size, err := files[0].Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), size)
+
+	// Pin 之后文件在磁盘上被删除也可以读取
+	assert.Nil(t, files[1].Pin())
+	assert.Nil(t, os.Remove(filepath.Join(dir, "1.data")))
+	for _, f := range files {
+		_, err := f.Size()
+		assert.Nil(t, err)
+	}
+	b := make([]byte, 6)
+	_, err = files[1].Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("file-1"), b)
+
+	for _, f := range files {
+		assert.Nil(t, f.Close())
+	}
+	assert.Equal(t, 0, pool.OpenFiles())
+	_, err = files[0].Read(b, 0)
+	assert.Equal(t, os.ErrClosed, err)
+}
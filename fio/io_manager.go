@@ -32,6 +32,8 @@ func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
 	switch ioType {
 	case StandardFIO:
 		return NewFileIOManager(fileName)
+	case MemoryMap:
+		return NewMMapIOManager(fileName)
 	default:
 		panic("unsupported io type")
 	}
@@ -0,0 +1,74 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+var ErrMMapReadOnly = errors.New("memory mapped file is read only")
+
+// MMap 内存文件映射，只用于读取数据（例如启动时加载索引）
+type MMap struct {
+	data	[]byte	// 映射到内存中的文件内容
+}
+
+func NewMMapIOManager(fileName string) (*MMap, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDONLY, DateFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	// 映射完成之后就不再需要文件描述符了
+	defer fd.Close()
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// 空文件不能映射
+	if stat.Size() == 0 {
+		return &MMap{}, nil
+	}
+	data, err := syscall.Mmap(int(fd.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &MMap{data: data}, nil
+}
+
+func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if offset < 0 || offset >= int64(len(mmap.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mmap.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mmap *MMap) Write([]byte) (int, error) {
+	return 0, ErrMMapReadOnly
+}
+
+// 只读映射，没有需要持久化的数据
+func (mmap *MMap) Sync() error {
+	return nil
+}
+
+func (mmap *MMap) Close() error {
+	if mmap.data == nil {
+		return nil
+	}
+	data := mmap.data
+	mmap.data = nil
+	return syscall.Munmap(data)
+}
+
+func (mmap *MMap) Size() (int64, error) {
+	return int64(len(mmap.data)), nil
+}
@@ -0,0 +1,66 @@
+package fio
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMMap_Read(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-a.data")
+	defer destroyFile(path)
+
+	// 空文件
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+	b1 := make([]byte, 10)
+	n1, err := mmapIO.Read(b1, 0)
+	assert.Equal(t, 0, n1)
+	assert.Equal(t, io.EOF, err)
+	err = mmapIO.Close()
+	assert.Nil(t, err)
+
+	// 有数据的文件
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("aa"))
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("bb"))
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("cc"))
+	assert.Nil(t, err)
+
+	mmapIO2, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+	defer mmapIO2.Close()
+	size, err := mmapIO2.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), size)
+
+	b2 := make([]byte, 2)
+	n2, err := mmapIO2.Read(b2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n2)
+	assert.Equal(t, []byte("bb"), b2)
+
+	// 读取超过文件末尾
+	b3 := make([]byte, 4)
+	n3, err := mmapIO2.Read(b3, 4)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, n3)
+	assert.Equal(t, []byte("cc"), b3[:n3])
+}
+
+func TestMMap_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-b.data")
+	defer destroyFile(path)
+
+	mmapIO, err := NewIOManager(path, MemoryMap)
+	assert.Nil(t, err)
+	defer mmapIO.Close()
+
+	_, err = mmapIO.Write([]byte("aa"))
+	assert.Equal(t, ErrMMapReadOnly, err)
+}
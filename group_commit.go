@@ -0,0 +1,293 @@
+package aperturekv
+
+import (
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+)
+
+// 需要持久化的写入在锁内追加到活跃文件之后释放锁，再等待写到的位置被 sync
+// 同一时间只有一个写入方执行 sync，其他写入方等待它完成，一次 sync 可以覆盖所有在它之前追加的数据
+// 持久化的时机由配置项决定：SyncWrites 每次写入都 sync，BytesPerSync 累计写入一定的数据量之后 sync，
+// SyncInterval 由后台定时 sync，都没有设置时只在切换活跃文件时 sync
+// 等待 sync 的写入在 sync 之前已经更新了索引，sync 失败时按写入的逆序回滚它们对索引的修改
+
+// 等待 sync 的写入对索引的一次修改
+type indexUndo struct {
+	key		[]byte
+	pos		*data.LogRecordPos	// 写入之后的位置，删除时为 nil
+	oldPos	*data.LogRecordPos	// 写入之前的位置，key 原来不存在时为 nil
+	seq		uint64				// 这次写入的数据在日志中的结束位置
+}
+
+// 当前写到的位置，调用方需要持有数据库的锁
+func (db *DB) syncPosition() uint64 {
+	if db.activeFile == nil {
+		return 0
+	}
+	return changeSeq(db.activeFile.FileId, db.activeFile.WriteOff)
+}
+
+// 活跃文件中已经持久化的位置，调用方需要持有数据库的锁
+func (db *DB) syncedOffset() int64 {
+	db.syncMu.Lock()
+	fid, offset := parseChangeSeq(db.syncedSeq)
+	db.syncMu.Unlock()
+	if db.activeFile == nil || fid != db.activeFile.FileId {
+		return 0
+	}
+	return offset
+}
+
+// 写入完成之后释放数据库的锁，需要持久化时等待写入的数据被 sync
+func (db *DB) unlockAndSync(syncWrites bool) error {
+	seq := db.syncPosition()
+	if db.options.BytesPerSync > 0 && db.unsyncedBytes >= db.options.BytesPerSync {
+		syncWrites = true
+	}
+	undo := db.pendingUndo
+	db.pendingUndo = nil
+	if syncWrites {
+		for _, u := range undo {
+			u.seq = seq
+		}
+		db.unsyncedUndo = append(db.unsyncedUndo, undo...)
+	}
+	db.mu.Unlock()
+	if !syncWrites {
+		return nil
+	}
+	if err := db.waitForSync(seq); err != nil {
+		// sync 失败之后才写入的数据没有被 failSync 回滚
+		db.mu.Lock()
+		db.rollbackUnsynced()
+		db.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// 记录写入对索引的修改，写入需要等待 sync 时在 unlockAndSync 中保留下来，调用方需要持有数据库的锁
+func (db *DB) recordUndo(key []byte, pos, oldPos *data.LogRecordPos) {
+	db.pendingUndo = append(db.pendingUndo, &indexUndo{key: key, pos: pos, oldPos: oldPos})
+}
+
+// 删除已经持久化的写入的回滚记录，调用方需要持有数据库的锁
+func (db *DB) trimUndo(seq uint64) {
+	n := 0
+	for n < len(db.unsyncedUndo) && db.unsyncedUndo[n].seq <= seq {
+		n++
+	}
+	if n == len(db.unsyncedUndo) {
+		db.unsyncedUndo = nil
+		return
+	}
+	db.unsyncedUndo = db.unsyncedUndo[n:]
+}
+
+// 按写入的逆序回滚还没有 sync 的写入对索引的修改，调用方需要持有数据库的锁
+func (db *DB) rollbackUnsynced() {
+	for i := len(db.unsyncedUndo) - 1; i >= 0; i-- {
+		db.undo(db.unsyncedUndo[i])
+	}
+	db.unsyncedUndo = nil
+}
+
+// 索引已经被之后不需要等待 sync 的写入修改过时不再回滚，调用方需要持有数据库的锁
+func (db *DB) undo(u *indexUndo) {
+	if !samePosition(db.index.Get(u.key), u.pos) {
+		return
+	}
+	if u.pos != nil {
+		// 写入的数据不会生效，成为无效数据
+		db.addReclaimSize(u.pos)
+	}
+	if u.oldPos == nil {
+		if u.pos != nil {
+			db.index.Delete(u.key)
+		}
+		db.setExpire(u.key, 0)
+		return
+	}
+	db.index.Put(u.key, u.oldPos)
+	db.subReclaimSize(u.oldPos)
+	db.addToBloomFilter(u.key)
+	db.setExpire(u.key, u.oldPos.Expire)
+}
+
+func samePosition(a, b *data.LogRecordPos) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Fid == b.Fid && a.Offset == b.Offset
+}
+
+// sync 失败之后无法确定之前写入的数据是否持久化了，之后再 sync 成功也不能说明这些数据已经持久化，
+// 所以错误会一直保留，等待 sync 的写入都会失败并回滚，需要重新打开数据库。调用方需要持有数据库的锁
+func (db *DB) failSync(err error) {
+	db.syncMu.Lock()
+	if db.syncErr == nil {
+		db.syncErr = err
+	}
+	db.syncCond.Broadcast()
+	db.syncMu.Unlock()
+	db.rollbackUnsynced()
+}
+
+// 在锁内持久化已经写入的数据，调用方需要持有数据库的锁
+// 切换活跃文件、merge 和 blob 回收替换文件之前调用，之后等待 sync 的写入不会再回滚到被替换的文件中
+func (db *DB) syncWithLock() error {
+	db.syncMu.Lock()
+	err := db.syncErr
+	db.syncMu.Unlock()
+	if err != nil {
+		return err
+	}
+	seq := db.syncPosition()
+	if err := db.syncBlobAndActiveFile(); err != nil {
+		db.failSync(err)
+		return err
+	}
+	db.markSynced(db.unsyncedBytes, time.Now())
+	db.trimUndo(seq)
+	db.syncMu.Lock()
+	if seq > db.syncedSeq {
+		db.syncedSeq = seq
+	}
+	db.syncCond.Broadcast()
+	db.syncMu.Unlock()
+	return nil
+}
+
+// 等待 seq 之前的数据持久化，调用方不能持有数据库的锁
+func (db *DB) waitForSync(seq uint64) error {
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+	for db.syncedSeq < seq {
+		if db.syncErr != nil {
+			return db.syncErr
+		}
+		if db.syncing {
+			db.syncCond.Wait()
+			continue
+		}
+		db.syncing = true
+		db.syncMu.Unlock()
+		synced, err := db.syncActiveFile()
+		db.syncMu.Lock()
+		db.syncing = false
+		if synced > db.syncedSeq {
+			db.syncedSeq = synced
+		}
+		db.syncCond.Broadcast()
+		// 等待的写入方拿到 failSync 保留的错误
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync 当前的活跃文件，返回 sync 之后已经持久化的位置
+// 切换活跃文件时旧的活跃文件已经 sync 过了，所以只需要 sync 当前的活跃文件
+func (db *DB) syncActiveFile() (uint64, error) {
+	db.mu.Lock()
+	dataFile := db.activeFile
+	if dataFile == nil {
+		db.mu.Unlock()
+		return 0, nil
+	}
+	seq := db.syncPosition()
+	bytes, syncTime := db.unsyncedBytes, time.Now()
+	// sync 期间数据文件可能被 merge 替换，blob 文件可能被回收，不能被关闭
+	blobFile := db.activeBlobFile
+	db.syncingFile, db.syncingBlobFile = dataFile, blobFile
+	db.mu.Unlock()
+
+	// 数据文件引用的 blob 需要先持久化
+	var err error
+	if blobFile != nil {
+		err = blobFile.Sync()
+	}
+	if err == nil {
+		err = dataFile.Sync()
+	}
+
+	db.mu.Lock()
+	db.syncingFile, db.syncingBlobFile = nil, nil
+	db.closeRetiredFiles()
+	if err == nil {
+		db.markSynced(bytes, syncTime)
+		db.trimUndo(seq)
+	} else {
+		db.failSync(err)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// 记录新写入还没有 sync 的数据，调用方需要持有数据库的锁
+func (db *DB) addUnsyncedBytes(size int64) {
+	if db.unsyncedBytes == 0 {
+		db.unsyncedSince = time.Now()
+	}
+	db.unsyncedBytes += size
+}
+
+// 在 syncTime 开始的 sync 持久化了 bytes 的数据，调用方需要持有数据库的锁
+func (db *DB) markSynced(bytes int64, syncTime time.Time) {
+	db.unsyncedBytes -= bytes
+	if db.unsyncedBytes <= 0 {
+		db.unsyncedBytes = 0
+		db.unsyncedSince = time.Time{}
+		return
+	}
+	// 剩下的数据都是在 sync 开始之后写入的
+	if db.unsyncedSince.Before(syncTime) {
+		db.unsyncedSince = syncTime
+	}
+}
+
+// 启动后台定时 sync
+func (db *DB) startSyncTicker() {
+	if db.options.SyncInterval <= 0 {
+		return
+	}
+	db.syncCloseCh = make(chan struct{})
+	db.syncWg.Add(1)
+	go db.syncTicker(db.syncCloseCh)
+}
+
+func (db *DB) stopSyncTicker() {
+	if db.syncCloseCh == nil {
+		return
+	}
+	close(db.syncCloseCh)
+	db.syncCloseCh = nil
+	db.syncWg.Wait()
+}
+
+// 每隔 SyncInterval 持久化一次新写入的数据，崩溃时最多丢失一个间隔内的写入
+func (db *DB) syncTicker(closeCh chan struct{}) {
+	defer db.syncWg.Done()
+
+	ticker := time.NewTicker(db.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.mu.RLock()
+			seq, unsynced := db.syncPosition(), db.unsyncedBytes
+			db.mu.RUnlock()
+			if unsynced > 0 {
+				// 失败之后写入方在 sync 时也会拿到同样的错误
+				_ = db.waitForSync(seq)
+			}
+		case <-closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package aperturekv
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/fio"
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 并发的 Put/Delete/WriteBatch 都在数据持久化之后返回
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := utils.GetTestKey(w*1000 + i)
+				assert.Nil(t, db.Put(key, key))
+				if i%10 == 0 {
+					assert.Nil(t, db.Delete(key))
+				}
+			}
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			_ = wb.Put(utils.GetTestKey(w*1000+500), []byte("batch"))
+			assert.Nil(t, wb.Commit())
+		}(w)
+	}
+	wg.Wait()
+
+	// 返回之前所有写入的位置都已经 sync 过了
+	db.mu.RLock()
+	end := db.syncPosition()
+	db.mu.RUnlock()
+	db.syncMu.Lock()
+	assert.Equal(t, end, db.syncedSeq)
+	db.syncMu.Unlock()
+	assert.Equal(t, 16*91, len(db.ListKeys()))
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 16*91, len(db.ListKeys()))
+	val, err := db.Get(utils.GetTestKey(15500))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), val)
+}
+
+func TestDB_SyncPolicy(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sync-policy")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 不持久化时所有的写入都在丢失窗口中，直到手动 Sync
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(100)))
+	}
+	stat := db.Stat()
+	assert.True(t, stat.UnsyncedBytes > 100*100)
+	assert.False(t, stat.UnsyncedSince.IsZero())
+	assert.Nil(t, db.Sync())
+	stat = db.Stat()
+	assert.Equal(t, int64(0), stat.UnsyncedBytes)
+	assert.True(t, stat.UnsyncedSince.IsZero())
+	assert.Nil(t, db.Close())
+
+	// 累计写入 BytesPerSync 之后持久化
+	opts.BytesPerSync = 4 * 1024
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(100)))
+		assert.True(t, db.Stat().UnsyncedBytes < opts.BytesPerSync)
+	}
+	assert.Nil(t, db.Close())
+
+	// 后台定时持久化
+	opts.BytesPerSync = 0
+	opts.SyncInterval = time.Millisecond * 20
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(100)))
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for db.Stat().UnsyncedBytes > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	stat = db.Stat()
+	assert.Equal(t, int64(0), stat.UnsyncedBytes)
+	assert.True(t, stat.UnsyncedSince.IsZero())
+}
+
+var errSyncFailed = errors.New("sync failed")
+
+// sync 总是失败的文件
+type failingSyncIO struct {
+	fio.IOManager
+}
+
+func (f *failingSyncIO) Sync() error {
+	return errSyncFailed
+}
+
+func TestDB_GroupCommit_SyncFailed(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit-failed")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("v1")))
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("v2")))
+	ioManager := db.activeFile.IoManager
+	db.activeFile.IoManager = &failingSyncIO{IOManager: ioManager}
+
+	// sync 失败的写入不可见
+	assert.Equal(t, errSyncFailed, db.Put(utils.GetTestKey(1), []byte("new")))
+	assert.Equal(t, errSyncFailed, db.Put(utils.GetTestKey(3), []byte("v3")))
+	assert.Equal(t, errSyncFailed, db.Delete(utils.GetTestKey(2)))
+	assert.Equal(t, errSyncFailed, db.Expire(utils.GetTestKey(2), time.Millisecond))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(4), []byte("v4"))
+	_ = wb.Delete(utils.GetTestKey(1))
+	assert.Equal(t, errSyncFailed, wb.Commit())
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	time.Sleep(2 * time.Millisecond)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+	assert.Equal(t, 0, len(db.unsyncedUndo))
+
+	// 之后即使 sync 成功也不能说明之前的数据已经持久化了
+	db.activeFile.IoManager = ioManager
+	assert.Equal(t, errSyncFailed, db.Sync())
+	assert.Equal(t, errSyncFailed, db.Put(utils.GetTestKey(5), []byte("v5")))
+	_, err = db.Get(utils.GetTestKey(5))
+	assert.Equal(t, ErrKeyNotFound, err)
+	destroyDB(db)
+}
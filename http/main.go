@@ -2,25 +2,58 @@ package http
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	aperture "github.com/minimAluminiumalism/ApertureKV"
+	"github.com/minimAluminiumalism/ApertureKV/cluster"
 )
 
-var db *aperture.DB
+// 单机模式下是 *aperture.DB，集群模式下是 *cluster.Node，写入经过 raft 日志并由 follower 转发给 leader
+type store interface {
+	Put(key []byte, value []byte) error
+	Get(key []byte) ([]byte, error)
+	Delete(key []byte) error
+	ListKeys() [][]byte
+	Stat() *aperture.Stat
+}
+
+var db store
 
 func init() {
-	var err error
 	options := aperture.DefaultOptions
 	dir, _ := os.MkdirTemp("", "aperture-http")
 	options.DirPath = dir
-	db, err = aperture.Open(options)
+	standalone, err := aperture.Open(options)
 	if err != nil {
 		panic(fmt.Sprintf("failed to open db: %v", err))
 	}
+	db = standalone
+}
+
+// 切换到集群模式
+func startClusterNode(dir, raftAddr, peers string) error {
+	cfg := cluster.DefaultConfig
+	cfg.Dir = dir
+	cfg.RaftAddr = raftAddr
+	node, err := cluster.NewNode(cfg)
+	if err != nil {
+		return err
+	}
+	var peerAddrs []string
+	if peers != "" {
+		peerAddrs = strings.Split(peers, ",")
+	}
+	node.Start(peerAddrs)
+	if standalone, ok := db.(*aperture.DB); ok {
+		_ = standalone.Close()
+	}
+	db = node
+	return nil
 }
 
 
@@ -112,6 +145,16 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
 
 
 func main() {
+	clusterDir := flag.String("cluster-dir", "", "data directory of the cluster node, empty to run standalone")
+	raftAddr := flag.String("raft", "127.0.0.1:7080", "raft address of the cluster node")
+	peers := flag.String("peers", "", "comma separated raft addresses of the other cluster nodes")
+	flag.Parse()
+	if *clusterDir != "" {
+		if err := startClusterNode(*clusterDir, *raftAddr, *peers); err != nil {
+			log.Fatalf("failed to start cluster node: %v", err)
+		}
+	}
+
 	http.HandleFunc("/aperture/put", handlePut)
 	http.HandleFunc("/aperture/get", handleGet)
 	http.HandleFunc("/aperture/delete", handleDelete)
@@ -10,26 +10,30 @@ import (
 )
 
 type AdaptiveRadixTree struct {
-	tree	goart.Tree
-	lock	*sync.RWMutex
+	tree		goart.Tree
+	lock		*sync.RWMutex
+	snapshots	map[*artSnapshot]struct{}	// 打开的快照，修改 key 时保存旧的位置
 }
 
 
 func NewART() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: goart.New(),
-		lock: new(sync.RWMutex),
+		tree:		goart.New(),
+		lock:		new(sync.RWMutex),
+		snapshots:	make(map[*artSnapshot]struct{}),
 	}
 }
 
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	art.lock.Lock()
 	oldValue, _ := art.tree.Insert(key, pos)
-	art.lock.Unlock()
-	if oldValue == nil {
-		return nil
+	var oldPos *data.LogRecordPos
+	if oldValue != nil {
+		oldPos = oldValue.(*data.LogRecordPos)
 	}
-	return oldValue.(*data.LogRecordPos)
+	art.preserve(key, oldPos)
+	art.lock.Unlock()
+	return oldPos
 }
 
 func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
@@ -44,11 +48,12 @@ func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
 
 func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
+	defer art.lock.Unlock()
 	oldValue, deleted := art.tree.Delete(key)
-	art.lock.Unlock()
 	if oldValue == nil {
 		return nil, false
 	}
+	art.preserve(key, oldValue.(*data.LogRecordPos))
 	return oldValue.(*data.LogRecordPos), deleted
 }
 
@@ -59,12 +64,78 @@ func (art *AdaptiveRadixTree) Size() int {
 	return size
 }
 
+func (art *AdaptiveRadixTree) Close() error {
+	return nil
+}
+
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
 	art.lock.RLock() // 只读迭代器
-	art.lock.RUnlock()
+	defer art.lock.RUnlock()
 	return NewARTIterator(art.tree, reverse)
 }
 
+// ART 不支持写时复制，快照只记录之后被修改的 key 原来的位置，创建快照不需要拷贝整个索引
+func (art *AdaptiveRadixTree) Snapshot() Snapshot {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	as := &artSnapshot{art: art, overlay: newSnapshotOverlay()}
+	art.snapshots[as] = struct{}{}
+	return as
+}
+
+// 修改 key 之前的位置保存到所有的快照中，调用方需要持有写锁
+func (art *AdaptiveRadixTree) preserve(key []byte, oldPos *data.LogRecordPos) {
+	for as := range art.snapshots {
+		as.overlay.preserve(key, oldPos)
+	}
+}
+
+type artSnapshot struct {
+	art		*AdaptiveRadixTree
+	overlay	*snapshotOverlay	// 由 art.lock 保护
+	closed	bool
+}
+
+func (as *artSnapshot) Get(key []byte) *data.LogRecordPos {
+	as.art.lock.RLock()
+	defer as.art.lock.RUnlock()
+	if as.closed {
+		return nil
+	}
+	if pos, ok := as.overlay.get(key); ok {
+		return pos
+	}
+	value, found := as.art.tree.Search(key)
+	if !found {
+		return nil
+	}
+	return value.(*data.LogRecordPos)
+}
+
+// 迭代器拷贝当前的所有 key，和快照中保存的旧的位置合并
+func (as *artSnapshot) Iterator(reverse bool) Iterator {
+	as.art.lock.RLock()
+	defer as.art.lock.RUnlock()
+	if as.closed {
+		return &artIterator{reverse: reverse}
+	}
+	live := NewARTIterator(as.art.tree, reverse).values
+	overlay := as.overlay.scan(nil, false, true, nil, false, reverse)
+	return &artIterator{
+		currIndex:	0,
+		reverse:	reverse,
+		values:		mergeOverlay(live, overlay, reverse),
+	}
+}
+
+func (as *artSnapshot) Close() {
+	as.art.lock.Lock()
+	defer as.art.lock.Unlock()
+	as.closed = true
+	as.overlay = nil
+	delete(as.art.snapshots, as)
+}
+
 
 type artIterator struct {
 	currIndex		int		// 当前遍历的下标
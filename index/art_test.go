@@ -67,3 +67,41 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestAdaptiveRadixTree_Snapshot(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	art.Put([]byte("bb"), &data.LogRecordPos{Fid: 1, Offset: 20})
+	snapshot := art.Snapshot()
+	defer snapshot.Close()
+
+	art.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 10})
+	art.Delete([]byte("bb"))
+	art.Put([]byte("cc"), &data.LogRecordPos{Fid: 2, Offset: 20})
+
+	assert.Equal(t, uint32(1), snapshot.Get([]byte("aa")).Fid)
+	assert.NotNil(t, snapshot.Get([]byte("bb")))
+	assert.Nil(t, snapshot.Get([]byte("cc")))
+
+	iter := snapshot.Iterator(true)
+	iter.Seek([]byte("ab"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("aa"), iter.Key())
+
+	// 多次修改之后快照中仍然是第一次修改之前的位置
+	art.Put([]byte("bb"), &data.LogRecordPos{Fid: 3, Offset: 20})
+	art.Put([]byte("aa"), &data.LogRecordPos{Fid: 3, Offset: 10})
+	assert.Equal(t, uint32(1), snapshot.Get([]byte("bb")).Fid)
+	var keys []string
+	iter = snapshot.Iterator(false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, uint32(1), iter.Value().Fid)
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"aa", "bb"}, keys)
+
+	// 快照释放之后不再保存旧的位置
+	snapshot.Close()
+	assert.Empty(t, art.snapshots)
+	assert.Nil(t, snapshot.Get([]byte("aa")))
+}
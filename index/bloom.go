@@ -0,0 +1,126 @@
+package index
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+)
+
+// 可扩容的布隆过滤器，判断 key 一定不存在时可以跳过查询磁盘上的索引
+// 写满之后追加一个容量翻倍、误判率减半的过滤器，整体的误判率不会超过 fpRate 的两倍
+// 不是并发安全的，Add 和 MayContain 需要由调用方加锁
+type BloomFilter struct {
+	seed	maphash.Seed
+	fpRate	float64
+	filters	[]*bloomFilter
+}
+
+type bloomFilter struct {
+	bits		[]uint64
+	m			uint64	// 位数组的长度
+	k			uint64	// 哈希函数的个数
+	capacity	int
+	count		int
+}
+
+func NewBloomFilter(capacity int, fpRate float64) *BloomFilter {
+	bf := &BloomFilter{seed: maphash.MakeSeed(), fpRate: fpRate}
+	bf.filters = append(bf.filters, newBloomFilter(capacity, fpRate/2))
+	return bf
+}
+
+// 容量为 n、误判率为 p 时需要 m = -n*ln(p)/ln(2)^2 位，k = m/n*ln(2) 个哈希函数
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:		make([]uint64, (m+63)/64),
+		m:			m,
+		k:			k,
+		capacity:	capacity,
+	}
+}
+
+// 用一次哈希的结果派生出 k 个位置 (h1 + i*h2) mod m
+func (bf *BloomFilter) hash(key []byte) (uint64, uint64) {
+	var h maphash.Hash
+	h.SetSeed(bf.seed)
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+	return sum, bits.RotateLeft64(sum, 32) | 1
+}
+
+func (bf *BloomFilter) Add(key []byte) {
+	last := bf.filters[len(bf.filters)-1]
+	if last.count >= last.capacity {
+		last = newBloomFilter(last.capacity*2, bf.fpRate/math.Pow(2, float64(len(bf.filters)+1)))
+		bf.filters = append(bf.filters, last)
+	}
+	h1, h2 := bf.hash(key)
+	for i := uint64(0); i < last.k; i++ {
+		idx := (h1 + i*h2) % last.m
+		last.bits[idx/64] |= 1 << (idx % 64)
+	}
+	last.count++
+}
+
+// 返回 false 时 key 一定没有被添加过，返回 true 时 key 可能被添加过
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bf.hash(key)
+	for _, f := range bf.filters {
+		if f.mayContain(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *bloomFilter) mayContain(h1, h2 uint64) bool {
+	for i := uint64(0); i < f.k; i++ {
+		idx := (h1 + i*h2) % f.m
+		if f.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 添加过的 key 的数量
+func (bf *BloomFilter) Count() int {
+	var count int
+	for _, f := range bf.filters {
+		count += f.count
+	}
+	return count
+}
+
+// 占用的内存大小(Bytes)
+func (bf *BloomFilter) MemSize() int64 {
+	var size int64
+	for _, f := range bf.filters {
+		size += int64(len(f.bits)) * 8
+	}
+	return size
+}
+
+// 根据位数组中被置位的比例估算的误判率
+func (bf *BloomFilter) EstimatedFPRate() float64 {
+	miss := 1.0
+	for _, f := range bf.filters {
+		var set int
+		for _, word := range f.bits {
+			set += bits.OnesCount64(word)
+		}
+		miss *= 1 - math.Pow(float64(set)/float64(f.m), float64(f.k))
+	}
+	return 1 - miss
+}
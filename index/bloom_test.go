@@ -0,0 +1,31 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := NewBloomFilter(1000, 0.01)
+	// 超过容量之后扩容，添加过的 key 一定能查到
+	for i := 0; i < 10000; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	assert.Equal(t, 10000, bf.Count())
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bf.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+
+	// 扩容之后整体的误判率不超过 fpRate 的两倍
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, float64(falsePositives)/10000 < 0.02)
+	assert.True(t, bf.EstimatedFPRate() > 0 && bf.EstimatedFPRate() < 0.02)
+	assert.True(t, bf.MemSize() > 0)
+}
@@ -1,86 +1,288 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"path/filepath"
+	"sync"
 
+	"github.com/google/btree"
 	"github.com/minimAluminiumalism/ApertureKV/data"
 	"go.etcd.io/bbolt"
 )
 
-const bptreeIndexFileName = "bptree-index"
+const BPTreeIndexFileName = "bptree-index"
 
 var indexBucketName = []byte("bitcask-index")
 
+var ErrIndexCorrupted = errors.New("the keys of the bptree index do not match the index file")
+
+// 迭代器每次从索引文件中读取的数据量
+const bptreeIteratorBatch = 128
+
+// 记录索引加密方式的 bucket
+var (
+	indexMetaBucketName	= []byte("bitcask-index-meta")
+	indexMetaKeyId		= []byte("key-id")
+	indexMetaCheck		= []byte("check")
+)
+
 // B+Tree 索引，封装了 go.etcd.io/bbolt 库
 type BPlusTree struct {
-	tree	*bbolt.DB
+	tree		*bbolt.DB
+	encryptor	*data.Encryptor	// 不为 nil 时 key 以 HMAC 摘要的形式存储，原始的 key 和位置索引加密之后存储
+	hashKeyId	uint32			// 计算摘要使用的 key id
+	lock		sync.RWMutex	// 修改索引时加写锁，key 集合和快照中旧的位置需要和索引文件一起修改；读取快照时加读锁
+	keys		*btree.BTree	// 加密时按原始 key 排序的所有 key，只保存在内存中，用于按 key 的顺序遍历
+	snapshots	map[*bptreeSnapshot]struct{}
+	errLock		sync.Mutex
+	err			error			// 读写索引文件时遇到的第一个错误
 }
 
 
 func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+	bptree, err := OpenBPlusTree(dirPath, syncWrites, nil)
+	if err != nil {
+		panic("failed to open bptree")
+	}
+	return bptree
+}
+
+// 打开 B+ 树索引，encryptor 不为 nil 时索引文件中不保存明文的 key
+// key 的摘要只能用同一个 key 计算，所以加密方式变化（开启、关闭加密或者轮换了 key）时清空索引，
+// 打开数据库时会从数据文件中重建索引
+// 摘要没有 key 的顺序，加密时打开索引需要解密所有的 key，在内存中按 key 排序，内存占用和 key 的总大小相当
+func OpenBPlusTree(dirPath string, syncWrites bool, encryptor *data.Encryptor) (*BPlusTree, error) {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
-	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	tree, err := bbolt.Open(filepath.Join(dirPath, BPTreeIndexFileName), 0644, opts)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, err
+	}
+
+	bpt := &BPlusTree{tree: tree, encryptor: encryptor, snapshots: make(map[*bptreeSnapshot]struct{})}
+	if encryptor != nil {
+		bpt.hashKeyId = encryptor.CurrentKeyId()
+	}
+	if err := tree.Update(bpt.init); err != nil {	// 事务保证
+		_ = tree.Close()
+		return nil, err
 	}
+	if encryptor != nil {
+		bpt.keys = btree.New(32)
+		if err := tree.View(bpt.loadKeys); err != nil {
+			_ = tree.Close()
+			return nil, err
+		}
+	}
+	return bpt, nil
+}
+
+// 解密索引文件中所有的 key
+func (bpt *BPlusTree) loadKeys(tx *bbolt.Tx) error {
+	return tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+		key, _, err := bpt.decodeValue(k, v)
+		if err != nil {
+			return err
+		}
+		bpt.keys.ReplaceOrInsert(&Item{key: copyKey(key)})
+		return nil
+	})
+}
 
-	// Create corresponding bucket
-	if err := bptree.Update(func(tx *bbolt.Tx) error {	// 事务保证
+// 创建索引的 bucket，检查索引的加密方式和 key
+func (bpt *BPlusTree) init(tx *bbolt.Tx) error {
+	var keyId uint32
+	meta := tx.Bucket(indexMetaBucketName)
+	if meta != nil {
+		id, _ := binary.Uvarint(meta.Get(indexMetaKeyId))
+		keyId = uint32(id)
+	}
+	if keyId == bpt.hashKeyId {
+		if keyId != 0 {
+			// 解密失败说明 key 不对
+			if _, err := bpt.encryptor.Decrypt(meta.Get(indexMetaCheck), indexMetaCheck); err != nil {
+				return err
+			}
+		}
 		_, err := tx.CreateBucketIfNotExists(indexBucketName)
 		return err
-	}); err != nil {
-		panic("failed to create bucket in bptree")
 	}
-	return &BPlusTree{tree: bptree}
+
+	for _, name := range [][]byte{indexBucketName, indexMetaBucketName} {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.CreateBucket(indexBucketName); err != nil {
+		return err
+	}
+	if bpt.hashKeyId == 0 {
+		return nil
+	}
+	meta, err := tx.CreateBucket(indexMetaBucketName)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen32)
+	n := binary.PutUvarint(buf, uint64(bpt.hashKeyId))
+	if err := meta.Put(indexMetaKeyId, buf[:n]); err != nil {
+		return err
+	}
+	check, err := bpt.encryptor.Encrypt(indexMetaCheck, indexMetaCheck)
+	if err != nil {
+		return err
+	}
+	return meta.Put(indexMetaCheck, check)
 }
 
+// 索引文件中实际存储的 key
+func (bpt *BPlusTree) treeKey(key []byte) ([]byte, error) {
+	if bpt.encryptor == nil {
+		return key, nil
+	}
+	return bpt.encryptor.Hash(bpt.hashKeyId, key)
+}
+
+// 加密时原始的 key 和位置索引一起加密存储
+// 和摘要使用同一个 key 加密，打开索引时检查过这个 key，之后轮换 key 不会影响索引的读写
+func (bpt *BPlusTree) encodeValue(treeKey, key []byte, pos *data.LogRecordPos) ([]byte, error) {
+	if bpt.encryptor == nil {
+		return data.EncodeLogRecordPos(pos), nil
+	}
+	buf := make([]byte, binary.MaxVarintLen32+len(key))
+	n := binary.PutUvarint(buf, uint64(len(key)))
+	copy(buf[n:], key)
+	buf = append(buf[:n+len(key)], data.EncodeLogRecordPos(pos)...)
+	return bpt.encryptor.EncryptWithKey(bpt.hashKeyId, buf, treeKey)
+}
+
+// 解码索引文件中存储的 value，返回原始的 key 和位置索引
+// 没有加密时返回的 key 就是 treeKey，只在 bbolt 的事务内有效
+func (bpt *BPlusTree) decodeValue(treeKey, value []byte) ([]byte, *data.LogRecordPos, error) {
+	if bpt.encryptor == nil {
+		return treeKey, data.DecodeLogRecordPos(value), nil
+	}
+	buf, err := bpt.encryptor.Decrypt(value, treeKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keySize, n := binary.Uvarint(buf)
+	if n <= 0 || n+int(keySize) > len(buf) {
+		return nil, nil, data.ErrInvalidEncryptionKey
+	}
+	return buf[n : n+int(keySize)], data.DecodeLogRecordPos(buf[n+int(keySize):]), nil
+}
+
+// 记录读写索引文件时遇到的第一个错误
+func (bpt *BPlusTree) setErr(err error) {
+	bpt.errLock.Lock()
+	defer bpt.errLock.Unlock()
+	if bpt.err == nil {
+		bpt.err = err
+	}
+}
+
+// 读写索引文件时遇到的第一个错误，例如 key 不对导致无法解密
+// 出错之后索引可能和数据文件不一致，需要重新打开数据库从数据文件重建索引
+func (bpt *BPlusTree) Err() error {
+	bpt.errLock.Lock()
+	defer bpt.errLock.Unlock()
+	return bpt.err
+}
 
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	var oldVal []byte
+	treeKey, err := bpt.treeKey(key)
+	if err != nil {
+		bpt.setErr(err)
+		return nil
+	}
+	value, err := bpt.encodeValue(treeKey, key, pos)
+	if err != nil {
+		bpt.setErr(err)
+		return nil
+	}
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
-		oldVal = bucket.Get(key)
-		return bucket.Put(key, data.EncodeLogRecordPos(pos))
+		// 旧的 value 只在事务内有效，需要在事务内解码
+		if oldVal := bucket.Get(treeKey); len(oldVal) != 0 {
+			var err error
+			if _, oldPos, err = bpt.decodeValue(treeKey, oldVal); err != nil {
+				return err
+			}
+		}
+		return bucket.Put(treeKey, value)
 	}); err != nil {
-		panic("failed to put value in bptree")
-	}
-	if len(oldVal) == 0 {
+		bpt.setErr(err)
 		return nil
 	}
-	return data.DecodeLogRecordPos(oldVal)
+	if bpt.keys != nil && oldPos == nil {
+		bpt.keys.ReplaceOrInsert(&Item{key: copyKey(key)})
+	}
+	bpt.preserve(key, oldPos)
+	return oldPos
 }
 
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+	treeKey, err := bpt.treeKey(key)
+	if err != nil {
+		bpt.setErr(err)
+		return nil
+	}
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		value := bucket.Get(key)
-		if len(value) != 0 {
-			pos = data.DecodeLogRecordPos(value)
-		}
-		return nil
+		var err error
+		pos, err = bpt.get(tx, treeKey)
+		return err
 	}); err != nil {
-		panic("failed to get key in bptree")
+		bpt.setErr(err)
+		return nil
 	}
 	return pos
 }
 
+func (bpt *BPlusTree) get(tx *bbolt.Tx, treeKey []byte) (*data.LogRecordPos, error) {
+	value := tx.Bucket(indexBucketName).Get(treeKey)
+	if len(value) == 0 {
+		return nil, nil
+	}
+	_, pos, err := bpt.decodeValue(treeKey, value)
+	return pos, err
+}
+
 func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	var oldVal []byte
+	treeKey, err := bpt.treeKey(key)
+	if err != nil {
+		bpt.setErr(err)
+		return nil, false
+	}
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		if oldVal = bucket.Get(key); len(oldVal) != 0 {
-			return bucket.Delete(key)
+		var err error
+		if oldPos, err = bpt.get(tx, treeKey); err != nil || oldPos == nil {
+			return err
 		}
-		return nil
+		return tx.Bucket(indexBucketName).Delete(treeKey)
 	}); err != nil {
-		panic("failed to delete value in bptree")
+		bpt.setErr(err)
+		return nil, false
 	}
-	if len(oldVal) == 0 {
+	if oldPos == nil {
 		return nil, false
 	}
-	return data.DecodeLogRecordPos(oldVal), true
+	if bpt.keys != nil {
+		bpt.keys.Delete(&Item{key: key})
+	}
+	bpt.preserve(key, oldPos)
+	return oldPos, true
 }
 
 func (bpt *BPlusTree) Size() int {
@@ -90,76 +292,253 @@ func (bpt *BPlusTree) Size() int {
 		size = bucket.Stats().KeyN
 		return nil
 	}); err != nil {
-		panic("failed to get size in bptree")
+		bpt.setErr(err)
 	}
 	return size
 }
 
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
-	return newBptreeIterator(bpt.tree, reverse)
+	return newBptreeIterator(bpt.snapshot(), true, reverse)
 }
 
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
-// B+ tree iterator
-type bptreeIterator struct {
-	tx			*bbolt.Tx
-	cursor		*bbolt.Cursor
-	reverse		bool
-	currKey		[]byte
-	currValue	[]byte
+// 快照不持有 bbolt 的事务：之后被修改的 key 在修改之前把旧的位置保存到快照中，其他的 key 直接读取索引文件
+// bbolt 在索引文件变大之后需要重新 mmap，这时写入会等待所有的只读事务结束，长时间持有的事务会让持有数据库的锁的写入一直阻塞
+func (bpt *BPlusTree) Snapshot() Snapshot {
+	return bpt.snapshot()
+}
+
+func (bpt *BPlusTree) snapshot() *bptreeSnapshot {
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	bs := &bptreeSnapshot{bpt: bpt, overlay: newSnapshotOverlay()}
+	bpt.snapshots[bs] = struct{}{}
+	return bs
+}
+
+// 修改 key 之前的位置保存到所有的快照中，调用方需要持有写锁
+func (bpt *BPlusTree) preserve(key []byte, oldPos *data.LogRecordPos) {
+	for bs := range bpt.snapshots {
+		bs.overlay.preserve(key, oldPos)
+	}
+}
+
+// 从 from 开始按顺序读取最多 n 条数据，调用方需要持有锁
+func (bpt *BPlusTree) scan(from []byte, fromSet, inclusive, reverse bool, n int) ([]*Item, error) {
+	if bpt.keys != nil {
+		return bpt.scanKeys(from, fromSet, inclusive, reverse, n)
+	}
+	var items []*Item
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(indexBucketName).Cursor()
+		var k, v []byte
+		switch {
+		case !fromSet && reverse:
+			k, v = cursor.Last()
+		case !fromSet:
+			k, v = cursor.First()
+		case reverse:
+			// 定位到第一个不大于 from 的位置
+			k, v = cursor.Seek(from)
+			if k == nil {
+				k, v = cursor.Last()
+			} else if c := bytes.Compare(k, from); c > 0 || (c == 0 && !inclusive) {
+				k, v = cursor.Prev()
+			}
+		default:
+			k, v = cursor.Seek(from)
+			if k != nil && !inclusive && bytes.Equal(k, from) {
+				k, v = cursor.Next()
+			}
+		}
+		for k != nil && len(items) < n {
+			key, pos, err := bpt.decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			// 事务内的数据在事务结束之后就无效了
+			items = append(items, &Item{key: copyKey(key), pos: pos})
+			if reverse {
+				k, v = cursor.Prev()
+			} else {
+				k, v = cursor.Next()
+			}
+		}
+		return nil
+	})
+	return items, err
+}
+
+// 加密时按 key 集合的顺序读取，再从索引文件中读取位置索引
+func (bpt *BPlusTree) scanKeys(from []byte, fromSet, inclusive, reverse bool, n int) ([]*Item, error) {
+	var items []*Item
+	rangeItems(bpt.keys, from, fromSet, inclusive, reverse, func(item *Item) bool {
+		items = append(items, &Item{key: item.key})
+		return len(items) < n
+	})
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		for _, item := range items {
+			treeKey, err := bpt.treeKey(item.key)
+			if err != nil {
+				return err
+			}
+			if item.pos, err = bpt.get(tx, treeKey); err != nil {
+				return err
+			}
+			if item.pos == nil {
+				// key 集合和索引文件不一致
+				return ErrIndexCorrupted
+			}
+		}
+		return nil
+	})
+	return items, err
+}
+
+type bptreeSnapshot struct {
+	bpt		*BPlusTree
+	overlay	*snapshotOverlay	// 由 bpt.lock 保护
+	closed	bool
 }
 
-func newBptreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
-	tx, err := tree.Begin(false) // 手动开启事务，Update() 方法会自动开启
+func (bs *bptreeSnapshot) Get(key []byte) *data.LogRecordPos {
+	bs.bpt.lock.RLock()
+	defer bs.bpt.lock.RUnlock()
+	if bs.closed {
+		return nil
+	}
+	if pos, ok := bs.overlay.get(key); ok {
+		return pos
+	}
+	return bs.bpt.Get(key)
+}
+
+func (bs *bptreeSnapshot) Iterator(reverse bool) Iterator {
+	return newBptreeIterator(bs, false, reverse)
+}
+
+// 快照释放之后它上面的迭代器都会失效
+func (bs *bptreeSnapshot) Close() {
+	bs.bpt.lock.Lock()
+	defer bs.bpt.lock.Unlock()
+	bs.closed = true
+	bs.overlay = nil
+	delete(bs.bpt.snapshots, bs)
+}
+
+// 在当前时刻开启一个只读事务，之后可以把这一时刻的索引拷贝出去
+func (bpt *BPlusTree) Checkpoint() (*BPTreeCheckpoint, error) {
+	tx, err := bpt.tree.Begin(false)
 	if err != nil {
-		panic("failed to start a transaction")
+		return nil, err
 	}
+	return &BPTreeCheckpoint{tx: tx}, nil
+}
+
+// B+ 树索引在某一时刻的一致性视图
+type BPTreeCheckpoint struct {
+	tx	*bbolt.Tx
+}
+
+// 将索引写到 path 中，写完之后结束只读事务
+func (c *BPTreeCheckpoint) CopyFile(path string) error {
+	defer c.tx.Rollback()
+	return c.tx.CopyFile(path, 0644)
+}
+
+// 放弃拷贝，结束只读事务
+func (c *BPTreeCheckpoint) Close() {
+	_ = c.tx.Rollback()
+}
+
+// B+ tree iterator，每次在一个短的只读事务中读取一批数据，和快照中保存的旧的位置合并
+type bptreeIterator struct {
+	snapshot	*bptreeSnapshot
+	ownSnapshot	bool		// 关闭迭代器时是否需要释放快照
+	reverse		bool
+	items		[]*Item		// 当前这一批快照中的数据
+	currIndex	int
+	next		[]byte		// 下一批从这个 key 之后开始读取
+	more		bool		// 索引文件中还有没有读取的数据
+}
+
+func newBptreeIterator(snapshot *bptreeSnapshot, ownSnapshot bool, reverse bool) *bptreeIterator {
 	bpi := &bptreeIterator{
-		tx:		tx,
-		cursor: tx.Bucket(indexBucketName).Cursor(),
-		reverse: reverse,
+		snapshot:		snapshot,
+		ownSnapshot:	ownSnapshot,
+		reverse:		reverse,
 	}
 	bpi.Rewind()
 	return bpi
 }
 
 func (bpi *bptreeIterator) Rewind() {
-	if bpi.reverse {
-		bpi.currKey, bpi.currValue = bpi.cursor.Last()
-	} else {
-		bpi.currKey, bpi.currValue = bpi.cursor.First()
-	}
+	bpi.load(nil, false, true)
 }
 
+// 反向遍历时定位到第一个不大于 key 的位置
 func (bpi *bptreeIterator) Seek(key []byte) {
-	bpi.currKey, bpi.currValue = bpi.cursor.Seek(key)
+	bpi.load(key, true, true)
 }
 
 func (bpi *bptreeIterator) Next() {
-	if bpi.reverse {
-		bpi.currKey, bpi.currValue = bpi.cursor.Prev()
-	} else {
-		bpi.currKey, bpi.currValue = bpi.cursor.Next()
+	if !bpi.Valid() {
+		return
+	}
+	bpi.currIndex++
+	if bpi.currIndex >= len(bpi.items) && bpi.more {
+		bpi.load(bpi.next, true, false)
+	}
+}
+
+// 读取下一批数据，跳过快照之后才写入的 key
+func (bpi *bptreeIterator) load(from []byte, fromSet, inclusive bool) {
+	bs := bpi.snapshot
+	bs.bpt.lock.RLock()
+	defer bs.bpt.lock.RUnlock()
+	bpi.items, bpi.currIndex, bpi.more = nil, 0, false
+	if bs.closed {
+		return
+	}
+	for {
+		live, err := bs.bpt.scan(from, fromSet, inclusive, bpi.reverse, bptreeIteratorBatch)
+		if err != nil {
+			bs.bpt.setErr(err)
+			return
+		}
+		// 索引文件读完之后快照中剩下的 key 都需要返回
+		more := len(live) == bptreeIteratorBatch
+		var to []byte
+		if more {
+			to = live[len(live)-1].key
+		}
+		items := mergeOverlay(live, bs.overlay.scan(from, fromSet, inclusive, to, more, bpi.reverse), bpi.reverse)
+		if len(items) > 0 || !more {
+			bpi.items, bpi.next, bpi.more = items, to, more
+			return
+		}
+		from, fromSet, inclusive = to, true, false
 	}
 }
 
 func (bpi *bptreeIterator) Valid() bool {
-	return len(bpi.currKey) != 0
+	return bpi.currIndex < len(bpi.items)
 }
 
 func (bpi *bptreeIterator) Key() []byte {
-	return bpi.currKey
+	return bpi.items[bpi.currIndex].key
 }
 
 func (bpi *bptreeIterator) Value() *data.LogRecordPos {
-	return data.DecodeLogRecordPos(bpi.currValue)
+	return bpi.items[bpi.currIndex].pos
 }
 
 func (bpi *bptreeIterator) Close() {
-	_ = bpi.tx.Rollback()
+	bpi.items = nil
+	if bpi.ownSnapshot {
+		bpi.snapshot.Close()
+	}
 }
-
-
@@ -1,12 +1,16 @@
 package index
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/minimAluminiumalism/ApertureKV/data"
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
 )
 
 
@@ -109,4 +113,220 @@ func TestBPlusTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
 	}
-}
\ No newline at end of file
+}
+func TestBPlusTree_Encrypted(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-encrypted")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	provider := &data.StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32)},
+	}
+	encryptor, err := data.NewEncryptor(provider)
+	assert.Nil(t, err)
+	tree, err := OpenBPlusTree(path, false, encryptor)
+	assert.Nil(t, err)
+
+	keys := [][]byte{[]byte("caac"), []byte("bbca"), []byte("acce"), []byte("ccec")}
+	for i, key := range keys {
+		assert.Nil(t, tree.Put(key, &data.LogRecordPos{Fid: uint32(i), Offset: 999}))
+	}
+	old := tree.Put([]byte("acce"), &data.LogRecordPos{Fid: 10, Offset: 100})
+	assert.Equal(t, uint32(2), old.Fid)
+	assert.Equal(t, uint32(10), tree.Get([]byte("acce")).Fid)
+	old, ok := tree.Delete([]byte("ccec"))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(3), old.Fid)
+	assert.Equal(t, 3, tree.Size())
+
+	// 和不加密时一样按 key 的顺序遍历
+	var iterKeys []string
+	iter := tree.Iterator(false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		iterKeys = append(iterKeys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"acce", "bbca", "caac"}, iterKeys)
+	iterKeys = nil
+	for iter.Seek([]byte("bbca")); iter.Valid(); iter.Next() {
+		iterKeys = append(iterKeys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"bbca", "caac"}, iterKeys)
+	iter.Close()
+	iterKeys = nil
+	iter = tree.Iterator(true)
+	for iter.Seek([]byte("bz")); iter.Valid(); iter.Next() {
+		iterKeys = append(iterKeys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"bbca", "acce"}, iterKeys)
+	iter.Close()
+	assert.Nil(t, tree.Close())
+
+	// 重新打开之后从索引文件中恢复 key 的顺序
+	tree, err = OpenBPlusTree(path, false, encryptor)
+	assert.Nil(t, err)
+	iterKeys = nil
+	iter = tree.Iterator(true)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		iterKeys = append(iterKeys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"caac", "bbca", "acce"}, iterKeys)
+	iter.Close()
+	assert.Nil(t, tree.Err())
+	assert.Nil(t, tree.Close())
+
+	// 索引文件中没有明文的 key
+	buf, err := os.ReadFile(filepath.Join(path, BPTreeIndexFileName))
+	assert.Nil(t, err)
+	for _, key := range keys {
+		assert.False(t, bytes.Contains(buf, key))
+	}
+
+	// key 不对时无法打开
+	wrongKey, err := data.NewEncryptor(&data.StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: bytes.Repeat([]byte("x"), 32)},
+	})
+	assert.Nil(t, err)
+	_, err = OpenBPlusTree(path, false, wrongKey)
+	assert.Equal(t, data.ErrInvalidEncryptionKey, err)
+
+	// 轮换 key 之后索引被清空，由数据库从数据文件重建
+	provider.CurrentId = 2
+	provider.Keys[2] = bytes.Repeat([]byte("n"), 32)
+	tree, err = OpenBPlusTree(path, false, encryptor)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, tree.Size())
+	assert.Nil(t, tree.Close())
+}
+
+func TestBPlusTree_Snapshot(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-snapshot")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false)
+	defer tree.Close()
+
+	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 1, Offset: 20})
+	snapshot := tree.Snapshot()
+	iter := snapshot.Iterator(false)
+
+	// 快照之后的修改对快照和它上面的迭代器不可见
+	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 2, Offset: 30})
+	tree.Delete([]byte("abc"))
+	tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 2, Offset: 40})
+	assert.Equal(t, uint32(1), snapshot.Get([]byte("aac")).Fid)
+	assert.NotNil(t, snapshot.Get([]byte("abc")))
+	assert.Nil(t, snapshot.Get([]byte("acc")))
+
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"aac", "abc"}, keys)
+
+	// 快照释放之后迭代器失效
+	snapshot.Close()
+	iter.Rewind()
+	assert.False(t, iter.Valid())
+	iter.Close()
+	assert.Equal(t, uint32(2), tree.Get([]byte("aac")).Fid)
+}
+
+// 快照和迭代器打开时索引文件变大需要重新 mmap，写入不会被阻塞
+func TestBPlusTree_SnapshotRemap(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-snapshot-remap")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false)
+	defer tree.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%05d", i))
+	}
+	for i := 0; i < 1000; i += 2 {
+		tree.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	snapshot := tree.Snapshot()
+	defer snapshot.Close()
+	iter := snapshot.Iterator(false)
+	defer iter.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20000; i++ {
+			tree.Put(key(i), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+		for i := 0; i < 500; i += 2 {
+			tree.Delete(key(i))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("put blocked by the snapshot")
+	}
+
+	// 快照中仍然是之前的数据，跨过了多批读取
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, uint32(1), iter.Value().Fid)
+		keys = append(keys, iter.Key())
+	}
+	assert.Equal(t, 500, len(keys))
+	assert.Equal(t, key(0), keys[0])
+	assert.Equal(t, key(998), keys[499])
+
+	reverse := snapshot.Iterator(true)
+	defer reverse.Close()
+	var count int
+	for reverse.Seek(key(501)); reverse.Valid(); reverse.Next() {
+		assert.Equal(t, key(500-count*2), reverse.Key())
+		count++
+	}
+	assert.Equal(t, 251, count)
+
+	assert.Equal(t, uint32(1), snapshot.Get(key(10)).Fid)
+	assert.Nil(t, snapshot.Get(key(11)))
+	assert.Nil(t, tree.Get(key(10)))
+	assert.Equal(t, uint32(2), tree.Get(key(11)).Fid)
+}
+
+// 索引文件中的数据无法解密时记录错误，而不是 panic
+func TestBPlusTree_DecryptError(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-decrypt-error")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	encryptor, err := data.NewEncryptor(&data.StaticKeyProvider{
+		CurrentId:	1,
+		Keys:		map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32)},
+	})
+	assert.Nil(t, err)
+	tree, err := OpenBPlusTree(path, false, encryptor)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	treeKey, err := tree.treeKey([]byte("aac"))
+	assert.Nil(t, err)
+	err = tree.tree.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(indexBucketName).Put(treeKey, []byte("broken value"))
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, tree.Get([]byte("aac")))
+	assert.NotNil(t, tree.Err())
+	assert.Nil(t, tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 2, Offset: 20}))
+	iter := tree.Iterator(false)
+	assert.False(t, iter.Valid())
+	iter.Close()
+}
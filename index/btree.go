@@ -37,7 +37,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -59,6 +61,10 @@ func (bt *BTree) Size() int {
 	return bt.tree.Len()
 }
 
+func (bt *BTree) Close() error {
+	return nil
+}
+
 func (bt *BTree) Iterator(reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
@@ -68,6 +74,33 @@ func (bt *BTree) Iterator(reverse bool) Iterator {
 	return NewBtreeIterator(bt.tree, reverse)
 }
 
+func (bt *BTree) Snapshot() Snapshot {
+	// Clone 是写时复制的，之后两棵树可以各自并发使用
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &btreeSnapshot{tree: bt.tree.Clone()}
+}
+
+// BTree 索引的快照，快照中的树不会再被修改，读取时不需要加锁
+type btreeSnapshot struct {
+	tree	*btree.BTree
+}
+
+func (bs *btreeSnapshot) Get(key []byte) *data.LogRecordPos {
+	btreeItem := bs.tree.Get(&Item{key: key})
+	if btreeItem == nil {
+		return nil
+	}
+	return btreeItem.(*Item).pos
+}
+
+func (bs *btreeSnapshot) Iterator(reverse bool) Iterator {
+	return NewBtreeIterator(bs.tree, reverse)
+}
+
+func (bs *btreeSnapshot) Close() {
+}
+
 
 type btreeIterator struct {
 	currIndex		int		// 当前遍历的下标
@@ -100,4 +100,26 @@ func TestBtree_Iterator(t *testing.T) {
 	for iter6.Seek([]byte("zz")); iter6.Valid(); iter6.Next() {
 		assert.NotNil(t, iter6.Key())
 	}
-}
\ No newline at end of file
+}
+func TestBTree_Snapshot(t *testing.T) {
+	bt := NewBTree()
+	bt.Put([]byte("aa"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	bt.Put([]byte("bb"), &data.LogRecordPos{Fid: 1, Offset: 20})
+	snapshot := bt.Snapshot()
+	defer snapshot.Close()
+
+	bt.Put([]byte("aa"), &data.LogRecordPos{Fid: 2, Offset: 10})
+	bt.Delete([]byte("bb"))
+	bt.Put([]byte("cc"), &data.LogRecordPos{Fid: 2, Offset: 20})
+
+	assert.Equal(t, uint32(1), snapshot.Get([]byte("aa")).Fid)
+	assert.NotNil(t, snapshot.Get([]byte("bb")))
+	assert.Nil(t, snapshot.Get([]byte("cc")))
+
+	var keys [][]byte
+	iter := snapshot.Iterator(true)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	assert.Equal(t, [][]byte{[]byte("bb"), []byte("aa")}, keys)
+}
@@ -0,0 +1,531 @@
+package index
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/google/btree"
+	"github.com/minimAluminiumalism/ApertureKV/data"
+)
+
+// 内存占用更小的索引，适合 key 数量非常多的场景
+// BTree 中每个 key 都有一个 Item、一个 LogRecordPos 和 key 本身三次内存分配，再加上 btree 节点中的接口，每个 key 额外占用约 80 字节
+// CompactIndex 把位置索引直接保存在固定大小的 compactEntry 中，key 拷贝到按块分配的 arena 里，
+// compactEntry 按 key 有序地存放在数组块中，btree 中只保存数组块，每个 key 额外占用约 32 字节
+// 快照克隆 btree，数组块是写时复制的，创建快照和迭代器不需要拷贝索引项
+
+const (
+	compactBlockSize	= 256				// 每个数组块中最多的 key 数量，超过之后分裂
+	keySlabSize			= 1024 * 1024		// arena 中每个 slab 的大小
+	compactExtraFlag	= uint32(1) << 31	// keyLen 的最高位，置位时完整的位置索引保存在 extras 中
+	compactArenaFlag	= uint32(1) << 31	// slab 的最高位，表示 key 在哪一个 arena 中
+	compactStepBlocks	= 4					// compact 期间每次写入处理的块数量
+)
+
+// 固定大小的索引项，key 保存在 arena 中
+type compactEntry struct {
+	slab	uint32	// key 所在的 slab，最高位是 compactArenaFlag
+	keyOff	uint32	// key 在 slab 中的偏移
+	keyLen	uint32	// key 的长度，最高位是 compactExtraFlag
+	fid		uint32
+	offset	uint32	// 数据文件不超过 4GB
+	size	uint32
+	expire	int64
+}
+
+func (e *compactEntry) ref() uint64 {
+	return uint64(e.slab)<<32 | uint64(e.keyOff)
+}
+
+func (e *compactEntry) hasExtra() bool {
+	return e.keyLen&compactExtraFlag != 0
+}
+
+// 存放 key 的 arena，key 写入之后不会被修改，被删除的 key 占用的空间在 compact 时回收
+type keyArena struct {
+	slabs	[][]byte
+	size	int64	// 所有 key 占用的空间
+	garbage	int64	// 被删除的 key 占用的空间
+}
+
+func (a *keyArena) alloc(key []byte) (uint32, uint32) {
+	var slab []byte
+	if len(a.slabs) > 0 {
+		slab = a.slabs[len(a.slabs)-1]
+	}
+	// 放不下时分配新的 slab，超过 slab 大小的 key 单独占用一个 slab
+	if slab == nil || cap(slab)-len(slab) < len(key) {
+		slabSize := keySlabSize
+		if len(key) > slabSize {
+			slabSize = len(key)
+		}
+		slab = make([]byte, 0, slabSize)
+		a.slabs = append(a.slabs, slab)
+	}
+	idx := len(a.slabs) - 1
+	off := len(slab)
+	a.slabs[idx] = append(slab, key...)
+	a.size += int64(len(key))
+	return uint32(idx), uint32(off)
+}
+
+func (a *keyArena) memSize() int64 {
+	var size int64
+	for _, slab := range a.slabs {
+		size += int64(cap(slab))
+	}
+	return size
+}
+
+// 按 key 有序排列的一组索引项，btree 中按第一个 key 排序
+// 块在创建之后的快照中是共享的，gen 小于索引当前的 gen 时不能修改，需要先复制
+type compactBlock struct {
+	first	[]byte	// 第一个 key，引用 arena 中不会被修改的数据
+	entries	[]compactEntry
+	extras	map[uint64]*data.LogRecordPos	// 放不进 compactEntry 的位置索引（value 在 blob 文件中），key 是 compactEntry.ref()
+	gen		uint64
+}
+
+func (b *compactBlock) Less(than btree.Item) bool {
+	return bytes.Compare(b.first, than.(*compactBlock).first) < 0
+}
+
+// tree 中 b 之后的块
+func nextBlock(tree *btree.BTree, b *compactBlock) *compactBlock {
+	var next *compactBlock
+	tree.AscendGreaterOrEqual(b, func(item btree.Item) bool {
+		if !b.Less(item) {
+			return true
+		}
+		next = item.(*compactBlock)
+		return false
+	})
+	return next
+}
+
+// tree 中 b 之前的块
+func prevBlock(tree *btree.BTree, b *compactBlock) *compactBlock {
+	var prev *compactBlock
+	tree.DescendLessOrEqual(b, func(item btree.Item) bool {
+		if !item.Less(b) {
+			return true
+		}
+		prev = item.(*compactBlock)
+		return false
+	})
+	return prev
+}
+
+// 被删除的 key 超过 arena 的一半时开始 compact：新的 key 写到另一个 arena 中，
+// 之后每次写入按顺序把几个块中的 key 拷贝过去，全部拷贝完之后释放旧的 arena，不会在一次写入中遍历整个索引
+type CompactIndex struct {
+	tree		*btree.BTree
+	arenas		[2]keyArena
+	cur			uint32	// 新的 key 写入的 arena
+	compacting	bool
+	compactNext	[]byte	// 下一个需要拷贝的块中的 key
+	gen			uint64	// 每次创建快照加一
+	count		int
+	lock		*sync.RWMutex
+}
+
+func NewCompactIndex() *CompactIndex {
+	return &CompactIndex{
+		tree:	btree.New(32),
+		lock:	new(sync.RWMutex),
+	}
+}
+
+func (ci *CompactIndex) key(e *compactEntry) []byte {
+	keyLen := e.keyLen &^ compactExtraFlag
+	slab := ci.arenas[e.slab>>31].slabs[e.slab&^compactArenaFlag]
+	return slab[e.keyOff : e.keyOff+keyLen : e.keyOff+keyLen]
+}
+
+// 把 key 拷贝到当前的 arena 中
+func (ci *CompactIndex) alloc(key []byte) (uint32, uint32) {
+	slab, off := ci.arenas[ci.cur].alloc(key)
+	return slab | ci.cur<<31, off
+}
+
+// 找到 key 所在的块：第一个 key 不大于 key 的最后一个块，key 比所有的块都小时是第一个块
+func (ci *CompactIndex) findBlock(key []byte) *compactBlock {
+	var block *compactBlock
+	ci.tree.DescendLessOrEqual(&compactBlock{first: key}, func(item btree.Item) bool {
+		block = item.(*compactBlock)
+		return false
+	})
+	if block == nil && ci.tree.Len() > 0 {
+		block = ci.tree.Min().(*compactBlock)
+	}
+	return block
+}
+
+// 在块中查找 key，返回第一个不小于 key 的位置，以及是否找到
+func (ci *CompactIndex) search(b *compactBlock, key []byte) (int, bool) {
+	idx := sort.Search(len(b.entries), func(i int) bool {
+		return bytes.Compare(ci.key(&b.entries[i]), key) >= 0
+	})
+	return idx, idx < len(b.entries) && bytes.Equal(ci.key(&b.entries[idx]), key)
+}
+
+// 返回可以修改的块，被快照共享的块先复制一份替换到 btree 中
+func (ci *CompactIndex) writable(b *compactBlock) *compactBlock {
+	if b.gen == ci.gen {
+		return b
+	}
+	clone := &compactBlock{
+		first:		b.first,
+		entries:	make([]compactEntry, len(b.entries), len(b.entries)+1),
+		gen:		ci.gen,
+	}
+	copy(clone.entries, b.entries)
+	if len(b.extras) > 0 {
+		clone.extras = make(map[uint64]*data.LogRecordPos, len(b.extras))
+		for ref, pos := range b.extras {
+			clone.extras[ref] = pos
+		}
+	}
+	ci.tree.ReplaceOrInsert(clone)
+	return clone
+}
+
+// 把位置索引写到 entry 中，放不下的保存到块的 extras
+func (ci *CompactIndex) setPos(b *compactBlock, e *compactEntry, pos *data.LogRecordPos) {
+	if e.hasExtra() {
+		delete(b.extras, e.ref())
+		e.keyLen &^= compactExtraFlag
+	}
+	e.fid, e.size, e.expire = pos.Fid, pos.Size, pos.Expire
+	e.offset = uint32(pos.Offset)
+	if pos.Blob != nil || pos.Offset < 0 || pos.Offset > math.MaxUint32 {
+		e.keyLen |= compactExtraFlag
+		if b.extras == nil {
+			b.extras = make(map[uint64]*data.LogRecordPos)
+		}
+		b.extras[e.ref()] = pos
+	}
+}
+
+func (ci *CompactIndex) decodePos(b *compactBlock, e *compactEntry) *data.LogRecordPos {
+	if e.hasExtra() {
+		pos := *b.extras[e.ref()]
+		return &pos
+	}
+	return &data.LogRecordPos{Fid: e.fid, Offset: int64(e.offset), Size: e.size, Expire: e.expire}
+}
+
+func (ci *CompactIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	defer ci.compactStep()
+
+	block := ci.findBlock(key)
+	if block == nil {
+		block = &compactBlock{gen: ci.gen}
+		ci.tree.ReplaceOrInsert(block)
+	}
+	idx, found := ci.search(block, key)
+	block = ci.writable(block)
+	if found {
+		e := &block.entries[idx]
+		oldPos := ci.decodePos(block, e)
+		ci.setPos(block, e, pos)
+		return oldPos
+	}
+
+	var e compactEntry
+	e.slab, e.keyOff = ci.alloc(key)
+	e.keyLen = uint32(len(key))
+	ci.setPos(block, &e, pos)
+	block.entries = append(block.entries, compactEntry{})
+	copy(block.entries[idx+1:], block.entries[idx:])
+	block.entries[idx] = e
+	if idx == 0 {
+		block.first = ci.key(&block.entries[0])
+	}
+	ci.count++
+
+	// 块满了之后分裂，后一部分作为新的块插入 btree
+	// 按顺序写入时新的 key 总是在最后，只把这个 key 分出去，前面的块保持是满的
+	if len(block.entries) > compactBlockSize {
+		split := len(block.entries) / 2
+		if idx == len(block.entries)-1 {
+			split = idx
+		}
+		right := &compactBlock{entries: make([]compactEntry, len(block.entries)-split), gen: ci.gen}
+		copy(right.entries, block.entries[split:])
+		right.first = ci.key(&right.entries[0])
+		for i := range right.entries {
+			if e := &right.entries[i]; e.hasExtra() {
+				if right.extras == nil {
+					right.extras = make(map[uint64]*data.LogRecordPos)
+				}
+				right.extras[e.ref()] = block.extras[e.ref()]
+				delete(block.extras, e.ref())
+			}
+		}
+		left := make([]compactEntry, split)
+		copy(left, block.entries[:split])
+		block.entries = left
+		ci.tree.ReplaceOrInsert(right)
+	}
+	return nil
+}
+
+func (ci *CompactIndex) Get(key []byte) *data.LogRecordPos {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.get(key)
+}
+
+func (ci *CompactIndex) get(key []byte) *data.LogRecordPos {
+	block := ci.findBlock(key)
+	if block == nil {
+		return nil
+	}
+	idx, found := ci.search(block, key)
+	if !found {
+		return nil
+	}
+	return ci.decodePos(block, &block.entries[idx])
+}
+
+func (ci *CompactIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	block := ci.findBlock(key)
+	if block == nil {
+		return nil, false
+	}
+	idx, found := ci.search(block, key)
+	if !found {
+		return nil, false
+	}
+	block = ci.writable(block)
+	e := &block.entries[idx]
+	oldPos := ci.decodePos(block, e)
+	if e.hasExtra() {
+		delete(block.extras, e.ref())
+	}
+	ci.arenas[e.slab>>31].garbage += int64(e.keyLen &^ compactExtraFlag)
+	// 块变空之前先从 btree 中删除，空的块无法比较
+	if len(block.entries) == 1 {
+		ci.tree.Delete(block)
+		block.entries = nil
+	} else {
+		block.entries = append(block.entries[:idx], block.entries[idx+1:]...)
+		if idx == 0 {
+			block.first = ci.key(&block.entries[0])
+		}
+	}
+	ci.count--
+	ci.startCompact()
+	ci.compactStep()
+	return oldPos, true
+}
+
+// 被删除的 key 超过 arena 的一半时开始 compact
+func (ci *CompactIndex) startCompact() {
+	if ci.compacting {
+		return
+	}
+	var size, garbage int64
+	for i := range ci.arenas {
+		size += ci.arenas[i].size
+		garbage += ci.arenas[i].garbage
+	}
+	if garbage < keySlabSize || garbage*2 < size {
+		return
+	}
+	ci.compacting = true
+	ci.cur ^= 1
+	ci.compactNext = nil
+}
+
+// 把 compactStepBlocks 个块中仍然在旧 arena 中的 key 拷贝到新的 arena 中
+// 已经处理过的块中新写入的 key 都在新的 arena 中，处理到最后一个块之后旧的 arena 不再被引用
+func (ci *CompactIndex) compactStep() {
+	if !ci.compacting {
+		return
+	}
+	for i := 0; i < compactStepBlocks; i++ {
+		block := ci.findBlock(ci.compactNext)
+		if block != nil {
+			block = ci.moveKeys(block)
+			block = nextBlock(ci.tree, block)
+		}
+		if block == nil {
+			// 快照持有旧的 slab，不受影响
+			ci.arenas[ci.cur^1] = keyArena{}
+			ci.compacting = false
+			ci.compactNext = nil
+			return
+		}
+		ci.compactNext = block.first
+	}
+}
+
+func (ci *CompactIndex) moveKeys(b *compactBlock) *compactBlock {
+	old := ci.cur ^ 1
+	moved := false
+	for i := range b.entries {
+		if b.entries[i].slab>>31 != old {
+			continue
+		}
+		if !moved {
+			b = ci.writable(b)
+			moved = true
+		}
+		e := &b.entries[i]
+		oldRef := e.ref()
+		e.slab, e.keyOff = ci.alloc(ci.key(e))
+		if e.hasExtra() {
+			b.extras[e.ref()] = b.extras[oldRef]
+			delete(b.extras, oldRef)
+		}
+	}
+	if moved {
+		b.first = ci.key(&b.entries[0])
+	}
+	return b
+}
+
+func (ci *CompactIndex) Size() int {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.count
+}
+
+// 索引占用的内存大小的估计值(Bytes)，包括 arena 中被删除的 key
+func (ci *CompactIndex) MemSize() int64 {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	var entries int64
+	ci.tree.Ascend(func(item btree.Item) bool {
+		entries += int64(cap(item.(*compactBlock).entries))
+		return true
+	})
+	return entries*int64(unsafe.Sizeof(compactEntry{})) + ci.arenaMemSize()
+}
+
+func (ci *CompactIndex) arenaMemSize() int64 {
+	return ci.arenas[0].memSize() + ci.arenas[1].memSize()
+}
+
+func (ci *CompactIndex) Close() error {
+	return nil
+}
+
+func (ci *CompactIndex) Iterator(reverse bool) Iterator {
+	return ci.Snapshot().Iterator(reverse)
+}
+
+// 快照克隆 btree 并且共享所有的块，之后被修改的块会先复制；arena 中的 key 写入之后不会被修改，只需要拷贝 slab 列表
+func (ci *CompactIndex) Snapshot() Snapshot {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	view := &CompactIndex{tree: ci.tree.Clone(), count: ci.count}
+	for i := range ci.arenas {
+		view.arenas[i].slabs = append([][]byte(nil), ci.arenas[i].slabs...)
+	}
+	ci.gen++
+	return &compactSnapshot{view: view}
+}
+
+// CompactIndex 的快照，view 中的树和块不会再被修改，读取时不需要加锁
+type compactSnapshot struct {
+	view	*CompactIndex
+}
+
+func (cs *compactSnapshot) Get(key []byte) *data.LogRecordPos {
+	return cs.view.get(key)
+}
+
+func (cs *compactSnapshot) Iterator(reverse bool) Iterator {
+	it := &compactIterator{view: cs.view, reverse: reverse}
+	it.Rewind()
+	return it
+}
+
+func (cs *compactSnapshot) Close() {
+}
+
+// 在快照的树中逐个块遍历，不拷贝索引项
+type compactIterator struct {
+	view	*CompactIndex
+	block	*compactBlock	// 当前的块，遍历结束时为 nil
+	idx		int				// 当前索引项在块中的下标
+	reverse	bool
+}
+
+func (it *compactIterator) Rewind() {
+	it.block = nil
+	if it.view.tree.Len() == 0 {
+		return
+	}
+	if it.reverse {
+		it.block = it.view.tree.Max().(*compactBlock)
+		it.idx = len(it.block.entries) - 1
+	} else {
+		it.block = it.view.tree.Min().(*compactBlock)
+		it.idx = 0
+	}
+}
+
+func (it *compactIterator) Seek(key []byte) {
+	it.block = it.view.findBlock(key)
+	if it.block == nil {
+		return
+	}
+	if it.reverse {
+		// 最后一个小于等于 key 的位置
+		it.idx = sort.Search(len(it.block.entries), func(i int) bool {
+			return bytes.Compare(it.view.key(&it.block.entries[i]), key) > 0
+		}) - 1
+	} else {
+		it.idx, _ = it.view.search(it.block, key)
+	}
+	it.skipBlock()
+}
+
+func (it *compactIterator) Next() {
+	if it.reverse {
+		it.idx--
+	} else {
+		it.idx++
+	}
+	it.skipBlock()
+}
+
+// 当前块遍历完之后移动到下一个块
+func (it *compactIterator) skipBlock() {
+	if it.reverse && it.idx < 0 {
+		it.block = prevBlock(it.view.tree, it.block)
+		if it.block != nil {
+			it.idx = len(it.block.entries) - 1
+		}
+	} else if !it.reverse && it.idx >= len(it.block.entries) {
+		it.block = nextBlock(it.view.tree, it.block)
+		it.idx = 0
+	}
+}
+
+func (it *compactIterator) Valid() bool {
+	return it.block != nil
+}
+
+func (it *compactIterator) Key() []byte {
+	return it.view.key(&it.block.entries[it.idx])
+}
+
+func (it *compactIterator) Value() *data.LogRecordPos {
+	return it.view.decodePos(it.block, &it.block.entries[it.idx])
+}
+
+func (it *compactIterator) Close() {
+	it.block = nil
+}
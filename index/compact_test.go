@@ -0,0 +1,180 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactIndex_PutGetDelete(t *testing.T) {
+	ci := NewCompactIndex()
+	assert.Nil(t, ci.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100}))
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 100}, ci.Get(nil))
+
+	assert.Nil(t, ci.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2, Size: 10}))
+	res := ci.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12, Size: 20, Expire: 1700000000000000000})
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 2, Size: 10}, res)
+	assert.Equal(t, &data.LogRecordPos{Fid: 11, Offset: 12, Size: 20, Expire: 1700000000000000000}, ci.Get([]byte("a")))
+
+	// 放不进 compactEntry 的位置索引
+	blobPos := &data.LogRecordPos{Fid: 3, Offset: 4, Size: 5, Blob: &data.LogRecordPos{Fid: 6, Offset: 1 << 40, Size: 8}}
+	assert.Nil(t, ci.Put([]byte("blob"), blobPos))
+	assert.Equal(t, blobPos, ci.Get([]byte("blob")))
+	assert.Equal(t, blobPos, ci.Put([]byte("blob"), &data.LogRecordPos{Fid: 7}))
+	assert.Equal(t, &data.LogRecordPos{Fid: 7}, ci.Get([]byte("blob")))
+	assert.Equal(t, 0, len(ci.findBlock([]byte("blob")).extras))
+	assert.Equal(t, 3, ci.Size())
+
+	pos, ok := ci.Delete([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(11), pos.Fid)
+	assert.Nil(t, ci.Get([]byte("a")))
+	_, ok = ci.Delete([]byte("a"))
+	assert.False(t, ok)
+	assert.Equal(t, 2, ci.Size())
+}
+
+// 和 BTree 的结果对比
+func TestCompactIndex_Random(t *testing.T) {
+	ci := NewCompactIndex()
+	bt := NewBTree()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		key := []byte(fmt.Sprintf("key-%096d", r.Intn(20000)))
+		if r.Intn(3) == 0 {
+			_, ok1 := ci.Delete(key)
+			_, ok2 := bt.Delete(key)
+			assert.Equal(t, ok2, ok1)
+			continue
+		}
+		pos := &data.LogRecordPos{Fid: uint32(i), Offset: int64(i), Size: uint32(i)}
+		if i%10 == 0 {
+			pos.Blob = &data.LogRecordPos{Fid: 1, Offset: int64(i)}
+		}
+		old1 := ci.Put(key, pos)
+		old2 := bt.Put(key, pos)
+		assert.Equal(t, old2, old1)
+	}
+	assert.Equal(t, bt.Size(), ci.Size())
+
+	for _, reverse := range []bool{false, true} {
+		it1, it2 := ci.Iterator(reverse), bt.Iterator(reverse)
+		for it1.Rewind(); it1.Valid(); it1.Next() {
+			assert.True(t, it2.Valid())
+			assert.Equal(t, it2.Key(), it1.Key())
+			assert.Equal(t, it2.Value(), it1.Value())
+			it2.Next()
+		}
+		assert.False(t, it2.Valid())
+
+		it1.Seek([]byte(fmt.Sprintf("key-%096d", 10000)))
+		it2.Seek([]byte(fmt.Sprintf("key-%096d", 10000)))
+		assert.Equal(t, it2.Key(), it1.Key())
+		it1.Close()
+		it2.Close()
+	}
+
+	// 删除大部分 key 之后 arena 被压缩，快照仍然可以读取之前的数据
+	snapshot := ci.Snapshot()
+	before := ci.MemSize()
+	for i := 0; i < 19000; i++ {
+		ci.Delete([]byte(fmt.Sprintf("key-%096d", i)))
+	}
+	assert.True(t, ci.MemSize() < before)
+	assert.False(t, ci.compacting)
+	assert.True(t, ci.arenaMemSize() <= 2*keySlabSize)
+	for i := 19000; i < 20000; i++ {
+		key := []byte(fmt.Sprintf("key-%096d", i))
+		assert.Equal(t, bt.Get(key), ci.Get(key))
+	}
+	for i := 0; i < 20000; i += 7 {
+		key := []byte(fmt.Sprintf("key-%096d", i))
+		assert.Equal(t, bt.Get(key), snapshot.Get(key))
+	}
+	snapshot.Close()
+}
+
+// 快照和迭代器共享块，之后的修改不影响它们
+func TestCompactIndex_Snapshot(t *testing.T) {
+	ci := NewCompactIndex()
+	for i := 0; i < 10000; i++ {
+		ci.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	snapshot := ci.Snapshot()
+	it := ci.Iterator(true)
+	for i := 0; i < 10000; i += 2 {
+		ci.Delete([]byte(fmt.Sprintf("key-%05d", i)))
+	}
+	for i := 1; i < 10000; i += 2 {
+		ci.Put([]byte(fmt.Sprintf("key-%05d", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+	}
+	ci.Put([]byte("key-99999"), &data.LogRecordPos{Fid: 2})
+
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 4}, snapshot.Get([]byte("key-00004")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 5}, snapshot.Get([]byte("key-00005")))
+	assert.Nil(t, snapshot.Get([]byte("key-99999")))
+	assert.Nil(t, ci.Get([]byte("key-00004")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 5}, ci.Get([]byte("key-00005")))
+
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%05d", 9999-count)), it.Key())
+		assert.Equal(t, uint32(1), it.Value().Fid)
+		count++
+	}
+	assert.Equal(t, 10000, count)
+	it.Seek([]byte("key-05000~"))
+	assert.Equal(t, []byte("key-05000"), it.Key())
+	it.Seek([]byte("a"))
+	assert.False(t, it.Valid())
+	it.Close()
+
+	it = snapshot.Iterator(false)
+	it.Seek([]byte("key-09999~"))
+	assert.False(t, it.Valid())
+	it.Seek([]byte("key-00255~"))
+	assert.Equal(t, []byte("key-00256"), it.Key())
+	it.Close()
+	snapshot.Close()
+}
+
+// compact 分散到多次写入中完成，期间的读写和快照都正常
+func TestCompactIndex_IncrementalCompact(t *testing.T) {
+	ci := NewCompactIndex()
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%0250d", i))
+	}
+	for i := 0; i < 20000; i++ {
+		ci.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	i := 0
+	for ; !ci.compacting; i++ {
+		ci.Delete(key(i))
+	}
+	// 开始 compact 的这次删除只处理了几个块
+	assert.NotNil(t, ci.compactNext)
+	snapshot, deleted := ci.Snapshot(), i
+	for ; ci.compacting; i++ {
+		ci.Put(key(i), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+	}
+	assert.Equal(t, int64(0), ci.arenas[ci.cur^1].size)
+	assert.True(t, ci.arenaMemSize() < snapshot.(*compactSnapshot).view.arenaMemSize())
+	for j := 0; j < 20000; j++ {
+		if j < deleted {
+			assert.Nil(t, snapshot.Get(key(j)))
+		} else {
+			assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: int64(j)}, snapshot.Get(key(j)))
+		}
+	}
+	it := ci.Iterator(false)
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	assert.Equal(t, ci.Size(), count)
+	it.Close()
+	snapshot.Close()
+}
@@ -11,9 +11,121 @@ import (
 type Indexer interface {
 	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
 	Get(key []byte) *data.LogRecordPos
-		Delete(key []byte) (*data.LogRecordPos, bool)
+	Delete(key []byte) (*data.LogRecordPos, bool)
 	Iterator(reverse bool) Iterator	// 索引迭代器
 	Size() int						// 索引中的数据量
+	Close() error					// 关闭索引
+	Snapshot() Snapshot				// 获取索引当前状态的只读快照
+}
+
+// 索引在某一时刻的只读视图，之后对索引的修改对它不可见
+type Snapshot interface {
+	Get(key []byte) *data.LogRecordPos
+	Iterator(reverse bool) Iterator
+	Close()							// 释放快照持有的资源
+}
+
+// 快照创建之后被修改的 key 在快照时的位置索引，pos 为 nil 表示快照时 key 不存在
+// 索引修改 key 时把旧的位置保存到所有打开的快照中，每个 key 只保存第一次修改之前的位置，
+// 快照读取时优先使用这里的位置，其他的 key 直接读取索引，不需要拷贝整个索引，也不需要一直持有索引的资源
+type snapshotOverlay struct {
+	items	*btree.BTree
+}
+
+func newSnapshotOverlay() *snapshotOverlay {
+	return &snapshotOverlay{items: btree.New(32)}
+}
+
+func (o *snapshotOverlay) preserve(key []byte, pos *data.LogRecordPos) {
+	if o.items.Has(&Item{key: key}) {
+		return
+	}
+	o.items.ReplaceOrInsert(&Item{key: copyKey(key), pos: pos})
+}
+
+// 快照时 key 的位置，key 在快照之后没有被修改过时返回 false
+func (o *snapshotOverlay) get(key []byte) (*data.LogRecordPos, bool) {
+	item := o.items.Get(&Item{key: key})
+	if item == nil {
+		return nil, false
+	}
+	return item.(*Item).pos, true
+}
+
+// 从 from 到 to（包括 to）之间保存的数据，toSet 为 false 时一直到最后
+func (o *snapshotOverlay) scan(from []byte, fromSet, inclusive bool, to []byte, toSet, reverse bool) []*Item {
+	var items []*Item
+	rangeItems(o.items, from, fromSet, inclusive, reverse, func(item *Item) bool {
+		if toSet {
+			c := bytes.Compare(item.key, to)
+			if (!reverse && c > 0) || (reverse && c < 0) {
+				return false
+			}
+		}
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
+// 把按顺序从索引中读到的一批数据和快照中保存的同一范围内的数据合并，
+// 快照中保存过的 key 使用快照时的位置，快照时不存在的 key 被去掉
+func mergeOverlay(live, overlay []*Item, reverse bool) []*Item {
+	items := make([]*Item, 0, len(live)+len(overlay))
+	i, j := 0, 0
+	for i < len(live) || j < len(overlay) {
+		var c int
+		switch {
+		case i == len(live):
+			c = 1
+		case j == len(overlay):
+			c = -1
+		default:
+			c = bytes.Compare(live[i].key, overlay[j].key)
+			if reverse {
+				c = -c
+			}
+		}
+		if c < 0 {
+			items = append(items, live[i])
+			i++
+			continue
+		}
+		if c == 0 {
+			i++
+		}
+		if overlay[j].pos != nil {
+			items = append(items, overlay[j])
+		}
+		j++
+	}
+	return items
+}
+
+// 按顺序遍历 tree 中从 from 开始的项，fromSet 为 false 时从头（反向时从末尾）开始，inclusive 为 false 时不包括 from 本身
+func rangeItems(tree *btree.BTree, from []byte, fromSet, inclusive, reverse bool, fn func(item *Item) bool) {
+	iter := func(item btree.Item) bool {
+		if fromSet && !inclusive && bytes.Equal(item.(*Item).key, from) {
+			return true
+		}
+		return fn(item.(*Item))
+	}
+	switch {
+	case !fromSet && reverse:
+		tree.Descend(iter)
+	case !fromSet:
+		tree.Ascend(iter)
+	case reverse:
+		tree.DescendLessOrEqual(&Item{key: from}, iter)
+	default:
+		tree.AscendGreaterOrEqual(&Item{key: from}, iter)
+	}
+}
+
+func copyKey(key []byte) []byte {
+	buf := make([]byte, len(key))
+	copy(buf, key)
+	return buf
 }
 
 type IndexType = int8
@@ -27,16 +139,22 @@ const (
 
 	// B+ 树索引
 	BPTree
+
+	// 内存占用更小的索引
+	Compact
 )
 
-func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
+// encryptor 不为 nil 时持久化到磁盘的索引需要加密
+func NewIndexer(typ IndexType, dirPath string, sync bool, encryptor *data.Encryptor) (Indexer, error) {
 	switch typ {
 	case Btree:
-		return NewBTree()
+		return NewBTree(), nil
 	case ART:
-		return NewART()
+		return NewART(), nil
 	case BPTree:
-		return NewBPlusTree(dirPath, sync)
+		return OpenBPlusTree(dirPath, sync, encryptor)
+	case Compact:
+		return NewCompactIndex(), nil
 	default:
 		panic("unsupported index type.")
 	}
@@ -8,17 +8,16 @@ import (
 
 type Iterator struct {
 	indexIter	index.Iterator
-	db			*DB
+	snapshot	*Snapshot
 	options		IteratorOptions
+	ownSnapshot	bool	// 关闭迭代器时是否需要释放快照
 }
 
+// 迭代器基于创建时的快照，遍历过程中的写入和 merge 对它都不可见
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
-	return &Iterator{
-		indexIter: indexIter,
-		db:			db,
-		options: 	opts,
-	}
+	iterator := db.Snapshot().NewIterator(opts)
+	iterator.ownSnapshot = true
+	return iterator
 }
 
 
@@ -48,25 +47,32 @@ func (it *Iterator) Key() []byte {
 }
 
 func (it *Iterator) Value() ([]byte, error) {
-	logRecordPos := it.indexIter.Value()
-	it.db.mu.RLock()
-	defer it.db.mu.RUnlock()
-	return it.db.getValueByPosition(logRecordPos)
+	it.snapshot.mu.RLock()
+	defer it.snapshot.mu.RUnlock()
+	if it.snapshot.released {
+		return nil, ErrSnapshotReleased
+	}
+	return it.snapshot.getValueByPosition(it.indexIter.Value())
 }
 
 func (it *Iterator) Close() {
 	it.indexIter.Close()
+	if it.ownSnapshot {
+		it.snapshot.Release()
+	}
 }
 
+// 跳过前缀不匹配和已经过期的 key
 func (it *Iterator) skipToNext() {
 	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
-		return
-	}
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
 		key := it.indexIter.Key()
-		if prefixLen < len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
-			break
+		if prefixLen != 0 && !(prefixLen < len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0) {
+			continue
+		}
+		if isExpired(it.indexIter.Value().Expire) {
+			continue
 		}
+		break
 	}
-}
\ No newline at end of file
+}
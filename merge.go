@@ -1,14 +1,18 @@
 package aperturekv
 
 import (
+	"encoding/binary"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/fio"
+	"github.com/minimAluminiumalism/ApertureKV/index"
 	"github.com/minimAluminiumalism/ApertureKV/utils"
 )
 
@@ -16,23 +20,39 @@ import (
 const (
 	mergeDirName     = "-merge"
 	mergeFinishedKey = "merge.finished"
+	mergeRewrittenKey = "merge.rewritten"
 )
 
 
-func (db *DB) Merge() error {
+// 副本也可以 merge，但只 merge 已经从主节点接收完的旧数据文件，活跃文件和主节点的数据文件一一对应
+func (db *DB) Merge() (err error) {
+	db.mu.Lock()
 	if db.activeFile == nil { // 数据库为空
+		db.mu.Unlock()
 		return nil
 	}
-	db.mu.Lock()
 	if db.isMerging {
 		db.mu.Unlock()
 		return ErrMergeInProgress
 	}
+	if db.isBackingUp {
+		db.mu.Unlock()
+		return ErrBackupInProgress
+	}
+	// 已经过期的 key 从索引中移除之后就不会被重写到 merge 后的文件中
+	db.collectExpired()
 	totalSize, err := utils.DirSize(db.options.DirPath)
 	if err != nil {
 		db.mu.Unlock()
 		return err
 	}
+	// blob 文件不参与 merge，单独由 GCBlobFiles 回收
+	blobSize, err := db.blobFilesSize()
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	totalSize -= blobSize
 	if float32(db.reclaimSize) / float32(totalSize) < db.options.DataFileMergeRatio {
 		db.mu.Unlock()
 		return ErrMergeRatioUnreached
@@ -47,29 +67,41 @@ func (db *DB) Merge() error {
 		return ErrNoEnoughSpaceForMerge
 	}
 	db.isMerging = true
+	mergeStartTime := time.Now()
 	defer func() {
-		db.isMerging = false
+		db.finishMerge(mergeStartTime, err)
 	}()
 	
-	// 持久化活跃文件
-	if err := db.activeFile.Sync(); err != nil {
-		db.mu.Unlock()
-		return err
-	}
+	var nonMergeFileId uint32
+	if db.replica != nil {
+		// 副本不能切换活跃文件，之后收到的数据还要追加到活跃文件中
+		nonMergeFileId = db.replica.mergeLimit()
+	} else {
+		// 持久化活跃文件
+		if err := db.activeFile.Sync(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
 
-	// change activeFile to olderFile
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	if err := db.setActiveDataFile(); err != nil {
-		db.mu.Unlock()
-		return err
+		// change activeFile to olderFile
+		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		if err := db.setActiveDataFile(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		nonMergeFileId = db.activeFile.FileId
 	}
-	nonMergeFileId := db.activeFile.FileId
 
 	var mergeFiles []*data.DataFile
 	for _, file := range db.olderFiles {
-		mergeFiles = append(mergeFiles, file)
+		if file.FileId < nonMergeFileId {
+			mergeFiles = append(mergeFiles, file)
+		}
 	}
 	db.mu.Unlock()
+	if len(mergeFiles) == 0 {
+		return nil
+	}
 
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
@@ -91,12 +123,16 @@ func (db *DB) Merge() error {
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	mergeOptions.AutoMergeInterval = 0
+	mergeOptions.ReplicaOf = ""
+	// merge 只重写数据文件中的记录，blob 文件中的 value 保持不动
+	mergeOptions.BlobThreshold = 0
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
 		return err
 	}
 
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := db.openHintFile(mergePath)
 	if err != nil {
 		return err
 	}
@@ -127,13 +163,26 @@ func (db *DB) Merge() error {
 		}
 	}
 
+	// 副本的 DataFileSize 比主节点小时，merge 后的数据文件可能比被 merge 的多，不能覆盖没有参与 merge 的文件
+	if mergeDB.activeFile != nil && mergeDB.activeFile.FileId >= nonMergeFileId {
+		_ = hintFile.Close()
+		_ = mergeDB.Close()
+		return ErrMergeFilesOverflow
+	}
 	if err := hintFile.Sync(); err != nil {
 		return err
 	}
+	if err := hintFile.Close(); err != nil {
+		return err
+	}
 	if err := mergeDB.Sync(); err != nil {
 		return err
 	}
+	if err := mergeDB.Close(); err != nil {
+		return err
+	}
 	
+	// 最后写入 merge 完成的标识，只有这个文件存在时 merge 的结果才会在 Open 时生效
 	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
 	if err != nil {
 		return err
@@ -146,26 +195,520 @@ func (db *DB) Merge() error {
 	if err := mergeFinishedFile.Write(encRecord); err != nil {
 		return err
 	}
+	if err := mergeFinishedFile.Sync(); err != nil {
+		return err
+	}
+	if err := mergeFinishedFile.Close(); err != nil {
+		return err
+	}
+
+	// 将 merge 的结果应用到当前的数据库中，回收旧数据文件占用的空间
+	return db.applyMerge(nonMergeFileId)
+}
+
+// 结束 merge，并记录本次 merge 的结果
+func (db *DB) finishMerge(startTime time.Time, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.isMerging = false
+	db.lastMerge = &mergeResult{
+		startTime:	startTime,
+		duration:	time.Since(startTime),
+		err:		err,
+	}
+}
+
+// 用 merge 后的数据文件替换掉正在使用的旧数据文件
+func (db *DB) applyMerge(nonMergeFileId uint32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 等待 sync 的写入失败时会回滚到旧的位置，被替换的文件删除之前需要先持久化它们
+	if len(db.unsyncedUndo) > 0 {
+		if err := db.syncWithLock(); err != nil {
+			return err
+		}
+	}
+
+	var mergeFiles []*data.DataFile
+	for fid, dataFile := range db.olderFiles {
+		if fid < nonMergeFileId {
+			mergeFiles = append(mergeFiles, dataFile)
+		}
+	}
+	var outputFids []uint32
+	for fid := uint32(0); fid < nonMergeFileId; fid++ {
+		outputFids = append(outputFids, fid)
+	}
+	if err := db.compactChangeLog(mergeFiles, outputFids); err != nil {
+		return err
+	}
+
+	// 关闭被 merge 过的旧数据文件，它们的无效数据都已经被 merge 掉了
+	for _, dataFile := range mergeFiles {
+		if err := db.retireDataFile(dataFile); err != nil {
+			return err
+		}
+		delete(db.olderFiles, dataFile.FileId)
+		db.removeReclaimSize(dataFile.FileId)
+	}
+
+	// 删除旧数据文件，并将 merge 后的文件移动到数据目录中
+	if err := db.loadMergeFiles(); err != nil {
+		return err
+	}
+	var fileId uint32 = 0
+	for ; fileId < nonMergeFileId; fileId++ {
+		if _, err := os.Stat(data.GetDataFileName(db.options.DirPath, fileId)); err != nil {
+			continue
+		}
+		dataFile, err := db.openDataFile(db.options.DirPath, fileId, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		db.olderFiles[fileId] = dataFile
+	}
+
+	// 仍然指向旧数据文件的索引更新为 merge 后的位置，merge 过程中写入的新数据不受影响
+	// merge 过程中被覆盖或者删除的 key，在 merge 后的文件中对应的数据是无效的
+	if err := db.iterateHintFile(func(key []byte, pos *data.LogRecordPos) {
+		if oldPos := db.index.Get(key); oldPos != nil && oldPos.Fid < nonMergeFileId {
+			db.index.Put(key, pos)
+		} else {
+			// 引用的 blob 和被覆盖的数据是同一个，覆盖时已经统计过了
+			db.addReclaimSize(withoutBlob(pos))
+		}
+	}); err != nil {
+		return err
+	}
+	// merge 之后被删除的 key 已经不在数据文件中了，重新构建布隆过滤器
+	db.rebuildBloomFilter()
 	return nil
 }
 
 
+// merge 时被重写的数据
+type rewrittenRecord struct {
+	key		[]byte
+	oldPos	*data.LogRecordPos
+	newPos	*data.LogRecordPos
+}
+
+// SelectiveMerge 只 merge 无效数据较多的数据文件，其余的数据文件保持不变
+// 被删除的 key 在旧的数据文件中可能还有数据，所以删除记录会被保留下来，只有 Merge 才会清理掉
+func (db *DB) SelectiveMerge(opts SelectiveMergeOptions) (err error) {
+	if db.replica != nil {
+		return ErrReadOnlyReplica
+	}
+	db.mu.Lock()
+	if db.activeFile == nil { // 数据库为空
+		db.mu.Unlock()
+		return nil
+	}
+	if db.isMerging {
+		db.mu.Unlock()
+		return ErrMergeInProgress
+	}
+	if db.isBackingUp {
+		db.mu.Unlock()
+		return ErrBackupInProgress
+	}
+	db.collectExpired()
+	mergeFiles, err := db.pickMergeFiles(opts)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	if len(mergeFiles) == 0 {
+		db.mu.Unlock()
+		return ErrMergeRatioUnreached
+	}
+	db.isMerging = true
+	mergeStartTime := time.Now()
+	defer func() {
+		db.finishMerge(mergeStartTime, err)
+	}()
+
+	// 切换活跃文件，并在新的活跃文件之前为 merge 后的文件预留 id
+	// 这样重写的数据在启动加载索引时位于所有旧数据之后，并且在之后写入的新数据之前
+	if err := db.activeFile.Sync(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	firstFileId := db.activeFile.FileId + 1
+	nonMergeFileId := firstFileId + uint32(len(mergeFiles))
+	activeFile, err := db.openDataFile(db.options.DirPath, nonMergeFileId, fio.StandardFIO)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	db.activeFile = activeFile
+	db.mu.Unlock()
+
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
+
+	// 先写到 merge 目录中，写完之后再移动到数据目录，避免中途崩溃留下不完整的数据文件
+	mergePath := db.getMergePath()
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
+		return err
+	}
+
+	var outputFiles []*data.DataFile
+	outputFile, err := db.openDataFile(mergePath, firstFileId, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	outputFiles = append(outputFiles, outputFile)
+
+	var rewritten []*rewrittenRecord
+	var tombstones []*data.LogRecordPos
+	for _, dataFile := range mergeFiles {
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			realKey, _ := parseLogRecordKey(logRecord.Key)
+			logRecordPos := db.index.Get(realKey)
+
+			// 有效的数据需要重写；key 仍然是被删除状态时需要保留删除记录，防止更早的数据在重启后重新生效
+			// 已经过期的数据和删除记录的作用相同
+			isPut := logRecord.Type == data.LogRecordNormal || logRecord.Type == data.LogRecordBlobIndex
+			isValid := isPut && logRecordPos != nil &&
+				logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset
+			isExpiredRecord := isPut && isExpired(logRecord.Expire)
+			isTombstone := (logRecord.Type == data.LogRecordDeleted || isExpiredRecord) && logRecordPos == nil
+			if isValid || isTombstone {
+				if isTombstone {
+					logRecord = &data.LogRecord{Type: data.LogRecordDeleted}
+				}
+				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+				encRecord, recordSize, err := db.encodeLogRecord(logRecord)
+				if err != nil {
+					return err
+				}
+				// 预留的文件 id 用完之后继续写在最后一个文件中
+				if outputFile.WriteOff+recordSize > db.options.DataFileSize && outputFile.FileId+1 < nonMergeFileId {
+					outputFile, err = db.openDataFile(mergePath, outputFile.FileId+1, fio.StandardFIO)
+					if err != nil {
+						return err
+					}
+					outputFiles = append(outputFiles, outputFile)
+				}
+				pos := &data.LogRecordPos{Fid: outputFile.FileId, Offset: outputFile.WriteOff, Size: uint32(recordSize), Expire: logRecord.Expire, Blob: blobPosOf(logRecord)}
+				if err := outputFile.Write(encRecord); err != nil {
+					return err
+				}
+				if isValid {
+					rewritten = append(rewritten, &rewrittenRecord{key: realKey, oldPos: logRecordPos, newPos: pos})
+				} else {
+					tombstones = append(tombstones, pos)
+				}
+			}
+			offset += size
+		}
+	}
+	for _, outputFile := range outputFiles {
+		if err := outputFile.Sync(); err != nil {
+			return err
+		}
+		if err := outputFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	return db.applySelectiveMerge(mergeFiles, outputFiles, rewritten, tombstones)
+}
+
+// 按照 opts 选出需要 merge 的数据文件，调用前必须加锁
+func (db *DB) pickMergeFiles(opts SelectiveMergeOptions) ([]*data.DataFile, error) {
+	var mergeFiles []*data.DataFile
+	for _, dataFile := range db.dataFiles() {
+		reclaimSize := db.fileReclaimSize[dataFile.FileId]
+		if reclaimSize == 0 {
+			continue
+		}
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		if float32(reclaimSize) / float32(size) < opts.FileReclaimRatio {
+			continue
+		}
+		mergeFiles = append(mergeFiles, dataFile)
+	}
+	// 优先 merge 无效数据最多的文件
+	sort.SliceStable(mergeFiles, func(i, j int) bool {
+		return db.fileReclaimSize[mergeFiles[i].FileId] > db.fileReclaimSize[mergeFiles[j].FileId]
+	})
+	if opts.MaxFileNum > 0 && len(mergeFiles) > opts.MaxFileNum {
+		mergeFiles = mergeFiles[:opts.MaxFileNum]
+	}
+	return mergeFiles, nil
+}
+
+// 用重写之后的数据文件替换掉被 merge 的数据文件
+func (db *DB) applySelectiveMerge(mergeFiles, outputFiles []*data.DataFile,
+	rewritten []*rewrittenRecord, tombstones []*data.LogRecordPos) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.unsyncedUndo) > 0 {
+		if err := db.syncWithLock(); err != nil {
+			return err
+		}
+	}
+
+	var outputFids []uint32
+	for _, outputFile := range outputFiles {
+		outputFids = append(outputFids, outputFile.FileId)
+	}
+	if err := db.compactChangeLog(mergeFiles, outputFids); err != nil {
+		return err
+	}
+
+	// 重写生成的数据文件移动到数据目录之前先记录下来，重启之后变更订阅仍然可以跳过它们
+	mergePath := db.getMergePath()
+	if err := db.writeMergeRewrittenFile(mergePath); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(mergePath, data.MergeRewrittenFileName),
+		filepath.Join(db.options.DirPath, data.MergeRewrittenFileName)); err != nil {
+		return err
+	}
+
+	// 新的数据文件先移动到数据目录中，再删除旧的数据文件，中途崩溃的话只会留下重复的数据
+	for _, outputFile := range outputFiles {
+		if outputFile.WriteOff == 0 {
+			continue
+		}
+		srcPath := data.GetDataFileName(mergePath, outputFile.FileId)
+		destPath := data.GetDataFileName(db.options.DirPath, outputFile.FileId)
+		if err := os.Rename(srcPath, destPath); err != nil {
+			return err
+		}
+		dataFile, err := db.openDataFile(db.options.DirPath, outputFile.FileId, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		db.olderFiles[dataFile.FileId] = dataFile
+	}
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	for _, dataFile := range mergeFiles {
+		if err := db.retireDataFile(dataFile); err != nil {
+			return err
+		}
+		if err := os.Remove(data.GetDataFileName(db.options.DirPath, dataFile.FileId)); err != nil {
+			return err
+		}
+		delete(db.olderFiles, dataFile.FileId)
+		db.removeReclaimSize(dataFile.FileId)
+	}
+
+	// merge 过程中没有被更新的 key 指向重写之后的位置，否则重写的数据是无效的
+	for _, record := range rewritten {
+		pos := db.index.Get(record.key)
+		if pos != nil && pos.Fid == record.oldPos.Fid && pos.Offset == record.oldPos.Offset {
+			db.index.Put(record.key, record.newPos)
+		} else {
+			db.addReclaimSize(withoutBlob(record.newPos))
+		}
+	}
+	// 保留下来的删除记录仍然是无效数据
+	for _, pos := range tombstones {
+		db.addReclaimSize(pos)
+	}
+	db.rebuildBloomFilter()
+	return nil
+}
+
+// 在 dirPath 中写入已经被 merge 掉的变更的位置和之后 merge 重写生成的数据文件，调用方需要持有数据库的锁
+func (db *DB) writeMergeRewrittenFile(dirPath string) error {
+	compactedFid, _ := parseChangeSeq(db.compactedSeq)
+	buf := make([]byte, binary.MaxVarintLen64*(len(db.rewrittenFids)+1))
+	n := binary.PutUvarint(buf, db.compactedSeq)
+	for fid := range db.rewrittenFids {
+		// 变更订阅不会再读取 compactedSeq 之前的数据文件
+		if fid > compactedFid {
+			n += binary.PutUvarint(buf[n:], uint64(fid))
+		}
+	}
+
+	rewrittenFile, err := data.OpenMergeRewrittenFile(dirPath)
+	if err != nil {
+		return err
+	}
+	defer rewrittenFile.Close()
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:	[]byte(mergeRewrittenKey),
+		Value:	buf[:n],
+	})
+	if err := rewrittenFile.Write(encRecord); err != nil {
+		return err
+	}
+	return rewrittenFile.Sync()
+}
+
+// 加载 SelectiveMerge 重写生成的数据文件，这些文件中的数据不是新写入的，变更订阅需要跳过它们
+// 记录之后还没有移动到数据目录中，或者已经被再次 merge 掉的文件不存在，会被忽略
+func (db *DB) loadMergeRewrittenFile() error {
+	if _, err := os.Stat(filepath.Join(db.options.DirPath, data.MergeRewrittenFileName)); os.IsNotExist(err) {
+		return nil
+	}
+	rewrittenFile, err := data.OpenMergeRewrittenFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	defer rewrittenFile.Close()
+	record, _, err := rewrittenFile.ReadLogRecord(0)
+	if err != nil {
+		return err
+	}
+
+	buf := record.Value
+	compactedSeq, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return ErrDataDirectoryCorrupted
+	}
+	buf = buf[n:]
+	if compactedSeq > db.compactedSeq {
+		db.compactedSeq = compactedSeq
+	}
+	compactedFid, _ := parseChangeSeq(db.compactedSeq)
+	existing := make(map[uint32]struct{}, len(db.fileIds))
+	for _, fid := range db.fileIds {
+		existing[uint32(fid)] = struct{}{}
+	}
+	for len(buf) > 0 {
+		fid, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return ErrDataDirectoryCorrupted
+		}
+		buf = buf[n:]
+		if _, ok := existing[uint32(fid)]; ok && uint32(fid) > compactedFid {
+			db.rewrittenFids[uint32(fid)] = struct{}{}
+		}
+	}
+	return nil
+}
+
 func (db *DB) getMergePath() string {
 	dir := path.Dir(path.Clean(db.options.DirPath))
 	base := path.Base(db.options.DirPath)
 	return filepath.Join(dir, base+mergeDirName)
 }
 
+// 加载 merge 数据目录
+// merge 完成的话，删除被 merge 过的旧数据文件，并把 merge 后的数据文件和 hint 文件移动到数据目录中；
+// 没有完成的 merge 目录直接丢弃
+func (db *DB) loadMergeFiles() error {
+	mergePath := db.getMergePath()
+	// merge 目录不存在，直接返回
+	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+		return nil
+	}
+	defer func() {
+		_ = os.RemoveAll(mergePath)
+	}()
+
+	dirEntries, err := os.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
+
+	// 查找 merge 完成的标识文件，判断 merge 是否处理完了
+	var mergeFinished bool
+	var mergeFileNames []string
+	for _, entry := range dirEntries {
+		if entry.Name() == data.MergeFinishedFileName {
+			mergeFinished = true
+		}
+		// merge 时临时 DB 的索引文件和文件锁，不能覆盖数据目录中的文件
+		if entry.Name() == index.BPTreeIndexFileName || entry.Name() == fileLockName {
+			continue
+		}
+		mergeFileNames = append(mergeFileNames, entry.Name())
+	}
+	if !mergeFinished {
+		return nil
+	}
+
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	if err != nil {
+		return err
+	}
+
+	// 删除已经被 merge 过的旧数据文件，即 id 比 nonMergeFileId 小的文件
+	var fileId uint32 = 0
+	for ; fileId < nonMergeFileId; fileId++ {
+		fileName := data.GetDataFileName(db.options.DirPath, fileId)
+		if _, err := os.Stat(fileName); err == nil {
+			if err := os.Remove(fileName); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 将 merge 后的数据文件、hint 文件和 merge 完成标识移动到数据目录中
+	for _, fileName := range mergeFileNames {
+		srcPath := filepath.Join(mergePath, fileName)
+		destPath := filepath.Join(db.options.DirPath, fileName)
+		if err := os.Rename(srcPath, destPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从 merge 完成的标识文件中读取第一个没有参与 merge 的文件 id
+func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	defer mergeFinishedFile.Close()
+
+	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	if err != nil {
+		return 0, err
+	}
+	nonMergeFileId, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(nonMergeFileId), nil
+}
+
 // build index from hint file
 func (db *DB) loadIndexFromHintFile() error {
+	return db.iterateHintFile(func(key []byte, pos *data.LogRecordPos) {
+		db.index.Put(key, pos)
+		db.setExpire(key, pos.Expire)
+	})
+}
+
+// 遍历数据目录中 hint 文件的所有记录
+func (db *DB) iterateHintFile(fn func(key []byte, pos *data.LogRecordPos)) error {
 	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
 	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
-	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	hintFile, err := db.openHintFile(db.options.DirPath)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
+
 	var offset int64 = 0
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
@@ -177,8 +720,72 @@ func (db *DB) loadIndexFromHintFile() error {
 		}
 		
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		fn(logRecord.Key, pos)
 		offset += size
 	}
 	return nil
-}
\ No newline at end of file
+}
+// 上一次 merge 的执行结果
+type mergeResult struct {
+	startTime	time.Time
+	duration	time.Duration
+	err			error
+}
+
+// 允许自动 merge 的时间段，按一天中的小时计算（本地时间）
+// StartHour 和 EndHour 相等时不做限制，StartHour 大于 EndHour 时表示跨越零点，例如 22 点到次日 4 点
+type MergeWindow struct {
+	StartHour	int	// 起始小时，包含
+	EndHour		int	// 结束小时，不包含
+}
+
+func (w MergeWindow) contains(t time.Time) bool {
+	if w.StartHour == w.EndHour {
+		return true
+	}
+	hour := t.Hour()
+	if w.StartHour < w.EndHour {
+		return hour >= w.StartHour && hour < w.EndHour
+	}
+	return hour >= w.StartHour || hour < w.EndHour
+}
+
+// 启动后台自动 merge
+func (db *DB) startAutoMerge() {
+	if db.options.AutoMergeInterval <= 0 {
+		return
+	}
+	db.autoMergeCloseCh = make(chan struct{})
+	db.autoMergeWg.Add(1)
+	go db.autoMerge(db.autoMergeCloseCh)
+}
+
+// 停止后台自动 merge，并等待正在进行的 merge 结束
+func (db *DB) stopAutoMerge() {
+	if db.autoMergeCloseCh == nil {
+		return
+	}
+	close(db.autoMergeCloseCh)
+	db.autoMergeCloseCh = nil
+	db.autoMergeWg.Wait()
+}
+
+// 定时检查无效数据的比例，达到 DataFileMergeRatio 时执行 merge
+func (db *DB) autoMerge(closeCh chan struct{}) {
+	defer db.autoMergeWg.Done()
+
+	ticker := time.NewTicker(db.options.AutoMergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !db.options.AutoMergeWindow.contains(time.Now()) {
+				continue
+			}
+			// 比例没有达到或者已经在 merge 时会直接返回，执行结果通过 Stat 查看
+			_ = db.Merge()
+		case <-closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package aperturekv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// 没有任何数据的情况下进行 merge
+func TestDB_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+}
+
+// 有失效的数据和被重复 Put 的数据，merge 之后重启
+func TestDB_Merge2(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 40000; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new value in merge"))
+		assert.Nil(t, err)
+	}
+	sizeBefore, err := utils.DirSize(dir)
+	assert.Nil(t, err)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 重启之后 merge 的结果生效
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+
+	_, err = os.Stat(db2.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	sizeAfter, err := utils.DirSize(dir)
+	assert.Nil(t, err)
+	assert.Less(t, sizeAfter, sizeBefore)
+
+	keys := db2.ListKeys()
+	assert.Equal(t, 40000, len(keys))
+	for i := 0; i < 10000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 40000; i < 50000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new value in merge"), val)
+	}
+}
+
+// merge 的过程中有新的数据写入
+func TestDB_Merge3(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-3")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// merge 之后写入的数据在新的活跃文件中，重启后不能丢失
+	for i := 50000; i < 60000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	keys := db2.ListKeys()
+	assert.Equal(t, 50000, len(keys))
+	for i := 50000; i < 60000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+// 没有完成的 merge 目录会被丢弃
+func TestDB_Merge_Unfinished(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-4")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 模拟 merge 过程中崩溃，merge 目录中只有一部分数据，没有 merge 完成的标识
+	mergePath := db.getMergePath()
+	err = os.MkdirAll(mergePath, os.ModePerm)
+	assert.Nil(t, err)
+	err = os.WriteFile(data.GetDataFileName(mergePath, 0), utils.RandomValue(128), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(mergePath, data.HintFileName), utils.RandomValue(128), 0644)
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, data.HintFileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+}
+
+// merge 的结果会直接应用到正在运行的数据库中
+func TestDB_Merge_ApplyOnline(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-online")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 30000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(512))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 20000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	sizeBefore, err := utils.DirSize(dir)
+	assert.Nil(t, err)
+
+	// merge 之前创建的迭代器
+	iter := db.NewIterator(DefaultIteratorOptions)
+	defer iter.Close()
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	stat := db.Stat()
+	assert.Less(t, stat.DiskSize, sizeBefore)
+	assert.Equal(t, int64(0), stat.ReclaimableSize)
+	assert.False(t, stat.LastMergeTime.IsZero())
+	assert.Equal(t, "", stat.LastMergeErr)
+
+	for i := 20000; i < 30000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	count := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+		count++
+	}
+	assert.Equal(t, 10000, count)
+
+	// 重启之后数据不变
+	err = db.Put(utils.GetTestKey(30000), []byte("value after merge"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 10001, len(db2.ListKeys()))
+	val, err := db2.Get(utils.GetTestKey(30000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value after merge"), val)
+}
+
+// 后台自动 merge
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024 * 1024
+	opts.DataFileMergeRatio = 0.5
+	opts.AutoMergeInterval = 50 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(512))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 15000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return !db.Stat().LastMergeTime.IsZero()
+	}, 10*time.Second, 50*time.Millisecond)
+	stat := db.Stat()
+	assert.Equal(t, "", stat.LastMergeErr)
+	assert.Equal(t, uint(5000), stat.KeyNum)
+
+	// Close 会停止后台 merge
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 5000, len(db2.ListKeys()))
+}
+
+func TestMergeWindow_Contains(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2023, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	assert.True(t, MergeWindow{}.contains(at(12)))
+
+	w1 := MergeWindow{StartHour: 1, EndHour: 5}
+	assert.True(t, w1.contains(at(1)))
+	assert.True(t, w1.contains(at(4)))
+	assert.False(t, w1.contains(at(5)))
+	assert.False(t, w1.contains(at(0)))
+
+	// 跨越零点
+	w2 := MergeWindow{StartHour: 22, EndHour: 4}
+	assert.True(t, w2.contains(at(23)))
+	assert.True(t, w2.contains(at(3)))
+	assert.False(t, w2.contains(at(4)))
+	assert.False(t, w2.contains(at(21)))
+}
+
+// 从 hint 文件加载的索引和重放全部数据文件得到的索引一致
+func TestDB_Merge_LoadIndexFromHintFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-5")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 30000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(512))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	for i := 30000; i < 35000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(512))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	collectIndex := func(db *DB) map[string]data.LogRecordPos {
+		positions := make(map[string]data.LogRecordPos)
+		iterator := db.index.Iterator(false)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			positions[string(iterator.Key())] = *iterator.Value()
+		}
+		return positions
+	}
+
+	// 通过 hint 文件加载索引
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, data.HintFileName))
+	assert.Nil(t, err)
+	hintIndex := collectIndex(db2)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 去掉 hint 文件和 merge 完成的标识，重放全部数据文件
+	err = os.Remove(filepath.Join(dir, data.HintFileName))
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(dir, data.MergeFinishedFileName))
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	replayIndex := collectIndex(db3)
+
+	assert.Equal(t, 30000, len(hintIndex))
+	assert.Equal(t, replayIndex, hintIndex)
+}
+
+// 运行时统计的每个文件的无效数据和重启后重新统计的一致
+func TestDB_FileReclaimSize(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-reclaim")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 5000; i < 8000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 8000; i < 9000; i++ {
+		_ = wb.Put(utils.GetTestKey(i), utils.RandomValue(64))
+	}
+	_ = wb.Delete(utils.GetTestKey(9000))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	stat := db.Stat()
+	var total int64
+	for _, fileStat := range stat.DataFiles {
+		total += fileStat.ReclaimableSize
+	}
+	assert.True(t, len(stat.DataFiles) > 1)
+	assert.Equal(t, stat.ReclaimableSize, total)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	stat2 := db2.Stat()
+	assert.Equal(t, stat.ReclaimableSize, stat2.ReclaimableSize)
+	assert.Equal(t, stat.DataFiles, stat2.DataFiles)
+}
+
+// 只 merge 无效数据最多的文件
+func TestDB_SelectiveMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-selective-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	// 第一个文件中的数据大部分都被覆盖或者删除了
+	for i := 0; i < 6000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new value"))
+		assert.Nil(t, err)
+	}
+	for i := 6000; i < 7000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 没有满足条件的文件
+	err = db.SelectiveMerge(SelectiveMergeOptions{FileReclaimRatio: 1})
+	assert.Equal(t, ErrMergeRatioUnreached, err)
+
+	stat := db.Stat()
+	dirtiest := stat.DataFiles[0]
+	for _, fileStat := range stat.DataFiles {
+		if fileStat.ReclaimableSize > dirtiest.ReclaimableSize {
+			dirtiest = fileStat
+		}
+	}
+	err = db.SelectiveMerge(SelectiveMergeOptions{FileReclaimRatio: 0.5, MaxFileNum: 1})
+	assert.Nil(t, err)
+
+	// 只有无效数据最多的文件被删除了，其他文件保持不变
+	stat2 := db.Stat()
+	assert.Less(t, stat2.ReclaimableSize, stat.ReclaimableSize)
+	_, err = os.Stat(data.GetDataFileName(dir, dirtiest.Fid))
+	assert.True(t, os.IsNotExist(err))
+	for _, fileStat := range stat.DataFiles {
+		if fileStat.Fid != dirtiest.Fid {
+			_, err = os.Stat(data.GetDataFileName(dir, fileStat.Fid))
+			assert.Nil(t, err)
+		}
+	}
+
+	check := func(db *DB) {
+		assert.Equal(t, 19000, len(db.ListKeys()))
+		for i := 0; i < 6000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("new value"), val)
+		}
+		for i := 6000; i < 7000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := 7000; i < 20000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+	}
+	check(db)
+
+	// 被 merge 掉的删除记录在重启之后仍然有效
+	err = db.Put(utils.GetTestKey(20000), []byte("after selective merge"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	_ = db2.Delete(utils.GetTestKey(20000))
+	check(db2)
+}
+
+// 只 merge 删除记录所在的文件，旧数据文件中被删除的 key 在重启后不能重新生效
+func TestDB_SelectiveMerge_Tombstone(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-selective-merge-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	// 删除记录写到单独的文件中
+	db.mu.Lock()
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	err = db.setActiveDataFile()
+	db.mu.Unlock()
+	assert.Nil(t, err)
+	tombstoneFid := db.activeFile.FileId
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	err = db.SelectiveMerge(SelectiveMergeOptions{FileReclaimRatio: 0.9})
+	assert.Nil(t, err)
+	_, err = os.Stat(data.GetDataFileName(dir, tombstoneFid))
+	assert.True(t, os.IsNotExist(err))
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 4900, len(db2.ListKeys()))
+	for i := 0; i < 100; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+}
@@ -1,14 +1,37 @@
 package aperturekv
 
-import "os"
+import (
+	"os"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+)
 
 
 type Options struct {
 	DirPath				string		// 数据库数据目录
 	DataFileSize		int64		// 数据文件的大小
 	SyncWrites			bool		// 每次写数据是否持久化
+	BytesPerSync		int64		// 累计写入多少数据(Bytes)之后持久化一次，为 0 时不按写入量持久化
+	SyncInterval		time.Duration	// 后台定时持久化的间隔（类似 redis 的 appendfsync everysec），为 0 时不定时持久化
 	IndexType			IndexType	// 索引类型
 	DataFileMergeRatio	float32
+	MMapAtStartup		bool		// 启动时是否使用 mmap 加载数据文件
+	RecoveryMode		RecoveryMode	// 启动时遇到损坏数据的处理方式
+	AutoMergeInterval	time.Duration	// 后台检查是否需要 merge 的间隔，为 0 时不开启自动 merge
+	AutoMergeWindow		MergeWindow		// 允许自动 merge 的时间段
+	ReplicaOf			string			// 主节点复制服务的地址，设置之后以只读副本的方式打开，不能和 BlobThreshold 一起使用
+	Compression			CodecType		// value 的压缩算法，CodecNone 表示不压缩
+	CompressThreshold	int				// 小于该长度的 value 不压缩
+	// 用 AES-GCM 加密数据文件、hint 文件和 B+ 树索引的 key，为 nil 时不加密
+	// B+ 树索引文件中只保存 key 的摘要，打开时解密所有的 key 保存在内存中，用于按 key 的顺序遍历
+	EncryptionKeys		KeyProvider
+	BlobThreshold		int				// 不小于该长度的 value 单独存储在 blob 文件中，为 0 时不分离
+	BlobFileSize		int64			// blob 文件的大小
+	BlobGCRatio			float32			// blob 文件中无效数据达到该比例时才会被 GCBlobFiles 回收
+	BloomFilterFPRate	float64			// 使用 B+ 树索引时用布隆过滤器过滤不存在的 key，期望的误判率，为 0 时不使用
+	ValueCacheSize		int64			// 缓存热点 value 的内存上限(Bytes)，为 0 时不缓存
+	MaxOpenFiles		int				// 最多同时打开的数据文件和 blob 文件数量，超过之后关闭最近最少使用的文件，为 0 时不限制
 }
 
 type IteratorOptions struct {
@@ -21,6 +44,17 @@ type WriteBatchOptions struct {
 	SyncWrites	bool	// 提交是是否 sync 持久化
 }
 
+type TxnOptions struct {
+	MaxBatchNum	uint	// 一个事务中最大的写入数量
+	SyncWrites	bool	// 提交时是否 sync 持久化
+}
+
+// 只 merge 部分数据文件时的配置项
+type SelectiveMergeOptions struct {
+	FileReclaimRatio	float32	// 只 merge 无效数据比例不小于该值的数据文件
+	MaxFileNum			int		// 最多 merge 的数据文件数量，按无效数据量从大到小选择，为 0 时不限制
+}
+
 type IndexType = int8
 
 const (
@@ -28,6 +62,33 @@ const (
 	ART
 	// B+ 树索引，将索引存储到本地磁盘
 	BPlusTree
+	// 位置索引和 key 紧凑地存储在内存中，每个 key 的额外开销比 BTree 和 ART 小得多，适合 key 数量非常多的场景
+	Compact
+)
+
+type CodecType = data.CodecType
+
+const (
+	CodecNone	= data.CodecNone
+	// 标准库的 flate 压缩，其他的算法可以通过 data.RegisterCodec 注册
+	CodecFlate	= data.CodecFlate
+)
+
+// 加密使用的 key，轮换 key 之后 merge 会用新的 key 重新加密旧数据
+type KeyProvider = data.KeyProvider
+
+type StaticKeyProvider = data.StaticKeyProvider
+
+// 零值是 RecoverTruncateTail，没有设置 RecoveryMode 的 Options 和之前一样截断活跃文件末尾损坏的数据
+type RecoveryMode = int8
+
+const (
+	// 截断活跃文件末尾损坏的数据（例如写入时崩溃），其他数据文件损坏时返回错误
+	RecoverTruncateTail RecoveryMode = iota
+	// 数据文件有任何损坏都返回错误
+	RecoverStrict
+	// 截断活跃文件末尾损坏的数据，并跳过旧数据文件中损坏的部分
+	RecoverSkipCorrupted
 )
 
 var DefaultOptions = Options {
@@ -36,6 +97,16 @@ var DefaultOptions = Options {
 	SyncWrites: 		false,
 	IndexType: 			BTree,
 	DataFileMergeRatio: 0.5, // 无效数据达到总数据的一半就 merge
+	MMapAtStartup:		false,
+	RecoveryMode:		RecoverTruncateTail,
+	Compression:		CodecNone,
+	CompressThreshold:	128,
+	BlobThreshold:		0,
+	BlobFileSize:		256*1024*1024, // 256MB
+	BlobGCRatio:		0.5,
+	BloomFilterFPRate:	0.01,
+	ValueCacheSize:		0,
+	MaxOpenFiles:		0,
 }
 
 var DefaultIteratorOptions = IteratorOptions {
@@ -46,4 +117,14 @@ var DefaultIteratorOptions = IteratorOptions {
 var DefaultWriteBatchOptions = WriteBatchOptions {
 	MaxBatchNum: 10000,
 	SyncWrites: true,
-}
\ No newline at end of file
+}
+
+var DefaultTxnOptions = TxnOptions {
+	MaxBatchNum: 10000,
+	SyncWrites: true,
+}
+
+var DefaultSelectiveMergeOptions = SelectiveMergeOptions {
+	FileReclaimRatio:	0.5,
+	MaxFileNum:			0,
+}
@@ -41,7 +41,13 @@ func execClientCommand(conn redcon.Conn, cmd redcon.Command) {
 			conn.WriteError("Err unsupported command: '" + command + "'")
 			return
 		}
-		res, err := cmdFunc(client, cmd.Args[1:])
+		var res interface{}
+		var err error
+		if client.server.node != nil {
+			res, err = execClusterCommand(client.server.node, command, cmdFunc, cmd.Args)
+		} else {
+			res, err = cmdFunc(client, cmd.Args[1:])
+		}
 		if err != nil {
 			if err == aperture.ErrKeyNotFound {
 				conn.WriteNull()
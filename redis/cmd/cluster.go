@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	aperture "github.com/minimAluminiumalism/ApertureKV"
+	"github.com/minimAluminiumalism/ApertureKV/cluster"
+	aperture_redis "github.com/minimAluminiumalism/ApertureKV/redis"
+	"github.com/tidwall/redcon"
+)
+
+// 集群模式下写命令整条写入 raft 日志，在每个节点上执行
+const redisOp = "redis"
+
+// 会修改数据的命令，集群模式下需要经过 raft 日志
+var writeCommands = map[string]bool{
+	"set":   true,
+	"hset":  true,
+	"sadd":  true,
+	"lpush": true,
+	"zadd":  true,
+}
+
+var errInvalidResult = errors.New("ERR invalid result from the cluster")
+
+// 集群模式下执行命令，写命令交给 raft（follower 会转发给 leader），读命令访问本地的数据库
+func execClusterCommand(node *cluster.Node, command string, cmdFunc cmdHandler, cmdArgs [][]byte) (interface{}, error) {
+	if writeCommands[command] {
+		result, err := node.Propose(redisOp, cmdArgs...)
+		if err != nil {
+			return nil, err
+		}
+		return decodeRedisResult(result)
+	}
+	var res interface{}
+	err := node.View(func(db *aperture.DB) error {
+		var err error
+		cli := &ApertureClient{db: aperture_redis.NewRedisDSWithDB(db)}
+		res, err = cmdFunc(cli, cmdArgs[1:])
+		return err
+	})
+	return res, err
+}
+
+// 应用 raft 日志中的 redis 命令，args 包含命令名
+func applyRedisCommand(db *aperture.DB, args [][]byte) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, cluster.ErrInvalidArgs
+	}
+	cmdFunc, ok := supportedCommands[strings.ToLower(string(args[0]))]
+	if !ok {
+		return nil, cluster.ErrUnknownCommand
+	}
+	cli := &ApertureClient{db: aperture_redis.NewRedisDSWithDB(db)}
+	res, err := cmdFunc(cli, args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return encodeRedisResult(res)
+}
+
+// 命令的结果需要通过 RPC 返回给转发的节点，第一个字节标识类型
+func encodeRedisResult(res interface{}) ([]byte, error) {
+	switch v := res.(type) {
+	case redcon.SimpleString:
+		return append([]byte{'+'}, v...), nil
+	case redcon.SimpleInt:
+		return strconv.AppendInt([]byte{':'}, int64(v), 10), nil
+	case []byte:
+		return append([]byte{'$'}, v...), nil
+	}
+	return nil, errInvalidResult
+}
+
+func decodeRedisResult(buf []byte) (interface{}, error) {
+	if len(buf) == 0 {
+		return nil, errInvalidResult
+	}
+	switch buf[0] {
+	case '+':
+		return redcon.SimpleString(buf[1:]), nil
+	case ':':
+		v, err := strconv.Atoi(string(buf[1:]))
+		if err != nil {
+			return nil, errInvalidResult
+		}
+		return redcon.SimpleInt(v), nil
+	case '$':
+		return buf[1:], nil
+	}
+	return nil, errInvalidResult
+}
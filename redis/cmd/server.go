@@ -1,10 +1,13 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"strings"
 	"sync"
 
 	aperturekv "github.com/minimAluminiumalism/ApertureKV"
+	"github.com/minimAluminiumalism/ApertureKV/cluster"
 	aperture_redis "github.com/minimAluminiumalism/ApertureKV/redis"
 	"github.com/tidwall/redcon"
 )
@@ -16,12 +19,13 @@ const PORT string = ":6380"
 type ApertureSvr struct {
 	dbs		map[int]*aperture_redis.RedisDS
 	server	*redcon.Server
+	node	*cluster.Node	// 集群模式下的节点，为 nil 时是单机模式
 	mu		sync.Mutex
 }
 
 
-func (svr *ApertureSvr) listen() {
-	log.Println("aperture server is running on %v", PORT)
+func (svr *ApertureSvr) listen(addr string) {
+	log.Printf("aperture server is running on %v", addr)
 	log.Fatal(svr.server.ListenAndServe())
 }
 
@@ -42,15 +46,38 @@ func (svr *ApertureSvr) close(conn redcon.Conn, err error) {
 }
 
 func main() {
-	addr := "localhost" + PORT
-	redisDS, err := aperture_redis.NewRedisDS(aperturekv.DefaultOptions)
-	if err != nil {
-		panic(err)
-	}
+	clusterDir := flag.String("cluster-dir", "", "data directory of the cluster node, empty to run standalone")
+	raftAddr := flag.String("raft", "127.0.0.1:7380", "raft address of the cluster node")
+	peers := flag.String("peers", "", "comma separated raft addresses of the other cluster nodes")
+	port := flag.String("port", PORT, "redis port")
+	flag.Parse()
+
+	addr := "localhost" + *port
 	apertureServer := &ApertureSvr{
 		dbs: make(map[int]*aperture_redis.RedisDS),
 	}
-	apertureServer.dbs[0] = redisDS
+	if *clusterDir != "" {
+		cfg := cluster.DefaultConfig
+		cfg.Dir = *clusterDir
+		cfg.RaftAddr = *raftAddr
+		cfg.Commands = map[string]cluster.ApplyFunc{redisOp: applyRedisCommand}
+		node, err := cluster.NewNode(cfg)
+		if err != nil {
+			panic(err)
+		}
+		var peerAddrs []string
+		if *peers != "" {
+			peerAddrs = strings.Split(*peers, ",")
+		}
+		node.Start(peerAddrs)
+		apertureServer.node = node
+	} else {
+		redisDS, err := aperture_redis.NewRedisDS(aperturekv.DefaultOptions)
+		if err != nil {
+			panic(err)
+		}
+		apertureServer.dbs[0] = redisDS
+	}
 	apertureServer.server = redcon.NewServer(addr, execClientCommand, apertureServer.accept, apertureServer.close)
-	apertureServer.listen()
-}
\ No newline at end of file
+	apertureServer.listen(addr)
+}
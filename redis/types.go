@@ -33,6 +33,11 @@ func NewRedisDS(options aperture.Options) (*RedisDS, error) {
 	return &RedisDS{db: db}, nil
 }
 
+// 在已经打开的数据库上提供 redis 数据结构
+func NewRedisDSWithDB(db *aperture.DB) *RedisDS {
+	return &RedisDS{db: db}
+}
+
 func (rds *RedisDS) Close() error {
 	return rds.db.Close()
 }
@@ -59,10 +64,11 @@ func (rds *RedisDS) Set(key []byte, ttl time.Duration, value []byte) error {
 	idx += binary.PutVarint(buf[idx:], expire)
 
 	encValue := make([]byte, idx+len(value))
-	copy(encValue[:idx], buf[idx:])
+	copy(encValue[:idx], buf[:idx])
 	copy(encValue[idx:], value)
 
-	return rds.db.Put(key, encValue)
+	// 交给存储引擎处理过期，过期的数据才能被 merge 回收
+	return rds.db.PutWithTTL(key, encValue, ttl)
 }
 
 // String get 
@@ -87,32 +93,35 @@ func (rds *RedisDS) Get(key []byte) ([]byte, error) {
 
 
 func (rds *RedisDS) HSet(key, field, value []byte) (bool, error) {
-	meta, err := rds.findMetadata(key, Hash)
-	if err != nil {
-		return false, err
-	}
-	
-	hk := &hashInternalKey{
-		key: 		key,
-		version:	meta.version,
-		field: 		field,
-	}
-	encKey := hk.encode()
+	var exist bool
+	// 读取元数据和写入需要在同一个事务中，否则并发的 HSet 会丢失对 size 的更新
+	err := rds.update(func(txn *aperture.Txn) error {
+		meta, err := findMetadata(txn, key, Hash)
+		if err != nil {
+			return err
+		}
 
-	exist := true
-	if _, err := rds.db.Get(encKey); err == aperture.ErrKeyNotFound {
-		exist = false
-	}
-	wb := rds.db.NewWriteBatch(aperture.DefaultWriteBatchOptions)
-	/*
-		需要两步工作：更新元数据，更新数据
-	*/
-	if !exist {
-		meta.size++
-		_ = wb.Put(key, meta.encode())
-	}
-	_ = wb.Put(encKey, value)
-	if err = wb.Commit(); err != nil {
+		hk := &hashInternalKey{
+			key: 		key,
+			version:	meta.version,
+			field: 		field,
+		}
+		encKey := hk.encode()
+
+		exist = true
+		if _, err := txn.Get(encKey); err == aperture.ErrKeyNotFound {
+			exist = false
+		}
+		/*
+			需要两步工作：更新元数据，更新数据
+		*/
+		if !exist {
+			meta.size++
+			_ = txn.Put(key, meta.encode())
+		}
+		return txn.Put(encKey, value)
+	})
+	if err != nil {
 		return false, err
 	}
 	return !exist, nil
@@ -136,60 +145,66 @@ func (rds *RedisDS) HGet(key, field []byte) ([]byte, error) {
 }
 
 func (rds *RedisDS) HDel(key, field []byte) (bool, error) {
-	meta, err := rds.findMetadata(key, Hash)
-	if err != nil {
-		return false, err
-	}
-	if meta.size == 0 {
-		return false, nil
-	}
-	hk := &hashInternalKey{
-		key: 		key,
-		version: 	meta.version,
-		field: 		field,
+	var exist bool
+	err := rds.update(func(txn *aperture.Txn) error {
+		meta, err := findMetadata(txn, key, Hash)
+		if err != nil {
+			return err
+		}
+		if meta.size == 0 {
+			exist = false
+			return nil
+		}
+		hk := &hashInternalKey{
+			key: 		key,
+			version: 	meta.version,
+			field: 		field,
 
-	}
-	encKey := hk.encode()
-	exist := true
-	if _, err := rds.db.Get(encKey); err == aperture.ErrKeyNotFound {
-		exist = false
-	}
-	if exist {
-		wb := rds.db.NewWriteBatch(aperture.DefaultWriteBatchOptions)
-		meta.size--
-		_ = wb.Put(key, meta.encode())
-		_ = wb.Delete(encKey)
-		if err = wb.Commit(); err != nil {
-			return false, err
 		}
+		encKey := hk.encode()
+		exist = true
+		if _, err := txn.Get(encKey); err == aperture.ErrKeyNotFound {
+			exist = false
+		}
+		if exist {
+			meta.size--
+			_ = txn.Put(key, meta.encode())
+			_ = txn.Delete(encKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
 	return exist, nil
 }
 
 func (rds *RedisDS) SAdd(key, member []byte) (bool, error) {
-	meta, err := rds.findMetadata(key, Set)
-	if err != nil {
-		return false, err
-	}
-	sk := &setInternalKey{
-		key:     key,
-		version: meta.version,
-		member:  member,
-	}
-
 	var ok bool
-	if _, err = rds.db.Get(sk.encode()); err == aperture.ErrKeyNotFound {
-		// 不存在的话则更新
-		wb := rds.db.NewWriteBatch(aperture.DefaultWriteBatchOptions)
-		meta.size++
-		_ = wb.Put(key, meta.encode())
-		_ = wb.Put(sk.encode(), nil)
-		if err = wb.Commit(); err != nil {
-			return false, err
+	err := rds.update(func(txn *aperture.Txn) error {
+		meta, err := findMetadata(txn, key, Set)
+		if err != nil {
+			return err
+		}
+		sk := &setInternalKey{
+			key:     key,
+			version: meta.version,
+			member:  member,
 		}
-		ok = true
-	}
 
+		ok = false
+		if _, err = txn.Get(sk.encode()); err == aperture.ErrKeyNotFound {
+			// 不存在的话则更新
+			meta.size++
+			_ = txn.Put(key, meta.encode())
+			_ = txn.Put(sk.encode(), nil)
+			ok = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
 	return ok, nil
 }
 
@@ -219,32 +234,37 @@ func (rds *RedisDS) SIsMember(key, member []byte) (bool, error) {
 }
 
 func (rds *RedisDS) SRem(key, member []byte) (bool, error) {
-	meta, err := rds.findMetadata(key, Set)
-	if err != nil {
-		return false, err
-	}
-	if meta.size == 0 {
-		return false, nil
-	}
+	var ok bool
+	err := rds.update(func(txn *aperture.Txn) error {
+		meta, err := findMetadata(txn, key, Set)
+		if err != nil {
+			return err
+		}
+		ok = false
+		if meta.size == 0 {
+			return nil
+		}
 
-	sk := &setInternalKey{
-		key:     key,
-		version: meta.version,
-		member:  member,
-	}
+		sk := &setInternalKey{
+			key:     key,
+			version: meta.version,
+			member:  member,
+		}
 
-	if _, err = rds.db.Get(sk.encode()); err == aperture.ErrKeyNotFound {
-		return false, nil
-	}
+		if _, err = txn.Get(sk.encode()); err == aperture.ErrKeyNotFound {
+			return nil
+		}
 
-	wb := rds.db.NewWriteBatch(aperture.DefaultWriteBatchOptions)
-	meta.size--
-	_ = wb.Put(key, meta.encode())
-	_ = wb.Delete(sk.encode())
-	if err = wb.Commit(); err != nil {
+		meta.size--
+		_ = txn.Put(key, meta.encode())
+		_ = txn.Delete(sk.encode())
+		ok = true
+		return nil
+	})
+	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return ok, nil
 }
 
 
@@ -409,7 +429,31 @@ func (rds *RedisDS) ZScore(key []byte, member []byte) (float64, error) {
 }
 
 func (rds *RedisDS) findMetadata(key []byte, dataType redisDataType) (*metadata, error) {
-	metaBuf, err := rds.db.Get(key)
+	return findMetadata(rds.db, key, dataType)
+}
+
+// 在乐观事务中执行 fn，提交时发生冲突则重试
+func (rds *RedisDS) update(fn func(txn *aperture.Txn) error) error {
+	for {
+		txn := rds.db.NewTxn(aperture.DefaultTxnOptions)
+		if err := fn(txn); err != nil {
+			txn.Rollback()
+			return err
+		}
+		if err := txn.Commit(); err != aperture.ErrTxnConflict {
+			return err
+		}
+	}
+}
+
+// 可以读取数据的对象，数据库和事务都实现了该接口
+type reader interface {
+	Get(key []byte) ([]byte, error)
+}
+
+// 使用 B+ 树索引时，不存在的 key 由布隆过滤器过滤，不需要查询磁盘上的索引；这时事务没有快照，r 是事务时也一样
+func findMetadata(r reader, key []byte, dataType redisDataType) (*metadata, error) {
+	metaBuf, err := r.Get(key)
 	if err != nil && err != aperture.ErrKeyNotFound {
 		return nil, err
 	}
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,6 +34,13 @@ func TestRedisDataStructure_Get(t *testing.T) {
 
 	_, err = rds.Get(utils.GetTestKey(33))
 	assert.Equal(t, aperture.ErrKeyNotFound, err)
+
+	// 过期之后由存储引擎清理
+	err = rds.Set(utils.GetTestKey(3), time.Millisecond*100, utils.RandomValue(100))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 150)
+	_, err = rds.Get(utils.GetTestKey(3))
+	assert.Equal(t, aperture.ErrKeyNotFound, err)
 }
 
 
@@ -62,3 +70,55 @@ func TestRedisDataStructure_Del_Type(t *testing.T) {
 	assert.Equal(t, aperture.ErrKeyNotFound, err)
 }
 
+
+
+// 并发写入同一个 Hash/Set 时元数据中的 size 不会丢失更新
+func TestRedisDataStructure_Concurrent_HSet_SAdd(t *testing.T) {
+	opts := aperture.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-concurrent")
+	opts.DirPath = dir
+	rds, err := NewRedisDS(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = rds.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	hashKey, setKey := []byte("hash"), []byte("set")
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ok, err := rds.HSet(hashKey, utils.GetTestKey(i*20+j), []byte("v"))
+				assert.Nil(t, err)
+				assert.True(t, ok)
+				ok, err = rds.SAdd(setKey, utils.GetTestKey(i*20+j))
+				assert.Nil(t, err)
+				assert.True(t, ok)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	meta, err := rds.findMetadata(hashKey, Hash)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(200), meta.size)
+	meta, err = rds.findMetadata(setKey, Set)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(200), meta.size)
+
+	ok, err := rds.HDel(hashKey, utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = rds.SRem(setKey, utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = rds.SRem(setKey, utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	meta, err = rds.findMetadata(setKey, Set)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(199), meta.size)
+}
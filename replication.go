@@ -0,0 +1,819 @@
+package aperturekv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/fio"
+	"github.com/minimAluminiumalism/ApertureKV/index"
+)
+
+/*
+主节点把数据文件的内容按 (fileId, offset, bytes) 的片段发送给副本，副本原样追加到自己的数据文件中
+副本连接之后先发送自己数据文件写到的位置，主节点从这个位置开始发送：
++-----+--------+
+| fid | offset |
+|  4  |   8    |
++-----+--------+
+之后主节点发送的每条消息：
++------+-----+--------+-----------+--------+---------+
+| type | fid | offset | remaining | length | payload |
+|  1   |  4  |   8    |     8     |   4    |         |
++------+-----+--------+-----------+--------+---------+
+remaining 是主节点在这条消息之后还没有发送的数据量，副本用它计算落后了多少
+副本请求的位置已经被 merge 掉时，主节点先发送一条 resync 消息，再从头发送现有的所有数据文件，
+副本把这些数据写到单独的目录中，追上主节点之后替换掉本地的数据文件，之后和正常同步一样继续接收
+只复制数据文件，blob 文件不会被复制，所以开启了 BlobThreshold 或者还有 blob 文件的数据库不能提供复制服务，副本也不能开启 BlobThreshold
+复制连接没有认证也没有加密，能连接到复制服务的任何人都可以拿到全部数据，副本也会接受冒充主节点发来的数据，
+所以复制服务只能在可信的网络中使用，跨不可信的网络时需要通过 VPN、SSH 隧道或者 TLS 代理转发
+*/
+const (
+	replicationRequestSize	= 12
+	replicationHeaderSize	= 25
+
+	// 一个片段最多包含的数据量
+	maxReplicationSegmentSize = 1024 * 1024
+	// 没有新数据时主节点发送心跳的间隔，副本超过 3 个间隔没有收到消息时重新连接
+	replicationHeartbeatInterval = time.Second
+	// 副本连接失败之后重试的间隔
+	replicationRetryInterval = time.Millisecond * 200
+)
+
+const (
+	replicationSegment byte = iota + 1
+	replicationHeartbeat
+	replicationError
+	replicationResync
+)
+
+const (
+	resyncDirName			= "-resync"
+	resyncFinishedFileName	= "resync-finished"	// 全量同步的数据已经完整地写到了临时目录中
+	resyncClearedFileName	= "resync-cleared"	// 数据目录中原来的数据文件已经删除了
+)
+
+// 副本的复制状态
+type ReplicaStatus struct {
+	Primary		string		// 主节点的复制地址
+	Connected	bool		// 是否连接到了主节点
+	AppliedSeq	uint64		// 已经应用到索引中的位置，和 Change.Seq 的含义相同
+	LagBytes	int64		// 落后主节点的数据量(Bytes)
+	LastContact	time.Time	// 上一次收到主节点消息的时间
+	Resyncing	bool		// 需要的数据在主节点上已经被 merge 掉了，正在全量同步
+	Err			string		// 上一次复制失败的原因
+}
+
+// 主节点上的复制服务，每个连接上来的副本从自己的位置开始接收数据文件的内容
+type ReplicationServer struct {
+	db			*DB
+	listener	net.Listener
+	mu			sync.Mutex
+	conns		map[net.Conn]struct{}
+	closeCh		chan struct{}
+	closed		bool
+	wg			sync.WaitGroup
+}
+
+// 在 addr 上启动复制服务，数据库关闭时复制服务也会关闭
+// 副本上没有 blob 文件，开启了 BlobThreshold 或者还有没被 GCBlobFiles 回收的 blob 文件时返回 ErrBlobNotReplicated
+func (db *DB) ServeReplication(addr string) (*ReplicationServer, error) {
+	if db.replica != nil {
+		return nil, ErrReadOnlyReplica
+	}
+	db.mu.RLock()
+	hasBlob := db.options.BlobThreshold > 0 || len(db.blobFileList()) > 0
+	db.mu.RUnlock()
+	if hasBlob {
+		return nil, ErrBlobNotReplicated
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &ReplicationServer{
+		db:			db,
+		listener:	listener,
+		conns:		make(map[net.Conn]struct{}),
+		closeCh:	make(chan struct{}),
+	}
+	db.mu.Lock()
+	db.replicationServers[srv] = struct{}{}
+	db.mu.Unlock()
+
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv, nil
+}
+
+// 复制服务监听的地址
+func (srv *ReplicationServer) Addr() net.Addr {
+	return srv.listener.Addr()
+}
+
+// 关闭复制服务，断开所有的副本
+func (srv *ReplicationServer) Close() error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return nil
+	}
+	srv.closed = true
+	close(srv.closeCh)
+	err := srv.listener.Close()
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+
+	srv.db.mu.Lock()
+	delete(srv.db.replicationServers, srv)
+	srv.db.mu.Unlock()
+	return err
+}
+
+func (srv *ReplicationServer) serve() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		srv.conns[conn] = struct{}{}
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+
+		go func() {
+			defer srv.wg.Done()
+			_ = srv.handle(conn)
+
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// 从副本请求的位置开始，持续发送数据文件中新写入的数据
+func (srv *ReplicationServer) handle(conn net.Conn) error {
+	db := srv.db
+	request := make([]byte, replicationRequestSize)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return err
+	}
+	fid := binary.LittleEndian.Uint32(request[:4])
+	offset := int64(binary.LittleEndian.Uint64(request[4:]))
+
+	db.mu.Lock()
+	cursor, err := db.openLogCursor(changeSeq(fid, offset))
+	resync := err == ErrChangesCompacted
+	if resync {
+		// 副本需要的数据已经被 merge 掉了，从头发送现有的所有数据
+		cursor, err = db.openLogCursor(0)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return writeReplicationMessage(conn, replicationError, 0, 0, 0, []byte(err.Error()))
+	}
+	defer func() {
+		db.mu.Lock()
+		db.closeLogCursor(cursor)
+		db.mu.Unlock()
+	}()
+	if resync {
+		if err := writeReplicationMessage(conn, replicationResync, 0, 0, 0, nil); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		segFid, segOffset, payload, remaining, err := srv.readSegment(cursor)
+		if err != nil {
+			return writeReplicationMessage(conn, replicationError, 0, 0, 0, []byte(err.Error()))
+		}
+		if len(payload) > 0 {
+			if err := writeReplicationMessage(conn, replicationSegment, segFid, segOffset, remaining, payload); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-cursor.wakeCh:
+		case <-heartbeat.C:
+			if err := writeReplicationMessage(conn, replicationHeartbeat, 0, 0, remaining, nil); err != nil {
+				return err
+			}
+		case <-srv.closeCh:
+			return nil
+		}
+	}
+}
+
+// 读取 cursor 位置之后的一个片段，没有新数据时返回空的片段
+// 和变更订阅一样只发送已经持久化的数据，读取数据文件时不持有数据库的锁
+func (srv *ReplicationServer) readSegment(cursor *logCursor) (uint32, int64, []byte, int64, error) {
+	db := srv.db
+	dataFile, offset, end, err := db.beginLogRead(cursor)
+	if dataFile == nil {
+		return 0, 0, nil, 0, err
+	}
+
+	size := end - offset
+	if size > maxReplicationSegmentSize {
+		size = maxReplicationSegmentSize
+	}
+	payload, err := dataFile.ReadNBytes(size, offset)
+	if err != nil {
+		return 0, 0, nil, 0, db.endLogRead(cursor, offset, err)
+	}
+	if err := db.endLogRead(cursor, offset+size, nil); err != nil {
+		return 0, 0, nil, 0, err
+	}
+
+	db.mu.RLock()
+	cursor.lock.Lock()
+	remaining, err := db.remainingLogSize(cursor)
+	cursor.lock.Unlock()
+	db.mu.RUnlock()
+	if err != nil {
+		return 0, 0, nil, 0, err
+	}
+	return dataFile.FileId, offset, payload, remaining, nil
+}
+
+// cursor 之后还没有读取的数据量，调用方需要持有数据库的锁，只持有读锁时还需要持有 cursor 的 lock
+func (db *DB) remainingLogSize(cursor *logCursor) (int64, error) {
+	var remaining int64
+	for _, dataFile := range db.dataFiles() {
+		if _, ok := cursor.skipFids[dataFile.FileId]; ok || dataFile.FileId < cursor.fid {
+			continue
+		}
+		end, err := db.logFileEnd(dataFile)
+		if err != nil {
+			return 0, err
+		}
+		if dataFile.FileId == cursor.fid {
+			end -= cursor.offset
+		}
+		remaining += end
+	}
+	return remaining, nil
+}
+
+func writeReplicationMessage(w io.Writer, typ byte, fid uint32, offset, remaining int64, payload []byte) error {
+	buf := make([]byte, replicationHeaderSize+len(payload))
+	buf[0] = typ
+	binary.LittleEndian.PutUint32(buf[1:5], fid)
+	binary.LittleEndian.PutUint64(buf[5:13], uint64(offset))
+	binary.LittleEndian.PutUint64(buf[13:21], uint64(remaining))
+	binary.LittleEndian.PutUint32(buf[21:25], uint32(len(payload)))
+	copy(buf[replicationHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 只读副本，从主节点接收数据文件的内容并追加到本地的数据文件中
+type replica struct {
+	db			*DB
+	primary		string
+	closeCh		chan struct{}
+	wg			sync.WaitGroup
+	connMu		sync.Mutex
+	conn		net.Conn
+
+	resync		*replicaResync	// 正在进行的全量同步，只在同步的 goroutine 中使用
+
+	// 以下字段由数据库的锁保护
+	replayer	*logReplayer
+	tail		[]byte	// 收到的不完整的数据记录，等收到完整的记录之后再写入数据文件
+	status		ReplicaStatus
+}
+
+// 全量同步时从主节点收到的数据先写到单独的目录中，替换之前副本仍然使用原来的数据提供读取
+type replicaResync struct {
+	dir			string
+	activeFile	*data.DataFile
+	tail		[]byte
+}
+
+func newReplica(db *DB, primary string) *replica {
+	return &replica{
+		db:			db,
+		primary:	primary,
+		closeCh:	make(chan struct{}),
+		replayer:	newLogReplayer(db),
+		status:		ReplicaStatus{Primary: primary},
+	}
+}
+
+func (r *replica) start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+func (r *replica) stop() {
+	close(r.closeCh)
+	r.connMu.Lock()
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+	r.connMu.Unlock()
+	r.wg.Wait()
+}
+
+// 断开之后不断重连，直到副本关闭
+// 同步过程中需要的数据被 merge 掉时，重连之后主节点会进行全量同步
+func (r *replica) run() {
+	defer r.wg.Done()
+	for {
+		err := r.sync()
+		r.db.mu.Lock()
+		r.status.Connected = false
+		r.tail = nil
+		if err != nil {
+			r.status.Err = err.Error()
+		}
+		r.db.mu.Unlock()
+
+		select {
+		case <-r.closeCh:
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+func (r *replica) sync() error {
+	conn, err := net.DialTimeout("tcp", r.primary, replicationHeartbeatInterval)
+	if err != nil {
+		return err
+	}
+	r.connMu.Lock()
+	select {
+	case <-r.closeCh:
+		r.connMu.Unlock()
+		return conn.Close()
+	default:
+	}
+	r.conn = conn
+	r.connMu.Unlock()
+	defer func() {
+		r.connMu.Lock()
+		r.conn = nil
+		r.connMu.Unlock()
+		_ = conn.Close()
+		// 没有完成的全量同步直接丢弃，重连之后重新开始
+		r.discardResync()
+	}()
+
+	// 从本地数据文件写到的位置开始接收
+	request := make([]byte, replicationRequestSize)
+	r.db.mu.Lock()
+	if activeFile := r.db.activeFile; activeFile != nil {
+		binary.LittleEndian.PutUint32(request[:4], activeFile.FileId)
+		binary.LittleEndian.PutUint64(request[4:], uint64(activeFile.WriteOff))
+	}
+	r.status.AppliedSeq = r.db.syncPosition()
+	r.status.Connected = true
+	r.db.mu.Unlock()
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, replicationHeaderSize)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(replicationHeartbeatInterval * 3)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		typ := header[0]
+		fid := binary.LittleEndian.Uint32(header[1:5])
+		offset := int64(binary.LittleEndian.Uint64(header[5:13]))
+		remaining := int64(binary.LittleEndian.Uint64(header[13:21]))
+		payload := make([]byte, binary.LittleEndian.Uint32(header[21:25]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return err
+		}
+
+		if typ == replicationError {
+			if string(payload) == ErrChangesCompacted.Error() {
+				return ErrChangesCompacted
+			}
+			return errors.New(string(payload))
+		}
+		if typ == replicationResync {
+			if err := r.startResync(); err != nil {
+				return err
+			}
+			continue
+		}
+		if r.resync != nil {
+			if err := r.stage(typ, fid, offset, remaining, payload); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.apply(typ, fid, offset, remaining, payload); err != nil {
+			return err
+		}
+	}
+}
+
+// 将收到的片段追加到数据文件中，并用和启动时加载索引相同的方式更新索引
+func (r *replica) apply(typ byte, fid uint32, offset, remaining int64, payload []byte) error {
+	db := r.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r.status.LastContact = time.Now()
+	r.status.LagBytes = remaining + int64(len(r.tail))
+	if typ != replicationSegment {
+		return nil
+	}
+
+	// 片段需要接在本地数据文件的末尾，切换到新的数据文件时从头开始
+	activeFile := db.activeFile
+	if activeFile == nil || fid != activeFile.FileId {
+		if offset != 0 || len(r.tail) > 0 || (activeFile != nil && fid < activeFile.FileId) {
+			return ErrReplicaDiverged
+		}
+		if err := r.rotate(fid); err != nil {
+			return err
+		}
+		activeFile = db.activeFile
+	} else if offset != activeFile.WriteOff+int64(len(r.tail)) {
+		return ErrReplicaDiverged
+	}
+
+	// 只把完整的数据记录写入数据文件，重启之后从数据文件末尾继续接收
+	buf := append(r.tail, payload...)
+	var consumed int64
+	var logRecords []*data.LogRecord
+	var positions []*data.LogRecordPos
+	for {
+		logRecord, size, err := data.DecodeLogRecord(buf[consumed:], db.encryptor)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		logRecords = append(logRecords, logRecord)
+		positions = append(positions, &data.LogRecordPos{
+			Fid:	fid,
+			Offset:	activeFile.WriteOff + consumed,
+			Size:	uint32(size),
+			Expire:	logRecord.Expire,
+		})
+		consumed += size
+	}
+	if consumed > 0 {
+		if err := activeFile.Write(buf[:consumed]); err != nil {
+			return err
+		}
+		if db.options.SyncWrites {
+			if err := activeFile.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	r.tail = append([]byte(nil), buf[consumed:]...)
+
+	for i, logRecord := range logRecords {
+		r.replayer.replay(logRecord, positions[i])
+	}
+	if r.replayer.seqNo > db.seqNo {
+		db.seqNo = r.replayer.seqNo
+	}
+	db.collectExpired()
+	db.notifyLogCursors()
+
+	r.status.AppliedSeq = changeSeq(fid, activeFile.WriteOff)
+	r.status.LagBytes = remaining + int64(len(r.tail))
+	return nil
+}
+
+// 切换到主节点的下一个数据文件，调用方需要持有数据库的锁
+func (r *replica) rotate(fid uint32) error {
+	db := r.db
+	if db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
+		db.olderFiles[db.activeFile.FileId] = db.activeFile
+	}
+	dataFile, err := db.openDataFile(db.options.DirPath, fid, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	db.activeFile = dataFile
+	return nil
+}
+
+// 开始全量同步，之后收到的片段写到临时目录中
+func (r *replica) startResync() error {
+	r.discardResync()
+	dir := resyncPath(r.db.options.DirPath)
+	// 上一次替换数据文件失败了，需要重新打开数据库完成替换
+	if _, err := os.Stat(filepath.Join(dir, resyncFinishedFileName)); err == nil {
+		return ErrResyncPending
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	r.resync = &replicaResync{dir: dir}
+	r.db.mu.Lock()
+	r.status.Resyncing = true
+	r.db.mu.Unlock()
+	return nil
+}
+
+// 丢弃没有完成的全量同步
+func (r *replica) discardResync() {
+	if r.resync == nil {
+		return
+	}
+	if r.resync.activeFile != nil {
+		_ = r.resync.activeFile.Close()
+	}
+	_ = os.RemoveAll(r.resync.dir)
+	r.resync = nil
+	r.db.mu.Lock()
+	r.status.Resyncing = false
+	r.db.mu.Unlock()
+}
+
+// 全量同步时把收到的片段追加到临时目录中的数据文件，追上主节点之后替换掉本地的数据文件
+func (r *replica) stage(typ byte, fid uint32, offset, remaining int64, payload []byte) error {
+	db := r.db
+	rs := r.resync
+	if typ == replicationSegment {
+		if rs.activeFile == nil || fid != rs.activeFile.FileId {
+			if offset != 0 || len(rs.tail) > 0 || (rs.activeFile != nil && fid < rs.activeFile.FileId) {
+				return ErrReplicaDiverged
+			}
+			if err := rs.rotate(fid); err != nil {
+				return err
+			}
+		} else if offset != rs.activeFile.WriteOff+int64(len(rs.tail)) {
+			return ErrReplicaDiverged
+		}
+
+		// 和正常同步一样只写入完整的数据记录，替换之后从数据文件末尾继续接收
+		buf := append(rs.tail, payload...)
+		var consumed int64
+		for {
+			_, size, err := data.DecodeLogRecord(buf[consumed:], db.encryptor)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			consumed += size
+		}
+		if consumed > 0 {
+			if err := rs.activeFile.Write(buf[:consumed]); err != nil {
+				return err
+			}
+		}
+		rs.tail = append([]byte(nil), buf[consumed:]...)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r.status.LastContact = time.Now()
+	r.status.LagBytes = remaining + int64(len(rs.tail))
+	// 替换之后副本读到的是收到的这部分数据，可能比原来的数据还旧，所以和主节点相差不到一个片段时才替换
+	// merge 和备份期间不能替换数据文件，等它们结束之后再替换
+	if remaining > maxReplicationSegmentSize || db.isMerging || db.isBackingUp {
+		return nil
+	}
+	return r.finishResync()
+}
+
+func (rs *replicaResync) rotate(fid uint32) error {
+	if rs.activeFile != nil {
+		if err := rs.activeFile.Sync(); err != nil {
+			return err
+		}
+		if err := rs.activeFile.Close(); err != nil {
+			return err
+		}
+	}
+	dataFile, err := data.OpenDataFile(rs.dir, fid, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	rs.activeFile = dataFile
+	return nil
+}
+
+// 用全量同步收到的数据替换本地的数据文件，并重新构建索引，调用方需要持有数据库的锁
+// 之前的变更 Seq 不再有效，正在进行的订阅会返回 ErrChangesCompacted
+func (r *replica) finishResync() error {
+	db := r.db
+	rs := r.resync
+	if rs.activeFile != nil {
+		if err := rs.activeFile.Sync(); err != nil {
+			return err
+		}
+		if err := rs.activeFile.Close(); err != nil {
+			return err
+		}
+		rs.activeFile = nil
+	}
+	// 标识文件写入之后，替换的过程中崩溃时重启会继续完成替换
+	if err := writeMarkerFile(filepath.Join(rs.dir, resyncFinishedFileName)); err != nil {
+		return err
+	}
+	r.resync = nil
+
+	for c := range db.logCursors {
+		c.err = ErrChangesCompacted
+	}
+	db.notifyLogCursors()
+	if err := db.resetIndex(); err != nil {
+		return err
+	}
+	for _, dataFile := range db.dataFiles() {
+		if err := db.retireDataFile(dataFile); err != nil {
+			return err
+		}
+	}
+	db.activeFile = nil
+	db.olderFiles = make(map[uint32]*data.DataFile)
+	db.reclaimSize = 0
+	db.fileReclaimSize = make(map[uint32]int64)
+	db.expires = nil
+	db.expireItems = make(map[string]*expireItem)
+	db.rewrittenFids = make(map[uint32]struct{})
+	r.replayer = newLogReplayer(db)
+	if err := applyResyncFiles(db.options.DirPath, rs.dir); err != nil {
+		return err
+	}
+	if err := db.load(); err != nil {
+		return err
+	}
+
+	// 替换进来的数据都已经 sync 过了
+	db.compactedSeq = db.syncPosition()
+	db.syncMu.Lock()
+	db.syncedSeq = db.compactedSeq
+	db.syncMu.Unlock()
+	r.tail = rs.tail
+	r.status.Resyncing = false
+	r.status.AppliedSeq = db.syncPosition()
+	return nil
+}
+
+// 副本上可以 merge 的数据文件的上限，调用方需要持有数据库的锁
+// 活跃文件之后还会继续接收主节点的数据；没有读到完成标识的事务数据之后会被加入索引，它们所在的数据文件也不能 merge
+func (r *replica) mergeLimit() uint32 {
+	limit := r.db.activeFile.FileId
+	for _, txnRecords := range r.replayer.transactionRecords {
+		for _, txnRecord := range txnRecords {
+			if txnRecord.Pos.Fid < limit {
+				limit = txnRecord.Pos.Fid
+			}
+		}
+	}
+	return limit
+}
+
+// 清空索引，调用方需要持有数据库的锁
+func (db *DB) resetIndex() error {
+	if _, ok := db.index.(*index.BPlusTree); ok {
+		// B+ 树索引保存在磁盘上，快照可能还在读取，只能逐个删除
+		var keys [][]byte
+		iterator := db.index.Iterator(false)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			keys = append(keys, iterator.Key())
+		}
+		iterator.Close()
+		for _, key := range keys {
+			db.index.Delete(key)
+		}
+		return db.indexErr()
+	}
+	indexer, err := index.NewIndexer(db.options.IndexType, db.options.DirPath, db.options.SyncWrites, db.encryptor)
+	if err != nil {
+		return err
+	}
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+	db.index = indexer
+	return nil
+}
+
+func resyncPath(dirPath string) string {
+	dir := path.Dir(path.Clean(dirPath))
+	base := path.Base(dirPath)
+	return filepath.Join(dir, base+resyncDirName)
+}
+
+// 打开数据库时继续完成没有完成的全量同步，没有完整收到的数据直接丢弃
+// B+ 树索引中还是原来的数据，需要删除之后从数据文件重新构建
+func recoverResync(options Options) error {
+	dir := resyncPath(options.DirPath)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, resyncFinishedFileName)); err == nil && options.IndexType == BPlusTree {
+		if err := os.Remove(filepath.Join(options.DirPath, index.BPTreeIndexFileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return applyResyncFiles(options.DirPath, dir)
+}
+
+// 用临时目录中的数据文件替换掉数据目录中的数据文件、hint 文件和 merge 完成标识
+// 失败时保留临时目录，重新打开数据库时继续替换
+func applyResyncFiles(dirPath, resyncDir string) error {
+	if _, err := os.Stat(filepath.Join(resyncDir, resyncFinishedFileName)); os.IsNotExist(err) {
+		return os.RemoveAll(resyncDir)
+	}
+
+	// 已经移动进来的数据文件不能再被删除
+	if _, err := os.Stat(filepath.Join(resyncDir, resyncClearedFileName)); os.IsNotExist(err) {
+		dirEntries, err := os.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range dirEntries {
+			name := entry.Name()
+			if strings.HasSuffix(name, data.DataFileNameSuffix) || name == data.HintFileName || name == data.MergeFinishedFileName || name == data.MergeRewrittenFileName {
+				if err := os.Remove(filepath.Join(dirPath, name)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := writeMarkerFile(filepath.Join(resyncDir, resyncClearedFileName)); err != nil {
+			return err
+		}
+	}
+
+	dirEntries, err := os.ReadDir(resyncDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(resyncDir, entry.Name()), filepath.Join(dirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(resyncDir)
+}
+
+func writeMarkerFile(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 关闭所有的复制服务，不能持有数据库的锁
+func (db *DB) closeReplicationServers() {
+	db.mu.RLock()
+	servers := make([]*ReplicationServer, 0, len(db.replicationServers))
+	for srv := range db.replicationServers {
+		servers = append(servers, srv)
+	}
+	db.mu.RUnlock()
+	for _, srv := range servers {
+		_ = srv.Close()
+	}
+}
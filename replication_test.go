@@ -0,0 +1,367 @@
+package aperturekv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// 等待副本追上主节点当前写到的位置
+func waitForReplica(t *testing.T, primary, replica *DB) {
+	primary.mu.RLock()
+	end := changeSeq(primary.activeFile.FileId, primary.activeFile.WriteOff)
+	primary.mu.RUnlock()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		status := replica.Stat().Replica
+		if status.AppliedSeq == end && status.LagBytes == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("replica did not catch up, status: %+v", replica.Stat().Replica)
+}
+
+func assertSameData(t *testing.T, primary, replica *DB) {
+	assert.Equal(t, primary.ListKeys(), replica.ListKeys())
+	err := primary.Fold(func(key []byte, value []byte) bool {
+		replicaValue, err := replica.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, replicaValue)
+		return true
+	})
+	assert.Nil(t, err)
+}
+
+func TestDB_Replication(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-1")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	primary, err := Open(opts)
+	defer destroyDB(primary)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := primary.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	srv, err := primary.ServeReplication("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	replicaOpts := DefaultOptions
+	replicaDir, _ := os.MkdirTemp("", "bitcask-go-replica-1")
+	replicaOpts.DirPath = replicaDir
+	replicaOpts.DataFileSize = opts.DataFileSize
+	replicaOpts.ReplicaOf = srv.Addr().String()
+	replica, err := Open(replicaOpts)
+	assert.Nil(t, err)
+	waitForReplica(t, primary, replica)
+	assertSameData(t, primary, replica)
+
+	// 新的写入、删除、过期时间和 WriteBatch 都会同步到副本
+	for i := 0; i < 100; i++ {
+		err := primary.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = primary.PutWithTTL(utils.GetTestKey(2000), []byte("ttl"), time.Hour)
+	assert.Nil(t, err)
+	wb := primary.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1000; i < 1500; i++ {
+		_ = wb.Put(utils.GetTestKey(i), utils.RandomValue(64))
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	waitForReplica(t, primary, replica)
+	assertSameData(t, primary, replica)
+	ttl, err := replica.TTL(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59)
+
+	status := replica.Stat().Replica
+	assert.True(t, status.Connected)
+	assert.Equal(t, srv.Addr().String(), status.Primary)
+	assert.False(t, status.LastContact.IsZero())
+
+	// 副本是只读的
+	err = replica.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Equal(t, ErrReadOnlyReplica, err)
+	err = replica.Delete(utils.GetTestKey(200))
+	assert.Equal(t, ErrReadOnlyReplica, err)
+	wb = replica.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Equal(t, ErrReadOnlyReplica, wb.Commit())
+	// SelectiveMerge 会把数据重写到新的数据文件中，副本上只能使用 Merge
+	assert.Equal(t, ErrReadOnlyReplica, replica.SelectiveMerge(SelectiveMergeOptions{FileReclaimRatio: 0.5}))
+
+	// 副本重启之后从本地数据文件的末尾继续接收
+	err = replica.Close()
+	assert.Nil(t, err)
+	for i := 1500; i < 2000; i++ {
+		err := primary.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	replica, err = Open(replicaOpts)
+	assert.Nil(t, err)
+	waitForReplica(t, primary, replica)
+	assertSameData(t, primary, replica)
+	destroyDB(replica)
+}
+
+// 主节点 merge 之后，已经同步的副本继续接收新的写入，新的副本可以从 merge 之后的数据开始同步
+func TestDB_Replication_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	primary, err := Open(opts)
+	defer destroyDB(primary)
+	assert.Nil(t, err)
+	srv, err := primary.ServeReplication("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	replicaOpts := DefaultOptions
+	replicaDir, _ := os.MkdirTemp("", "bitcask-go-replica-2")
+	replicaOpts.DirPath = replicaDir
+	replicaOpts.ReplicaOf = srv.Addr().String()
+	replica, err := Open(replicaOpts)
+	defer destroyDB(replica)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := primary.Put(utils.GetTestKey(i%500), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	waitForReplica(t, primary, replica)
+
+	err = primary.Merge()
+	assert.Nil(t, err)
+	for i := 500; i < 600; i++ {
+		err := primary.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	waitForReplica(t, primary, replica)
+	assertSameData(t, primary, replica)
+
+	newReplicaOpts := replicaOpts
+	newReplicaOpts.DirPath, _ = os.MkdirTemp("", "bitcask-go-replica-3")
+	newReplica, err := Open(newReplicaOpts)
+	defer destroyDB(newReplica)
+	assert.Nil(t, err)
+	waitForReplica(t, primary, newReplica)
+	assertSameData(t, primary, newReplica)
+}
+
+// 副本需要的数据在主节点上已经被 merge 掉时，重连之后全量同步
+func TestDB_Replication_Resync(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-3")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	primary, err := Open(opts)
+	defer destroyDB(primary)
+	assert.Nil(t, err)
+	srv, err := primary.ServeReplication("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	replicaOpts := DefaultOptions
+	replicaDir, _ := os.MkdirTemp("", "bitcask-go-replica-4")
+	replicaOpts.DirPath = replicaDir
+	replicaOpts.DataFileSize = opts.DataFileSize
+	replicaOpts.ReplicaOf = srv.Addr().String()
+	replica, err := Open(replicaOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := primary.Put(utils.GetTestKey(i%500), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	waitForReplica(t, primary, replica)
+	sub, err := replica.Subscribe(0)
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	// 副本断开期间主节点的写入被 merge 掉了
+	err = replica.Close()
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := primary.Put(utils.GetTestKey(i%600), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := primary.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = primary.Merge()
+	assert.Nil(t, err)
+	for i := 600; i < 700; i++ {
+		err := primary.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+
+	replica, err = Open(replicaOpts)
+	assert.Nil(t, err)
+	waitForReplica(t, primary, replica)
+	assertSameData(t, primary, replica)
+	status := replica.Stat().Replica
+	assert.False(t, status.Resyncing)
+	assert.Equal(t, "", status.Err)
+	_, err = os.Stat(resyncPath(replicaDir))
+	assert.True(t, os.IsNotExist(err))
+
+	// 全量同步之后继续接收新的写入，重启之后也不需要再全量同步
+	for i := 700; i < 800; i++ {
+		err := primary.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	waitForReplica(t, primary, replica)
+	assertSameData(t, primary, replica)
+	err = replica.Close()
+	assert.Nil(t, err)
+	replica, err = Open(replicaOpts)
+	assert.Nil(t, err)
+	assertSameData(t, primary, replica)
+	waitForReplica(t, primary, replica)
+	assert.False(t, replica.Stat().Replica.Resyncing)
+	destroyDB(replica)
+}
+
+// 全量同步收完数据之后、替换数据文件的过程中崩溃，重启时继续完成替换
+func TestDB_Replication_RecoverResync(t *testing.T) {
+	// 副本原来的数据
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-4")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(5000+i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 全量同步收到的数据
+	resyncOpts := DefaultOptions
+	resyncOpts.DirPath, _ = os.MkdirTemp("", "bitcask-go-replication-resync")
+	resyncOpts.DataFileSize = 32 * 1024
+	resyncDB, err := Open(resyncOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := resyncDB.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = resyncDB.Close()
+	assert.Nil(t, err)
+	resyncDir := resyncPath(dir)
+	err = os.Rename(resyncOpts.DirPath, resyncDir)
+	assert.Nil(t, err)
+	err = writeMarkerFile(filepath.Join(resyncDir, resyncFinishedFileName))
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(5000))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = os.Stat(resyncDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// 副本可以 merge 已经接收完的旧数据文件，merge 之后继续从主节点接收数据
+func TestDB_Replication_ReplicaMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-5")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	primary, err := Open(opts)
+	defer destroyDB(primary)
+	assert.Nil(t, err)
+	srv, err := primary.ServeReplication("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	replicaOpts := DefaultOptions
+	replicaDir, _ := os.MkdirTemp("", "bitcask-go-replica-5")
+	replicaOpts.DirPath = replicaDir
+	replicaOpts.DataFileSize = opts.DataFileSize
+	replicaOpts.DataFileMergeRatio = 0
+	replicaOpts.ReplicaOf = srv.Addr().String()
+	replica, err := Open(replicaOpts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3000; i++ {
+		err := primary.Put(utils.GetTestKey(i%300), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	waitForReplica(t, primary, replica)
+	sizeBefore := replica.Stat().DiskSize
+	replica.mu.RLock()
+	activeFid := replica.activeFile.FileId
+	replica.mu.RUnlock()
+
+	err = replica.Merge()
+	assert.Nil(t, err)
+	assert.True(t, replica.Stat().DiskSize < sizeBefore)
+	replica.mu.RLock()
+	assert.Equal(t, activeFid, replica.activeFile.FileId)
+	replica.mu.RUnlock()
+	assertSameData(t, primary, replica)
+
+	for i := 300; i < 600; i++ {
+		err := primary.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	waitForReplica(t, primary, replica)
+	assertSameData(t, primary, replica)
+
+	// 重启之后从 hint 文件加载 merge 过的数据
+	err = replica.Close()
+	assert.Nil(t, err)
+	replica, err = Open(replicaOpts)
+	assert.Nil(t, err)
+	assertSameData(t, primary, replica)
+	waitForReplica(t, primary, replica)
+	destroyDB(replica)
+}
+
+// blob 文件不会被复制，开启了 BlobThreshold 的数据库不能提供复制服务
+func TestDB_Replication_Blob(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-6")
+	opts.DirPath = dir
+	opts.BlobThreshold = 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = db.ServeReplication("127.0.0.1:0")
+	assert.Equal(t, ErrBlobNotReplicated, err)
+
+	// 关闭 BlobThreshold 之后，已有的 blob 文件被回收之前仍然不能复制
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(2048))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.BlobThreshold = 0
+	opts.BlobGCRatio = 0.5
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	_, err = db.ServeReplication("127.0.0.1:0")
+	assert.Equal(t, ErrBlobNotReplicated, err)
+
+	// 副本也不能开启 BlobThreshold
+	replicaOpts := DefaultOptions
+	replicaOpts.DirPath, _ = os.MkdirTemp("", "bitcask-go-replication-7")
+	defer os.RemoveAll(replicaOpts.DirPath)
+	replicaOpts.ReplicaOf = "127.0.0.1:1"
+	replicaOpts.BlobThreshold = 1024
+	_, err = Open(replicaOpts)
+	assert.Equal(t, ErrBlobNotReplicated, err)
+}
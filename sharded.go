@@ -0,0 +1,359 @@
+package aperturekv
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 记录分片数量的文件，分片数量改变之后 key 会被路由到其他分片，不能再打开
+const shardMetaFileName = "shard-meta"
+
+// ShardedDB 按 key 的哈希把数据分散到 N 个独立的 DB 中，每个分片有自己的锁和活跃文件，写入可以并行
+// 跨分片的遍历按 key 归并排序，但每个分片的快照是分别获取的，不是整个数据库的一致性快照
+type ShardedDB struct {
+	shards	[]*DB
+}
+
+// OpenSharded 在 options.DirPath 下打开 shardNum 个分片，每个分片使用相同的配置项
+func OpenSharded(options Options, shardNum int) (*ShardedDB, error) {
+	if shardNum <= 0 {
+		return nil, errors.New("shard number must be larger than 0")
+	}
+	// 每个分片需要单独复制，一个主节点地址无法对应多个分片
+	if options.ReplicaOf != "" {
+		return nil, errors.New("sharded database can not be opened as a replica")
+	}
+	if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := checkShardNum(options.DirPath, shardNum); err != nil {
+		return nil, err
+	}
+
+	s := &ShardedDB{}
+	for i := 0; i < shardNum; i++ {
+		shardOptions := options
+		shardOptions.DirPath = filepath.Join(options.DirPath, fmt.Sprintf("shard-%03d", i))
+		db, err := Open(shardOptions)
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, db)
+	}
+	return s, nil
+}
+
+// 第一次打开时记录分片数量，之后打开时必须一致
+func checkShardNum(dirPath string, shardNum int) error {
+	path := filepath.Join(dirPath, shardMetaFileName)
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return os.WriteFile(path, []byte(strconv.Itoa(shardNum)), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	num, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return ErrDataDirectoryCorrupted
+	}
+	if num != shardNum {
+		return ErrShardNumMismatch
+	}
+	return nil
+}
+
+func (s *ShardedDB) Close() error {
+	var firstErr error
+	for _, db := range s.shards {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *ShardedDB) Sync() error {
+	for _, db := range s.shards {
+		if err := db.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 每个分片的统计信息
+func (s *ShardedDB) Stat() []*Stat {
+	stats := make([]*Stat, len(s.shards))
+	for i, db := range s.shards {
+		stats[i] = db.Stat()
+	}
+	return stats
+}
+
+// key 所在的分片，WriteBatch 中的 key 需要在同一个分片中
+func (s *ShardedDB) ShardOf(key []byte) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// 返回第 i 个分片，可以在单个分片上使用事务等操作
+func (s *ShardedDB) Shard(i int) *DB {
+	return s.shards[i]
+}
+
+func (s *ShardedDB) ShardNum() int {
+	return len(s.shards)
+}
+
+func (s *ShardedDB) shardOf(key []byte) *DB {
+	return s.shards[s.ShardOf(key)]
+}
+
+func (s *ShardedDB) Put(key []byte, value []byte) error {
+	return s.shardOf(key).Put(key, value)
+}
+
+func (s *ShardedDB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return s.shardOf(key).PutWithTTL(key, value, ttl)
+}
+
+func (s *ShardedDB) Expire(key []byte, ttl time.Duration) error {
+	return s.shardOf(key).Expire(key, ttl)
+}
+
+func (s *ShardedDB) TTL(key []byte) (time.Duration, error) {
+	return s.shardOf(key).TTL(key)
+}
+
+func (s *ShardedDB) Delete(key []byte) error {
+	return s.shardOf(key).Delete(key)
+}
+
+func (s *ShardedDB) Get(key []byte) ([]byte, error) {
+	return s.shardOf(key).Get(key)
+}
+
+// 按 key 的顺序返回所有分片中的 key
+func (s *ShardedDB) ListKeys() [][]byte {
+	iterator := s.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	var keys [][]byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+	}
+	return keys
+}
+
+// 按 key 的顺序遍历所有分片中的数据，fn 返回 false 时终止遍历
+func (s *ShardedDB) Fold(fn func(key []byte, value []byte) bool) error {
+	iterator := s.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// 并行 merge 所有的分片，无效数据没有达到比例的分片会跳过
+func (s *ShardedDB) Merge() error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, db := range s.shards {
+		wg.Add(1)
+		go func(i int, db *DB) {
+			defer wg.Done()
+			errs[i] = db.Merge()
+		}(i, db)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && err != ErrMergeRatioUnreached {
+			return err
+		}
+	}
+	return nil
+}
+
+// 只能写入同一个分片的 WriteBatch，提交时在这个分片上原子地生效
+type ShardedWriteBatch struct {
+	db		*ShardedDB
+	options	WriteBatchOptions
+	mu		sync.Mutex
+	shard	int	// 第一个写入的 key 所在的分片，还没有写入时为 -1
+	batch	*WriteBatch
+}
+
+func (s *ShardedDB) NewWriteBatch(opts WriteBatchOptions) *ShardedWriteBatch {
+	return &ShardedWriteBatch{db: s, options: opts, shard: -1}
+}
+
+// 返回 key 所在分片的 WriteBatch，和之前写入的 key 不在同一个分片时返回 ErrBatchSpansShards
+func (wb *ShardedWriteBatch) shardBatch(key []byte) (*WriteBatch, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	shard := wb.db.ShardOf(key)
+	if wb.shard == -1 {
+		wb.shard = shard
+		wb.batch = wb.db.shards[shard].NewWriteBatch(wb.options)
+	}
+	if shard != wb.shard {
+		return nil, ErrBatchSpansShards
+	}
+	return wb.batch, nil
+}
+
+func (wb *ShardedWriteBatch) Put(key []byte, value []byte) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	batch, err := wb.shardBatch(key)
+	if err != nil {
+		return err
+	}
+	return batch.Put(key, value)
+}
+
+func (wb *ShardedWriteBatch) Delete(key []byte) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	batch, err := wb.shardBatch(key)
+	if err != nil {
+		return err
+	}
+	return batch.Delete(key)
+}
+
+// 提交之后可以写入其他分片的 key
+func (wb *ShardedWriteBatch) Commit() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if wb.batch == nil {
+		return nil
+	}
+	if err := wb.batch.Commit(); err != nil {
+		return err
+	}
+	wb.shard, wb.batch = -1, nil
+	return nil
+}
+
+// 跨分片的迭代器，每次返回所有分片中最小（反向遍历时最大）的 key
+type ShardedIterator struct {
+	iters	[]*Iterator
+	heap	shardIterHeap
+}
+
+func (s *ShardedDB) NewIterator(opts IteratorOptions) *ShardedIterator {
+	it := &ShardedIterator{heap: shardIterHeap{reverse: opts.Reverse}}
+	for _, db := range s.shards {
+		it.iters = append(it.iters, db.NewIterator(opts))
+	}
+	return it
+}
+
+func (it *ShardedIterator) Rewind() {
+	for _, iter := range it.iters {
+		iter.Rewind()
+	}
+	it.resetHeap()
+}
+
+func (it *ShardedIterator) Seek(key []byte) {
+	for _, iter := range it.iters {
+		iter.Seek(key)
+	}
+	it.resetHeap()
+}
+
+func (it *ShardedIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	top := it.heap.iters[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(&it.heap, 0)
+	} else {
+		heap.Pop(&it.heap)
+	}
+}
+
+func (it *ShardedIterator) Valid() bool {
+	return len(it.heap.iters) > 0
+}
+
+func (it *ShardedIterator) Key() []byte {
+	return it.heap.iters[0].Key()
+}
+
+func (it *ShardedIterator) Value() ([]byte, error) {
+	return it.heap.iters[0].Value()
+}
+
+func (it *ShardedIterator) Close() {
+	for _, iter := range it.iters {
+		iter.Close()
+	}
+}
+
+func (it *ShardedIterator) resetHeap() {
+	it.heap.iters = it.heap.iters[:0]
+	for _, iter := range it.iters {
+		if iter.Valid() {
+			it.heap.iters = append(it.heap.iters, iter)
+		}
+	}
+	heap.Init(&it.heap)
+}
+
+// 按各个分片迭代器当前的 key 排序，不同分片中的 key 不会重复
+type shardIterHeap struct {
+	iters	[]*Iterator
+	reverse	bool
+}
+
+func (h shardIterHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h shardIterHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h shardIterHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *shardIterHeap) Push(x interface{}) {
+	h.iters = append(h.iters, x.(*Iterator))
+}
+
+func (h *shardIterHeap) Pop() interface{} {
+	old := h.iters
+	iter := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.iters = old[:len(old)-1]
+	return iter
+}
@@ -0,0 +1,160 @@
+package aperturekv
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func destroyShardedDB(s *ShardedDB, dir string) {
+	if s != nil {
+		_ = s.Close()
+	}
+	_ = os.RemoveAll(dir)
+}
+
+func TestShardedDB_PutGetDelete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-1")
+	opts.DirPath = dir
+	s, err := OpenSharded(opts, 8)
+	defer func() {
+		destroyShardedDB(s, dir)
+	}()
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := s.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := s.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = s.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := s.Get(utils.GetTestKey(500))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(500), val)
+
+	// 数据分散在所有分片中
+	for _, stat := range s.Stat() {
+		assert.True(t, stat.KeyNum > 0)
+	}
+
+	// 重启之后数据仍然在原来的分片中，分片数量不同时无法打开
+	err = s.Close()
+	assert.Nil(t, err)
+	_, err = OpenSharded(opts, 4)
+	assert.Equal(t, ErrShardNumMismatch, err)
+	s, err = OpenSharded(opts, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 900, len(s.ListKeys()))
+	val, err = s.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(999), val)
+}
+
+func TestShardedDB_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-2")
+	opts.DirPath = dir
+	s, err := OpenSharded(opts, 4)
+	defer destroyShardedDB(s, dir)
+	assert.Nil(t, err)
+
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		key := utils.GetTestKey(i)
+		keys = append(keys, key)
+		err := s.Put(key, key)
+		assert.Nil(t, err)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	assert.Equal(t, keys, s.ListKeys())
+
+	// 反向遍历
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Reverse = true
+	iter := s.NewIterator(iterOpts)
+	i := len(keys) - 1
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[i], iter.Key())
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, keys[i], val)
+		i--
+	}
+	assert.Equal(t, -1, i)
+	iter.Close()
+
+	// Seek 和前缀
+	iter = s.NewIterator(DefaultIteratorOptions)
+	iter.Seek(keys[100])
+	assert.True(t, iter.Valid())
+	assert.Equal(t, keys[100], iter.Key())
+	iter.Close()
+
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Prefix = []byte("bitcask-go-key-00000001")
+	iter = s.NewIterator(iterOpts)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.True(t, bytes.HasPrefix(iter.Key(), iterOpts.Prefix))
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 10, count)
+}
+
+func TestShardedDB_WriteBatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded-3")
+	opts.DirPath = dir
+	s, err := OpenSharded(opts, 4)
+	defer destroyShardedDB(s, dir)
+	assert.Nil(t, err)
+
+	// 找到两个在同一个分片和一个在其他分片的 key
+	var sameShard [][]byte
+	var otherShard []byte
+	for i := 0; len(sameShard) < 2 || otherShard == nil; i++ {
+		key := utils.GetTestKey(i)
+		if s.ShardOf(key) == s.ShardOf(utils.GetTestKey(0)) {
+			sameShard = append(sameShard, key)
+		} else if otherShard == nil {
+			otherShard = key
+		}
+	}
+
+	wb := s.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(sameShard[0], []byte("a"))
+	assert.Nil(t, err)
+	err = wb.Put(sameShard[1], []byte("b"))
+	assert.Nil(t, err)
+	err = wb.Put(otherShard, []byte("c"))
+	assert.Equal(t, ErrBatchSpansShards, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	val, err := s.Get(sameShard[1])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+	_, err = s.Get(otherShard)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 提交之后可以写入其他分片
+	err = wb.Put(otherShard, []byte("c"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	val, err = s.Get(otherShard)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c"), val)
+}
@@ -0,0 +1,195 @@
+package aperturekv
+
+import (
+	"sync"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+	"github.com/minimAluminiumalism/ApertureKV/fio"
+	"github.com/minimAluminiumalism/ApertureKV/index"
+)
+
+// 数据库在某一时刻的只读快照，之后的写入和 merge 对快照都不可见
+// 快照使用完之后需要调用 Release 释放，否则被 merge 替换掉的数据文件不会被关闭
+type Snapshot struct {
+	db			*DB
+	seqNo		uint64
+	index		index.Snapshot
+	files		map[uint32]*data.DataFile	// 创建快照时的数据文件，位置索引只在这些文件中有效
+	blobFiles	map[uint32]*data.DataFile	// 创建快照时的 blob 文件
+	mu			*sync.RWMutex
+	released	bool
+}
+
+// 创建数据库当前状态的快照
+func (db *DB) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.snapshot()
+}
+
+// 调用方需要持有数据库的锁
+func (db *DB) snapshot() *Snapshot {
+	files := make(map[uint32]*data.DataFile, len(db.olderFiles)+1)
+	for fid, dataFile := range db.olderFiles {
+		files[fid] = dataFile
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileId] = db.activeFile
+	}
+	blobFiles := make(map[uint32]*data.DataFile, len(db.olderBlobFiles)+1)
+	for _, blobFile := range db.blobFileList() {
+		blobFiles[blobFile.FileId] = blobFile
+	}
+	s := &Snapshot{
+		db:			db,
+		seqNo:		db.seqNo,
+		index:		db.index.Snapshot(),
+		files:		files,
+		blobFiles:	blobFiles,
+		mu:			new(sync.RWMutex),
+	}
+	db.snapshots[s] = struct{}{}
+	return s
+}
+
+// 快照对应的事务序列号
+func (s *Snapshot) SeqNo() uint64 {
+	return s.seqNo
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	logRecordPos := s.index.Get(key)
+	if logRecordPos == nil {
+		if err := s.db.indexErr(); err != nil {
+			return nil, err
+		}
+	}
+	if logRecordPos == nil || isExpired(logRecordPos.Expire) {
+		return nil, ErrKeyNotFound
+	}
+	return s.getValueByPosition(logRecordPos)
+}
+
+// 创建快照上的迭代器，迭代器需要在快照释放之前关闭
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	return &Iterator{
+		indexIter:	s.index.Iterator(opts.Reverse),
+		snapshot:	s,
+		options:	opts,
+	}
+}
+
+// 遍历快照中的所有数据，函数返回 false 时终止遍历
+func (s *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return ErrSnapshotReleased
+	}
+
+	iterator := s.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if isExpired(iterator.Value().Expire) {
+			continue
+		}
+		value, err := s.getValueByPosition(iterator.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// 释放快照，快照不再使用的数据文件如果已经被 merge 替换掉了会被关闭
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.release()
+	s.db.closeRetiredFiles()
+}
+
+// 调用方需要持有数据库的锁
+func (s *Snapshot) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	s.index.Close()
+	delete(s.db.snapshots, s)
+}
+
+func (s *Snapshot) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	if logRecordPos.Blob != nil {
+		return s.db.readCachedBlobValue(s.blobFiles[logRecordPos.Blob.Fid], logRecordPos.Blob)
+	}
+	dataFile := s.files[logRecordPos.Fid]
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	return s.db.readCachedValue(dataFile, logRecordPos)
+}
+
+// 被 merge 替换掉的数据文件（或者被回收的 blob 文件），如果还有快照在使用则延迟到快照释放时关闭
+// 数据文件在磁盘上已经被删除了，但是打开的文件描述符仍然可以读取
+func (db *DB) retireDataFile(dataFile *data.DataFile) error {
+	db.valueCache.removeFile(dataFile)
+	if db.isFileInUse(dataFile) {
+		// 文件描述符池中的文件在磁盘上被删除之后不能再重新打开
+		if pooled, ok := dataFile.IoManager.(*fio.PooledFile); ok {
+			if err := pooled.Pin(); err != nil {
+				return err
+			}
+		}
+		db.retiredFiles = append(db.retiredFiles, dataFile)
+		return nil
+	}
+	return dataFile.Close()
+}
+
+func (db *DB) closeRetiredFiles() {
+	var inUse []*data.DataFile
+	for _, dataFile := range db.retiredFiles {
+		if db.isFileInUse(dataFile) {
+			inUse = append(inUse, dataFile)
+			continue
+		}
+		// 快照读取时可能重新缓存了被替换掉的文件中的数据
+		db.valueCache.removeFile(dataFile)
+		_ = dataFile.Close()
+	}
+	db.retiredFiles = inUse
+}
+
+func (db *DB) isFileInUse(dataFile *data.DataFile) bool {
+	if dataFile == db.syncingFile || dataFile == db.syncingBlobFile {
+		return true
+	}
+	for s := range db.snapshots {
+		if s.files[dataFile.FileId] == dataFile || s.blobFiles[dataFile.FileId] == dataFile {
+			return true
+		}
+	}
+	for c := range db.logCursors {
+		for _, reading := range c.reading {
+			if reading == dataFile {
+				return true
+			}
+		}
+	}
+	return false
+}
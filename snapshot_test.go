@@ -0,0 +1,191 @@
+package aperturekv
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/index"
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// 快照创建之后的写入和删除对快照不可见
+func TestDB_Snapshot(t *testing.T) {
+	for _, typ := range []index.IndexType{index.Btree, index.ART, index.BPTree, index.Compact} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-1")
+		opts.DirPath = dir
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 100; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		snapshot := db.Snapshot()
+
+		for i := 0; i < 50; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		for i := 50; i < 150; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte("new value"))
+			assert.Nil(t, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			value, err := snapshot.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), value)
+		}
+		_, err = snapshot.Get(utils.GetTestKey(120))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		var count int
+		err = snapshot.Fold(func(key []byte, value []byte) bool {
+			assert.Equal(t, key, value)
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 100, count)
+
+		iterOpts := DefaultIteratorOptions
+		iterOpts.Reverse = true
+		iterator := snapshot.NewIterator(iterOpts)
+		iterator.Seek(utils.GetTestKey(10))
+		assert.True(t, iterator.Valid())
+		assert.Equal(t, utils.GetTestKey(10), iterator.Key())
+		count = 0
+		for ; iterator.Valid(); iterator.Next() {
+			value, err := iterator.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, iterator.Key(), value)
+			count++
+		}
+		iterator.Close()
+		// key-0 ~ key-10
+		assert.Equal(t, 11, count)
+
+		snapshot.Release()
+		_, err = snapshot.Get(utils.GetTestKey(60))
+		assert.Equal(t, ErrSnapshotReleased, err)
+		// 重复释放不会出错
+		snapshot.Release()
+
+		value, err := db.Get(utils.GetTestKey(60))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new value"), value)
+
+		destroyDB(db)
+	}
+}
+
+// merge 之后快照仍然可以读取旧数据文件中的数据，释放之后旧数据文件才会被关闭
+func TestDB_Snapshot_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	snapshot := db.Snapshot()
+	iterator := db.NewIterator(DefaultIteratorOptions)
+
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, db.retiredFiles)
+
+	var count int
+	err = snapshot.Fold(func(key []byte, value []byte) bool {
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, count)
+
+	count = 0
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		_, err := iterator.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iterator.Close()
+	assert.NotEmpty(t, db.retiredFiles)
+
+	snapshot.Release()
+	assert.Empty(t, db.retiredFiles)
+	assert.Empty(t, db.snapshots)
+
+	_, err = db.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(600))
+	assert.Nil(t, err)
+}
+
+// B+ 树索引在快照和迭代器打开时变大需要重新 mmap，写入和释放快照都不会被阻塞
+func TestDB_Snapshot_BPTreeRemap(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-3")
+	opts.DirPath = dir
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snapshot := db.Snapshot()
+	iterator := snapshot.NewIterator(DefaultIteratorOptions)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20000; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte("new value"))
+			assert.Nil(t, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("put blocked by the snapshot")
+	}
+
+	// 快照中仍然是之前的数据
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iterator.Key(), value)
+		count++
+	}
+	assert.Equal(t, 100, count)
+	iterator.Close()
+	snapshot.Release()
+	assert.Empty(t, db.snapshots)
+
+	value, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new value"), value)
+}
@@ -0,0 +1,440 @@
+package aperturekv
+
+import (
+	"io"
+	"sync"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+)
+
+// 一次读取数据文件时最多返回的变更数量
+const maxChangesPerPoll = 256
+
+type ChangeType = int8
+
+const (
+	ChangePut ChangeType = iota + 1
+	ChangeDelete
+)
+
+// 一次提交的写入，单独的 Put/Delete 只有一条记录，WriteBatch 和事务的所有写入在同一个 Change 中
+type Change struct {
+	Seq		uint64			// 提交在数据文件中的结束位置，Subscribe(Seq) 从这次提交之后继续订阅
+	Records	[]*ChangeRecord
+}
+
+type ChangeRecord struct {
+	Type	ChangeType
+	Key		[]byte
+	Value	[]byte
+	Expire	int64	// 过期时间(UnixNano)，为 0 时永不过期
+}
+
+// 变更订阅，按提交的顺序从数据文件中读取变更
+// 订阅落后时直接读取数据文件追赶，写入不会因为订阅方消费得慢而阻塞
+type Subscription struct {
+	db			*DB
+	ch			chan *Change
+	closeCh		chan struct{}
+	closeOnce	sync.Once
+	wg			sync.WaitGroup
+
+	cursor		*logCursor
+	// 以下字段只在 run 中使用
+	pending		*Change		// 还没有读到事务完成标识的 WriteBatch/事务
+	pendingSeq	uint64
+}
+
+// Subscribe 订阅 fromSeq 之后提交的所有变更，fromSeq 为 0 时从最早的数据开始
+// Seq 是变更在数据文件中的位置，只有已经持久化的变更才会返回，还没有 sync 的写入由订阅触发 sync，崩溃后丢失的写入不会被订阅到
+// merge 会重写旧的数据文件，被 merge 掉的变更无法再订阅，返回 ErrChangesCompacted
+func (db *DB) Subscribe(fromSeq uint64) (*Subscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cursor, err := db.openLogCursor(fromSeq)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{
+		db:			db,
+		ch:			make(chan *Change, maxChangesPerPoll),
+		closeCh:	make(chan struct{}),
+		cursor:		cursor,
+	}
+	db.subscriptions[s] = struct{}{}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// 按提交顺序返回变更，订阅关闭或者出错时 channel 会被关闭
+func (s *Subscription) Changes() <-chan *Change {
+	return s.ch
+}
+
+// 订阅因为出错而结束时返回对应的错误
+func (s *Subscription) Err() error {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	s.cursor.lock.Lock()
+	defer s.cursor.lock.Unlock()
+	return s.cursor.err
+}
+
+// 取消订阅
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+	s.wg.Wait()
+
+	s.db.mu.Lock()
+	delete(s.db.subscriptions, s)
+	s.db.closeLogCursor(s.cursor)
+	s.db.mu.Unlock()
+}
+
+func (s *Subscription) run() {
+	defer s.wg.Done()
+	defer close(s.ch)
+	for {
+		changes, err := s.poll()
+		if err != nil {
+			return
+		}
+		if len(changes) == 0 {
+			select {
+			case <-s.cursor.wakeCh:
+			case <-s.closeCh:
+				return
+			}
+			continue
+		}
+		for _, change := range changes {
+			select {
+			case s.ch <- change:
+			case <-s.closeCh:
+				return
+			}
+		}
+	}
+}
+
+// 从当前位置读取一批已经提交的变更，读取数据文件时不持有数据库的锁
+func (s *Subscription) poll() ([]*Change, error) {
+	db := s.db
+	cursor := s.cursor
+	dataFile, offset, end, err := db.beginLogRead(cursor)
+	if dataFile == nil {
+		return nil, err
+	}
+
+	var changes []*Change
+	for len(changes) < maxChangesPerPoll && offset < end {
+		var logRecord *data.LogRecord
+		var size int64
+		logRecord, size, err = dataFile.ReadLogRecord(offset)
+		if err == nil {
+			err = db.resolveBlob(cursor, logRecord)
+		}
+		if err != nil {
+			break
+		}
+		offset += size
+		if change := s.apply(logRecord, changeSeq(dataFile.FileId, offset)); change != nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes, db.endLogRead(cursor, offset, err)
+}
+
+// 将读到的数据记录转换为变更，seq 是这条记录之后的位置
+// WriteBatch/事务的数据在读到事务完成标识之后一起返回
+func (s *Subscription) apply(logRecord *data.LogRecord, seq uint64) *Change {
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+	if seqNo != nonTransactionSeqNo && s.pending != nil && s.pendingSeq != seqNo {
+		// 事务没有写完就崩溃了，这部分数据不会生效
+		s.pending = nil
+	}
+
+	if logRecord.Type == data.LogRecordTxnFinished {
+		change := s.pending
+		s.pending = nil
+		if change != nil && s.pendingSeq == seqNo {
+			change.Seq = seq
+			return change
+		}
+		return nil
+	}
+	record := &ChangeRecord{
+		Type:	ChangePut,
+		Key:	realKey,
+		Value:	logRecord.Value,
+		Expire:	logRecord.Expire,
+	}
+	if logRecord.Type == data.LogRecordDeleted {
+		record.Type = ChangeDelete
+		record.Value = nil
+	}
+	if seqNo == nonTransactionSeqNo {
+		return &Change{Seq: seq, Records: []*ChangeRecord{record}}
+	}
+	if s.pending == nil {
+		s.pending, s.pendingSeq = &Change{}, seqNo
+	}
+	s.pending.Records = append(s.pending.Records, record)
+	return nil
+}
+
+// 关闭所有的订阅，不能持有数据库的锁
+func (db *DB) closeSubscriptions() {
+	db.mu.RLock()
+	subscriptions := make([]*Subscription, 0, len(db.subscriptions))
+	for s := range db.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	db.mu.RUnlock()
+	for _, s := range subscriptions {
+		s.Close()
+	}
+}
+
+// 按写入顺序读取数据文件的位置，变更订阅和复制都通过它读取新写入的数据
+// 字段由数据库的锁保护，只持有数据库的读锁时还需要持有 lock
+type logCursor struct {
+	lock		sync.Mutex
+	fid			uint32				// 当前读取的数据文件
+	offset		int64				// 当前读取的位置
+	fileDone	bool				// 当前数据文件已经读完，并且不会再写入
+	skipFids	map[uint32]struct{}	// merge 重写生成的数据文件，其中的数据不是新写入的
+	wakeCh		chan struct{}		// 有新的数据写入
+	reading		[]*data.DataFile	// 不持有数据库的锁正在读取的数据文件和 blob 文件，读完之前不能被关闭
+	err			error
+}
+
+// 从 fromSeq 的位置开始读取，调用方需要持有数据库的锁
+func (db *DB) openLogCursor(fromSeq uint64) (*logCursor, error) {
+	if fromSeq != 0 && fromSeq < db.compactedSeq {
+		return nil, ErrChangesCompacted
+	}
+	fid, offset := parseChangeSeq(fromSeq)
+	cursor := &logCursor{
+		fid:		fid,
+		offset:		offset,
+		skipFids:	make(map[uint32]struct{}),
+		wakeCh:		make(chan struct{}, 1),
+	}
+	// 不在 compactedSeq 之前的位置已经读过了被 merge 的数据，需要跳过 merge 重写生成的数据文件
+	if fromSeq != 0 {
+		for fid := range db.rewrittenFids {
+			cursor.skipFids[fid] = struct{}{}
+		}
+	}
+	// 刚好读完了被 merge 的数据文件，之后的数据在 merge 重写生成的数据文件之后
+	// 副本全量同步之后 compactedSeq 在活跃文件中，从这个位置继续读取即可
+	if fromSeq != 0 && fromSeq == db.compactedSeq && (db.activeFile == nil || fid != db.activeFile.FileId) {
+		cursor.fileDone = true
+	}
+	db.logCursors[cursor] = struct{}{}
+	return cursor, nil
+}
+
+// 调用方需要持有数据库的锁
+func (db *DB) closeLogCursor(cursor *logCursor) {
+	delete(db.logCursors, cursor)
+}
+
+// 返回当前位置所在的数据文件，当前文件读完时切换到下一个数据文件
+// 没有可以读取的数据文件时返回 nil，调用方需要持有数据库的锁
+func (c *logCursor) file(db *DB) *data.DataFile {
+	for c.err == nil {
+		dataFile := db.changeLogFile(c.fid)
+		if dataFile != nil && !c.fileDone {
+			return dataFile
+		}
+		// 读取中的数据文件不见了，只可能是被 merge 掉了
+		if dataFile == nil && c.offset > 0 && !c.fileDone {
+			c.err = ErrChangesCompacted
+			break
+		}
+		fid, ok := c.nextFile(db)
+		if !ok {
+			break
+		}
+		c.fid, c.offset, c.fileDone = fid, 0, false
+	}
+	return nil
+}
+
+// 当前数据文件之后的下一个数据文件，调用方需要持有数据库的锁
+func (c *logCursor) nextFile(db *DB) (uint32, bool) {
+	var next uint32
+	var found bool
+	for _, dataFile := range db.dataFiles() {
+		fid := dataFile.FileId
+		if _, ok := c.skipFids[fid]; ok {
+			continue
+		}
+		// 还没有开始读取的数据文件可能是刚刚创建的
+		if fid < c.fid || (fid == c.fid && (c.fileDone || c.offset > 0)) {
+			continue
+		}
+		if !found || fid < next {
+			next, found = fid, true
+		}
+	}
+	return next, found
+}
+
+// 确定下一段可以读取的数据，返回数据文件和可以读取的范围，没有新的数据时返回 nil
+// 活跃文件只读取已经持久化的数据，还有没有 sync 的写入时先等待 sync 完成，订阅方和副本不会看到崩溃后丢失的写入
+// 返回的数据文件在 endLogRead 之前不会被关闭，读取时不需要持有数据库的锁，调用方不能持有数据库的锁
+func (db *DB) beginLogRead(c *logCursor) (*data.DataFile, int64, int64, error) {
+	for {
+		dataFile, offset, end, syncSeq, err := db.nextLogRange(c)
+		if err != nil || syncSeq == 0 {
+			return dataFile, offset, end, err
+		}
+		if err := db.waitForSync(syncSeq); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+}
+
+// 返回下一段可以读取的数据，活跃文件中只有还没有 sync 的数据时返回需要等待 sync 的位置
+func (db *DB) nextLogRange(c *logCursor) (*data.DataFile, int64, int64, uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for {
+		dataFile := c.file(db)
+		if dataFile == nil {
+			return nil, 0, 0, 0, c.err
+		}
+		end, err := db.logFileEnd(dataFile)
+		if err != nil {
+			return nil, 0, 0, 0, err
+		}
+		if dataFile == db.activeFile {
+			if synced := db.syncedOffset(); synced < end {
+				if c.offset >= synced {
+					return nil, 0, 0, db.syncPosition(), nil
+				}
+				end = synced
+			}
+			if c.offset >= end {
+				return nil, 0, 0, 0, nil
+			}
+		}
+		if c.offset < end {
+			c.reading = append(c.reading, dataFile)
+			return dataFile, c.offset, end, 0, nil
+		}
+		c.fileDone = true
+	}
+}
+
+// 读取完成之后调用，offset 是读到的位置，err 是读取时遇到的错误，返回读取是否需要结束
+func (db *DB) endLogRead(c *logCursor, offset int64, err error) error {
+	db.mu.RLock()
+	c.lock.Lock()
+	c.offset = offset
+	c.reading = nil
+	// 旧的数据文件末尾可能有没有写完整的数据
+	if err == io.EOF && db.changeLogFile(c.fid) != db.activeFile {
+		c.fileDone, err = true, nil
+	}
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	err = c.err
+	c.lock.Unlock()
+	hasRetired := len(db.retiredFiles) > 0
+	db.mu.RUnlock()
+
+	// 读取期间被 merge 替换掉的文件现在可以关闭了
+	if hasRetired {
+		db.mu.Lock()
+		db.closeRetiredFiles()
+		db.mu.Unlock()
+	}
+	return err
+}
+
+// 数据文件中已经写入的数据量，调用方需要持有数据库的锁
+func (db *DB) logFileEnd(dataFile *data.DataFile) (int64, error) {
+	if dataFile == db.activeFile {
+		return dataFile.WriteOff, nil
+	}
+	return dataFile.IoManager.Size()
+}
+
+// 通知有新的数据写入，调用方需要持有数据库的锁
+func (db *DB) notifyLogCursors() {
+	for c := range db.logCursors {
+		select {
+		case c.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// merge 替换掉数据文件之前调用，调用方需要持有数据库的锁
+// 没有读完被 merge 的数据文件的读取无法继续，其他的读取需要跳过 merge 重写生成的数据文件
+func (db *DB) compactChangeLog(mergeFiles []*data.DataFile, outputFids []uint32) error {
+	var lastFid uint32
+	var lastSize int64
+	for _, dataFile := range mergeFiles {
+		if dataFile.FileId < lastFid {
+			continue
+		}
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		lastFid, lastSize = dataFile.FileId, size
+	}
+	if seq := changeSeq(lastFid, lastSize); seq > db.compactedSeq {
+		db.compactedSeq = seq
+	}
+	for _, fid := range outputFids {
+		db.rewrittenFids[fid] = struct{}{}
+	}
+
+	for c := range db.logCursors {
+		if c.fid < lastFid || (c.fid == lastFid && c.offset < lastSize && !c.fileDone) {
+			c.err = ErrChangesCompacted
+			continue
+		}
+		for _, dataFile := range mergeFiles {
+			if dataFile.FileId == c.fid {
+				c.fileDone = true
+			}
+		}
+		for _, fid := range outputFids {
+			c.skipFids[fid] = struct{}{}
+		}
+	}
+	db.notifyLogCursors()
+	return nil
+}
+
+// 调用方需要持有数据库的锁
+func (db *DB) changeLogFile(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
+	}
+	return db.olderFiles[fid]
+}
+
+// 变更的 Seq 由数据文件 id 和文件中的偏移组成，按提交的顺序递增
+func changeSeq(fid uint32, offset int64) uint64 {
+	return uint64(fid)<<32 | uint64(offset)
+}
+
+func parseChangeSeq(seq uint64) (uint32, int64) {
+	return uint32(seq >> 32), int64(seq & 0xffffffff)
+}
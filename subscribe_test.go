@@ -0,0 +1,251 @@
+package aperturekv
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveChanges(t *testing.T, sub *Subscription, n int) []*Change {
+	var changes []*Change
+	for len(changes) < n {
+		select {
+		case change, ok := <-sub.Changes():
+			if !ok {
+				t.Fatalf("subscription closed after %d changes, err: %v", len(changes), sub.Err())
+			}
+			changes = append(changes, change)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout after %d changes", len(changes))
+		}
+	}
+	return changes
+}
+
+func TestDB_Subscribe(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v2"), time.Hour)
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(3), []byte("v3"))
+	_ = wb.Delete(utils.GetTestKey(2))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	changes := receiveChanges(t, sub, 4)
+	assert.Equal(t, []*ChangeRecord{{Type: ChangePut, Key: utils.GetTestKey(1), Value: []byte("v1")}}, changes[0].Records)
+	assert.Equal(t, utils.GetTestKey(2), changes[1].Records[0].Key)
+	assert.True(t, changes[1].Records[0].Expire > 0)
+	assert.Equal(t, []*ChangeRecord{{Type: ChangeDelete, Key: utils.GetTestKey(1)}}, changes[2].Records)
+	// 一个 WriteBatch 的所有写入在同一个变更中
+	assert.ElementsMatch(t, []*ChangeRecord{
+		{Type: ChangePut, Key: utils.GetTestKey(3), Value: []byte("v3")},
+		{Type: ChangeDelete, Key: utils.GetTestKey(2)},
+	}, changes[3].Records)
+	for i := 1; i < len(changes); i++ {
+		assert.True(t, changes[i].Seq > changes[i-1].Seq)
+	}
+
+	// 从某个变更之后继续订阅
+	sub2, err := db.Subscribe(changes[1].Seq)
+	assert.Nil(t, err)
+	defer sub2.Close()
+	assert.Equal(t, changes[2:], receiveChanges(t, sub2, 2))
+
+	// 关闭数据库时订阅也会结束
+	err = db.Close()
+	assert.Nil(t, err)
+	_, ok := <-sub.Changes()
+	assert.False(t, ok)
+	assert.Nil(t, sub.Err())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
+
+// 订阅落后时从数据文件中追赶
+func TestDB_Subscribe_CatchUp(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	defer sub.Close()
+	// 写入期间不消费，写入不会被阻塞
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 1)
+
+	changes := receiveChanges(t, sub, 2000)
+	for i, change := range changes {
+		assert.Equal(t, utils.GetTestKey(i), change.Records[0].Key)
+	}
+
+	// 重启之后从上次的位置继续订阅
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 2000; i < 2100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	sub2, err := db.Subscribe(changes[999].Seq)
+	assert.Nil(t, err)
+	defer sub2.Close()
+	changes = receiveChanges(t, sub2, 1100)
+	for i, change := range changes {
+		assert.Equal(t, utils.GetTestKey(1000+i), change.Records[0].Key)
+	}
+}
+
+func TestDB_Subscribe_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-3")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i%100), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	upToDate, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	defer upToDate.Close()
+	changes := receiveChanges(t, upToDate, 2000)
+	// 订阅方最多缓存两批变更，落后的数量需要更多
+	lagging, err := db.Subscribe(changes[99].Seq)
+	assert.Nil(t, err)
+	defer lagging.Close()
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2000), utils.RandomValue(64))
+	assert.Nil(t, err)
+
+	// 已经读完的订阅跳过 merge 重写的数据，只会收到新的写入
+	newChanges := receiveChanges(t, upToDate, 1)
+	assert.Equal(t, utils.GetTestKey(2000), newChanges[0].Records[0].Key)
+	sub, err := db.Subscribe(changes[1999].Seq)
+	assert.Nil(t, err)
+	defer sub.Close()
+	assert.Equal(t, newChanges, receiveChanges(t, sub, 1))
+
+	// 落后的订阅需要的数据已经被 merge 掉了
+	for range lagging.Changes() {
+	}
+	assert.Equal(t, ErrChangesCompacted, lagging.Err())
+	_, err = db.Subscribe(changes[99].Seq)
+	assert.Equal(t, ErrChangesCompacted, err)
+}
+
+// SelectiveMerge 重写生成的数据文件在重启之后仍然会被跳过，不会重复返回其中的数据
+func TestDB_Subscribe_SelectiveMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-5")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i%100), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(10000+i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	changes := receiveChanges(t, sub, 3000)
+	sub.Close()
+	from := changes[2900].Seq
+
+	err = db.SelectiveMerge(DefaultSelectiveMergeOptions)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, db.rewrittenFids)
+	err = db.Put(utils.GetTestKey(20000), utils.RandomValue(64))
+	assert.Nil(t, err)
+
+	// 在 merge 之后从没有被 merge 的位置订阅，跳过重写生成的数据文件
+	check := func(db *DB, newKeys ...[]byte) {
+		sub, err := db.Subscribe(from)
+		assert.Nil(t, err)
+		defer sub.Close()
+		received := receiveChanges(t, sub, 99+len(newKeys))
+		for i := 0; i < 99; i++ {
+			assert.Equal(t, utils.GetTestKey(10000+901+i), received[i].Records[0].Key)
+		}
+		for i, key := range newKeys {
+			assert.Equal(t, key, received[99+i].Records[0].Key)
+		}
+	}
+	check(db, utils.GetTestKey(20000))
+
+	// 重启之后仍然跳过重写生成的数据文件，被 merge 掉的变更仍然无法订阅
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, db.rewrittenFids)
+	err = db.Put(utils.GetTestKey(20001), utils.RandomValue(64))
+	assert.Nil(t, err)
+	check(db, utils.GetTestKey(20000), utils.GetTestKey(20001))
+	_, err = db.Subscribe(changes[10].Seq)
+	assert.Equal(t, ErrChangesCompacted, err)
+}
+
+func TestDB_Subscribe_OnlySynced(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-4")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	// 写入不需要 sync，订阅读到新的写入时先 sync，返回的变更崩溃之后不会丢失
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	changes := receiveChanges(t, sub, 10)
+	db.syncMu.Lock()
+	syncedSeq := db.syncedSeq
+	db.syncMu.Unlock()
+	for _, change := range changes {
+		assert.True(t, change.Seq <= syncedSeq)
+	}
+}
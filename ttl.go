@@ -0,0 +1,199 @@
+package aperturekv
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+)
+
+// 写入数据并设置过期时间，ttl <= 0 时永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return db.put(key, value, expireAt(ttl))
+}
+
+// 重新设置 key 的过期时间，ttl <= 0 时移除过期时间
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if db.replica != nil {
+		return ErrReadOnlyReplica
+	}
+	db.mu.Lock()
+
+	logRecordPos := db.index.Get(key)
+	if logRecordPos == nil || isExpired(logRecordPos.Expire) {
+		db.mu.Unlock()
+		return ErrKeyNotFound
+	}
+	value, err := db.getValueByPosition(logRecordPos)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+
+	// 过期时间保存在数据记录中，需要重新写一条记录
+	logRecord := &data.LogRecord{
+		Key:	logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:	value,
+		Type:	data.LogRecordNormal,
+		Expire:	expireAt(ttl),
+	}
+	pos, err := db.appendLogRecord(logRecord)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	oldPos := db.index.Put(key, pos)
+	if oldPos != nil {
+		db.addReclaimSize(oldPos)
+	}
+	db.setExpire(key, pos.Expire)
+	db.recordWrite(key)
+	db.recordUndo(key, pos, oldPos)
+	db.collectExpired()
+	return db.unlockAndSync(db.options.SyncWrites)
+}
+
+// 获取 key 剩余的存活时间，没有设置过期时间的 key 返回 -1
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	logRecordPos := db.index.Get(key)
+	if logRecordPos == nil || isExpired(logRecordPos.Expire) {
+		return 0, ErrKeyNotFound
+	}
+	if logRecordPos.Expire == 0 {
+		return -1, nil
+	}
+	return time.Until(time.Unix(0, logRecordPos.Expire)), nil
+}
+
+func expireAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+func isExpired(expire int64) bool {
+	return expire != 0 && expire <= time.Now().UnixNano()
+}
+
+// 记录 key 的过期时间，expire 为 0 时移除，每个 key 在堆中最多只有一项，调用方需要持有数据库的锁
+func (db *DB) setExpire(key []byte, expire int64) {
+	item, ok := db.expireItems[string(key)]
+	switch {
+	case expire == 0:
+		if ok {
+			heap.Remove(&db.expires, item.index)
+			delete(db.expireItems, string(key))
+		}
+	case ok:
+		item.expire = expire
+		heap.Fix(&db.expires, item.index)
+	default:
+		item = &expireItem{key: key, expire: expire}
+		heap.Push(&db.expires, item)
+		db.expireItems[string(key)] = item
+	}
+}
+
+// 删除已经过期的 key，和 Delete 一样写一条删除记录，变更订阅、副本和乐观事务的冲突检测都可以看到
+// 副本不能写入，只从索引中移除，之后主节点的删除记录会同步过来
+// 写入失败时 key 留在堆中，下次再删除，调用方需要持有数据库的锁
+func (db *DB) collectExpired() {
+	now := time.Now().UnixNano()
+	for len(db.expires) > 0 && db.expires[0].expire <= now {
+		item := db.expires[0]
+		// 被没有过期时间的写入覆盖或者被删除的 key 可能还留在堆中，只处理索引中仍然过期的数据
+		pos := db.index.Get(item.key)
+		if pos != nil && pos.Expire != 0 && pos.Expire <= now {
+			if err := db.deleteExpired(item.key, pos); err != nil {
+				return
+			}
+		}
+		db.setExpire(item.key, 0)
+	}
+}
+
+// 已经过期但是还没有删除的数据的位置，不修改索引和堆，调用方需要持有数据库的锁（读锁即可）
+func (db *DB) expiredPositions() []*data.LogRecordPos {
+	now := time.Now().UnixNano()
+	var positions []*data.LogRecordPos
+	// 小顶堆中没有过期的项的子节点也都没有过期
+	var walk func(i int)
+	walk = func(i int) {
+		if i >= len(db.expires) || db.expires[i].expire > now {
+			return
+		}
+		pos := db.index.Get(db.expires[i].key)
+		if pos != nil && pos.Expire != 0 && pos.Expire <= now {
+			positions = append(positions, pos)
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return positions
+}
+
+func (db *DB) deleteExpired(key []byte, pos *data.LogRecordPos) error {
+	if db.replica == nil {
+		logRecord := &data.LogRecord{
+			Key:	logRecordKeyWithSeq(key, nonTransactionSeqNo),
+			Type:	data.LogRecordDeleted,
+		}
+		deletedPos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		db.addReclaimSize(deletedPos)
+	}
+	db.index.Delete(key)
+	db.addReclaimSize(pos)
+	db.recordWrite(key)
+	return nil
+}
+
+type expireItem struct {
+	key		[]byte
+	expire	int64
+	index	int		// 在堆中的位置
+}
+
+// 按过期时间排序的小顶堆
+type expireHeap []*expireItem
+
+func (h expireHeap) Len() int {
+	return len(h)
+}
+
+func (h expireHeap) Less(i, j int) bool {
+	return h[i].expire < h[j].expire
+}
+
+func (h expireHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expireHeap) Push(x interface{}) {
+	item := x.(*expireItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expireHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
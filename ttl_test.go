@@ -0,0 +1,284 @@
+package aperturekv
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), []byte("v1"), time.Millisecond*100)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v2"), time.Hour)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3), []byte("v3"))
+	assert.Nil(t, err)
+
+	ttl, err := db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59 && ttl <= time.Hour)
+	ttl, err = db.TTL(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), value)
+
+	time.Sleep(time.Millisecond * 150)
+
+	// 过期的 key 对 Get、迭代器、Fold 都不可见
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	var keys [][]byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+	}
+	iterator.Close()
+	assert.Equal(t, [][]byte{utils.GetTestKey(2), utils.GetTestKey(3)}, keys)
+
+	var count int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	// 过期的数据可以被回收，Stat 只读取统计信息，不会删除过期的 key
+	writeOff := db.activeFile.WriteOff
+	stat := db.Stat()
+	assert.Equal(t, uint(2), stat.KeyNum)
+	assert.True(t, stat.ReclaimableSize > 0)
+	assert.Equal(t, stat.ReclaimableSize, stat.DataFiles[0].ReclaimableSize)
+	assert.Equal(t, writeOff, db.activeFile.WriteOff)
+	assert.Equal(t, 3, db.index.Size())
+	assert.Equal(t, stat, db.Stat())
+
+	// 重启之后过期时间仍然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	ttl, err = db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59 && ttl <= time.Hour)
+	assert.True(t, db.Stat().ReclaimableSize > 0)
+}
+
+func TestDB_Expire(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Expire(utils.GetTestKey(1), time.Second)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Expire(utils.GetTestKey(1), time.Millisecond*100)
+	assert.Nil(t, err)
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Millisecond*100)
+
+	// 移除过期时间
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v2"), time.Millisecond*100)
+	assert.Nil(t, err)
+	err = db.Expire(utils.GetTestKey(2), 0)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 150)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	value, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), value)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	value, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), value)
+}
+
+// merge 之后过期的数据被清理掉，没有过期的数据保留过期时间
+func TestDB_Merge_TTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-3")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Millisecond*100)
+		assert.Nil(t, err)
+	}
+	for i := 100; i < 200; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Hour)
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Millisecond * 150)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	stat := db.Stat()
+	assert.Equal(t, uint(100), stat.KeyNum)
+	assert.Equal(t, int64(0), stat.ReclaimableSize)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	ttl, err := db.TTL(utils.GetTestKey(150))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59)
+}
+
+// 只 merge 部分文件时，过期的数据不能让更早的旧数据重新生效
+func TestDB_SelectiveMerge_TTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-4")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 旧的数据在第一个文件中
+	err = db.Put(utils.GetTestKey(0), []byte("old value"))
+	assert.Nil(t, err)
+	for i := 1; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(256))
+		assert.Nil(t, err)
+	}
+	// 设置了过期时间的数据所在的文件中大部分都是无效的数据
+	for i := 0; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(1000), utils.RandomValue(256))
+		assert.Nil(t, err)
+	}
+	err = db.PutWithTTL(utils.GetTestKey(0), []byte("new value"), time.Millisecond*100)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(1000), utils.RandomValue(256))
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Millisecond * 150)
+
+	selectiveOpts := DefaultSelectiveMergeOptions
+	selectiveOpts.FileReclaimRatio = 0.9
+	err = db.SelectiveMerge(selectiveOpts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+// 过期和 Delete 一样写删除记录，变更订阅和乐观事务都可以看到
+func TestDB_TTL_ExpireAsDelete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-5")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	err = db.PutWithTTL(utils.GetTestKey(1), []byte("v1"), time.Millisecond*100)
+	assert.Nil(t, err)
+	txn := db.NewTxn(DefaultTxnOptions)
+	_, err = txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_ = txn.Put(utils.GetTestKey(3), []byte("v3"))
+
+	time.Sleep(time.Millisecond * 150)
+	err = db.Put(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+
+	changes := receiveChanges(t, sub, 3)
+	assert.Equal(t, utils.GetTestKey(1), changes[0].Records[0].Key)
+	assert.Equal(t, utils.GetTestKey(2), changes[1].Records[0].Key)
+	assert.Equal(t, []*ChangeRecord{{Type: ChangeDelete, Key: utils.GetTestKey(1)}}, changes[2].Records)
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+
+	// 重启之后不需要再删除
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Empty(t, db.expires)
+	assert.Equal(t, 1, len(db.ListKeys()))
+}
+
+// 反复设置过期时间的 key 在堆中只有一项
+func TestDB_TTL_Refresh(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-6")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(1), []byte("v1"), time.Hour)
+		assert.Nil(t, err)
+		err = db.Expire(utils.GetTestKey(1), time.Hour*2)
+		assert.Nil(t, err)
+		err = db.PutWithTTL(utils.GetTestKey(2), []byte("v2"), time.Duration(i+1)*time.Minute)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, len(db.expires))
+	assert.Equal(t, utils.GetTestKey(2), db.expires[0].key)
+
+	// 移除过期时间或者删除之后不再留在堆中
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Empty(t, db.expires)
+	assert.Empty(t, db.expireItems)
+
+	// 重启之后同样只有一项
+	err = db.PutWithTTL(utils.GetTestKey(3), []byte("v3"), time.Hour)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(db.expires))
+}
@@ -0,0 +1,342 @@
+package aperturekv
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/minimAluminiumalism/ApertureKV/data"
+)
+
+// 乐观事务，读取数据库中的数据以及自己暂存的写入
+// 提交时如果读过或者写过的 key 在事务开始之后被其他写入修改了，返回 ErrTxnConflict
+// 事务读取开始时的快照，各种索引的快照都只记录之后被修改的部分，创建快照的开销很小
+type Txn struct {
+	options			TxnOptions
+	mu				*sync.Mutex
+	db				*DB
+	startSeq		uint64						// 事务开始时数据文件写到的位置，之后的写入都比它大
+	snapshot		*Snapshot					// 事务开始时的快照
+	pendingWrites	map[string]*data.LogRecord	// 暂存用户写入的数据
+	readKeys		map[string]struct{}			// 事务中读取过的 key
+	closed			bool
+}
+
+// 事务运行期间提交的一次写入
+type committedWrite struct {
+	seq		uint64	// 写入之后数据文件写到的位置
+	keys	[][]byte
+}
+
+// 事务的序列号在提交时才分配
+func (db *DB) NewTxn(opts TxnOptions) *Txn {
+	// 记录开始的位置和登记事务需要在同一把锁内完成，否则中间提交的写入不会被冲突检测发现
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	txn := &Txn{
+		options:		opts,
+		mu:				new(sync.Mutex),
+		db:				db,
+		startSeq:		db.syncPosition(),
+		pendingWrites:	map[string]*data.LogRecord{},
+		readKeys:		map[string]struct{}{},
+	}
+	txn.snapshot = db.snapshot()
+	db.activeTxns[txn] = struct{}{}
+	return txn
+}
+
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return nil, ErrTxnClosed
+	}
+
+	// 优先读取事务自己的写入
+	if record := txn.pendingWrites[string(key)]; record != nil {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+	txn.readKeys[string(key)] = struct{}{}
+	return txn.snapshot.Get(key)
+}
+
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Value: value}
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+
+	// 不存在的 key 不需要写删除记录，但是其他写入在这期间创建了它的话需要检测到冲突
+	txn.readKeys[string(key)] = struct{}{}
+	if pos := txn.getPosition(key); pos == nil || isExpired(pos.Expire) {
+		delete(txn.pendingWrites, string(key))
+		return nil
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	return nil
+}
+
+func (txn *Txn) getPosition(key []byte) *data.LogRecordPos {
+	return txn.snapshot.index.Get(key)
+}
+
+// 提交事务，无论成功与否事务都会结束
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+	if uint(len(txn.pendingWrites)) > txn.options.MaxBatchNum {
+		txn.close()
+		return ErrExceedMaxBatchNum
+	}
+
+	// 只读事务没有写入，不需要等待 sync
+	syncWrites := len(txn.pendingWrites) > 0 && (txn.options.SyncWrites || txn.db.options.SyncWrites)
+	txn.db.mu.Lock()
+	if err := txn.commitWithLock(); err != nil {
+		txn.db.mu.Unlock()
+		return err
+	}
+	return txn.db.unlockAndSync(syncWrites)
+}
+
+// 调用方需要持有数据库的锁
+func (txn *Txn) commitWithLock() error {
+	defer txn.closeWithLock()
+
+	// 读取快照的只读事务读到的一直是一致的数据，不需要检测冲突
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+	if txn.hasConflict() {
+		return ErrTxnConflict
+	}
+	return txn.db.commitRecords(txn.pendingWrites)
+}
+
+// 放弃事务中所有的写入
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return
+	}
+	txn.close()
+}
+
+// 事务开始之后提交的写入是否修改了事务读过或者写过的 key
+func (txn *Txn) hasConflict() bool {
+	for _, write := range txn.db.txnWrites {
+		if write.seq <= txn.startSeq {
+			continue
+		}
+		for _, key := range write.keys {
+			if _, ok := txn.readKeys[string(key)]; ok {
+				return true
+			}
+			if _, ok := txn.pendingWrites[string(key)]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (txn *Txn) close() {
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+	txn.closeWithLock()
+}
+
+// 调用方需要持有数据库的锁
+func (txn *Txn) closeWithLock() {
+	txn.closed = true
+	txn.pendingWrites = nil
+	txn.readKeys = nil
+	txn.snapshot.release()
+	txn.db.closeRetiredFiles()
+
+	// 所有还在运行的事务都不会再关心的写入可以丢弃了
+	delete(txn.db.activeTxns, txn)
+	if len(txn.db.activeTxns) == 0 {
+		txn.db.txnWrites = nil
+		return
+	}
+	var minSeq uint64 = math.MaxUint64
+	for activeTxn := range txn.db.activeTxns {
+		if activeTxn.startSeq < minSeq {
+			minSeq = activeTxn.startSeq
+		}
+	}
+	idx := sort.Search(len(txn.db.txnWrites), func(i int) bool {
+		return txn.db.txnWrites[i].seq > minSeq
+	})
+	txn.db.txnWrites = txn.db.txnWrites[idx:]
+}
+
+// 记录一次写入，只有存在运行中的事务时才需要，调用方需要持有数据库的锁并且已经写完了数据文件
+func (db *DB) recordWrite(keys ...[]byte) {
+	if len(db.activeTxns) == 0 {
+		return
+	}
+	db.txnWrites = append(db.txnWrites, &committedWrite{seq: db.syncPosition(), keys: keys})
+}
+
+// 事务中的迭代器，合并快照中的数据和事务自己暂存的写入
+// 创建迭代器之后事务中新的写入对迭代器不可见
+type TxnIterator struct {
+	txn			*Txn
+	iter		*Iterator				// 事务的快照上的迭代器，事务没有快照时是数据库的迭代器
+	pending		[]*data.LogRecord		// 暂存的写入，按遍历的顺序排列
+	pendingIdx	int
+	options		IteratorOptions
+}
+
+func (txn *Txn) NewIterator(opts IteratorOptions) *TxnIterator {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	var pending []*data.LogRecord
+	for _, record := range txn.pendingWrites {
+		if bytes.HasPrefix(record.Key, opts.Prefix) {
+			pending = append(pending, record)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if opts.Reverse {
+			return bytes.Compare(pending[i].Key, pending[j].Key) > 0
+		}
+		return bytes.Compare(pending[i].Key, pending[j].Key) < 0
+	})
+	it := &TxnIterator{
+		txn:		txn,
+		iter:		txn.snapshot.NewIterator(opts),
+		pending:	pending,
+		options:	opts,
+	}
+	it.skipDeleted()
+	return it
+}
+
+func (it *TxnIterator) Rewind() {
+	it.iter.Rewind()
+	it.pendingIdx = 0
+	it.skipDeleted()
+}
+
+func (it *TxnIterator) Seek(key []byte) {
+	it.iter.Seek(key)
+	it.pendingIdx = sort.Search(len(it.pending), func(i int) bool {
+		if it.options.Reverse {
+			return bytes.Compare(it.pending[i].Key, key) <= 0
+		}
+		return bytes.Compare(it.pending[i].Key, key) >= 0
+	})
+	it.skipDeleted()
+}
+
+func (it *TxnIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	switch c := it.compare(); {
+	case c < 0:
+		it.iter.Next()
+	case c > 0:
+		it.pendingIdx++
+	default:
+		it.iter.Next()
+		it.pendingIdx++
+	}
+	it.skipDeleted()
+}
+
+func (it *TxnIterator) Valid() bool {
+	return it.iter.Valid() || it.pendingIdx < len(it.pending)
+}
+
+func (it *TxnIterator) Key() []byte {
+	if it.compare() < 0 {
+		it.recordRead()
+		return it.iter.Key()
+	}
+	return it.pending[it.pendingIdx].Key
+}
+
+func (it *TxnIterator) Value() ([]byte, error) {
+	if it.compare() < 0 {
+		it.recordRead()
+		return it.iter.Value()
+	}
+	return it.pending[it.pendingIdx].Value, nil
+}
+
+func (it *TxnIterator) Close() {
+	it.iter.Close()
+	it.pending = nil
+}
+
+// 当前位置的数据来自哪里：小于 0 来自快照，大于 0 来自暂存的写入，等于 0 时两者的 key 相同，以暂存的写入为准
+func (it *TxnIterator) compare() int {
+	if !it.iter.Valid() {
+		return 1
+	}
+	if it.pendingIdx >= len(it.pending) {
+		return -1
+	}
+	c := bytes.Compare(it.iter.Key(), it.pending[it.pendingIdx].Key)
+	if it.options.Reverse {
+		c = -c
+	}
+	return c
+}
+
+// 跳过事务中被删除的 key
+func (it *TxnIterator) skipDeleted() {
+	for it.Valid() {
+		c := it.compare()
+		if c < 0 || it.pending[it.pendingIdx].Type != data.LogRecordDeleted {
+			return
+		}
+		if c == 0 {
+			it.iter.Next()
+		}
+		it.pendingIdx++
+	}
+}
+
+func (it *TxnIterator) recordRead() {
+	it.txn.mu.Lock()
+	defer it.txn.mu.Unlock()
+	if !it.txn.closed {
+		it.txn.readKeys[string(it.iter.Key())] = struct{}{}
+	}
+}
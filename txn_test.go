@@ -0,0 +1,306 @@
+package aperturekv
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/minimAluminiumalism/ApertureKV/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// 事务中可以读到自己的写入，提交之前其他读取看不到
+func TestDB_Txn(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+
+	txn := db.NewTxn(DefaultTxnOptions)
+	err = txn.Put(utils.GetTestKey(1), []byte("v1-txn"))
+	assert.Nil(t, err)
+	err = txn.Put(utils.GetTestKey(3), []byte("v3-txn"))
+	assert.Nil(t, err)
+	err = txn.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	value, err := txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-txn"), value)
+	_, err = txn.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	value, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = txn.Commit()
+	assert.Nil(t, err)
+	err = txn.Commit()
+	assert.Equal(t, ErrTxnClosed, err)
+
+	// 重启之后事务的写入仍然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	value, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-txn"), value)
+	value, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3-txn"), value)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Txn_Rollback(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	txn := db.NewTxn(DefaultTxnOptions)
+	err = txn.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	txn.Rollback()
+
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = txn.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Equal(t, ErrTxnClosed, err)
+	assert.Empty(t, db.activeTxns)
+	assert.Empty(t, db.snapshots)
+}
+
+func TestDB_Txn_Conflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-3")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+
+	// 读过的 key 被其他写入修改了
+	txn1 := db.NewTxn(DefaultTxnOptions)
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = txn1.Put(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), []byte("v1-new"))
+	assert.Nil(t, err)
+	err = txn1.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 两个事务写同一个 key，先提交的成功
+	txn2 := db.NewTxn(DefaultTxnOptions)
+	txn3 := db.NewTxn(DefaultTxnOptions)
+	err = txn2.Put(utils.GetTestKey(3), []byte("txn2"))
+	assert.Nil(t, err)
+	err = txn3.Put(utils.GetTestKey(3), []byte("txn3"))
+	assert.Nil(t, err)
+	err = txn3.Commit()
+	assert.Nil(t, err)
+	err = txn2.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+
+	// 不相关的写入不会产生冲突
+	txn4 := db.NewTxn(DefaultTxnOptions)
+	_, err = txn4.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = txn4.Put(utils.GetTestKey(1), []byte("txn4"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(5), []byte("v5"))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	_ = wb.Put(utils.GetTestKey(6), []byte("v6"))
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = txn4.Commit()
+	assert.Nil(t, err)
+
+	assert.Empty(t, db.txnWrites)
+}
+
+// 并发的读-改-写操作不会丢失更新
+func TestDB_Txn_Concurrent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-4")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	key := utils.GetTestKey(1)
+	increment := func() error {
+		for {
+			txn := db.NewTxn(DefaultTxnOptions)
+			var counter byte
+			value, err := txn.Get(key)
+			if err == nil {
+				counter = value[0]
+			} else if err != ErrKeyNotFound {
+				return err
+			}
+			if err := txn.Put(key, []byte{counter + 1}); err != nil {
+				return err
+			}
+			if err := txn.Commit(); err != ErrTxnConflict {
+				return err
+			}
+		}
+	}
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.Nil(t, increment())
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{100}, value)
+}
+
+func TestDB_Txn_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-5")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"a1", "a3", "a5", "b1"} {
+		err := db.Put([]byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	txn := db.NewTxn(DefaultTxnOptions)
+	defer txn.Rollback()
+	_ = txn.Put([]byte("a2"), []byte("a2-txn"))
+	_ = txn.Put([]byte("a3"), []byte("a3-txn"))
+	_ = txn.Delete([]byte("a5"))
+	_ = txn.Put([]byte("a6"), []byte("a6-txn"))
+	_ = txn.Put([]byte("b0"), []byte("b0-txn"))
+	// 事务开始之后的写入对事务中的迭代器不可见
+	err = db.Put([]byte("a4"), []byte("a4"))
+	assert.Nil(t, err)
+
+	collect := func(opts IteratorOptions) []string {
+		var kvs []string
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			value, err := iter.Value()
+			assert.Nil(t, err)
+			kvs = append(kvs, string(iter.Key())+"="+string(value))
+		}
+		return kvs
+	}
+
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Prefix = []byte("a")
+	assert.Equal(t, []string{"a1=a1", "a2=a2-txn", "a3=a3-txn", "a6=a6-txn"}, collect(iterOpts))
+
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Reverse = true
+	assert.Equal(t, []string{"b1=b1", "b0=b0-txn", "a6=a6-txn", "a3=a3-txn", "a2=a2-txn", "a1=a1"}, collect(iterOpts))
+
+	iter := txn.NewIterator(DefaultIteratorOptions)
+	iter.Seek([]byte("a4"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("a6"), iter.Key())
+	iter.Close()
+}
+
+// 所有索引的事务都读取开始时的快照，之后的写入对事务不可见
+func TestDB_Txn_IndexTypes(t *testing.T) {
+	for _, typ := range []IndexType{BTree, ART, BPlusTree, Compact} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-txn-6")
+		opts.DirPath = dir
+		opts.IndexType = typ
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		err = db.Put(utils.GetTestKey(1), []byte("v1"))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(2), []byte("v2"))
+		assert.Nil(t, err)
+
+		// 创建事务不会分配序列号
+		seqNo := db.seqNo
+		txn1 := db.NewTxn(DefaultTxnOptions)
+		assert.NotNil(t, txn1.snapshot)
+		assert.Equal(t, seqNo, db.seqNo)
+
+		err = db.Put(utils.GetTestKey(1), []byte("v1-new"))
+		assert.Nil(t, err)
+		err = db.Delete(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(3), []byte("v3"))
+		assert.Nil(t, err)
+
+		value, err := txn1.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), value)
+		value, err = txn1.Get(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v2"), value)
+		_, err = txn1.Get(utils.GetTestKey(3))
+		assert.Equal(t, ErrKeyNotFound, err)
+		var keys [][]byte
+		iter := txn1.NewIterator(DefaultIteratorOptions)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			keys = append(keys, iter.Key())
+		}
+		iter.Close()
+		assert.Equal(t, [][]byte{utils.GetTestKey(1), utils.GetTestKey(2)}, keys)
+		// 只读事务读到的一直是开始时的数据，提交不会冲突
+		err = txn1.Commit()
+		assert.Nil(t, err)
+
+		// 读过的 key 被修改之后写入会冲突
+		txn2 := db.NewTxn(DefaultTxnOptions)
+		_, err = txn2.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		_ = txn2.Put(utils.GetTestKey(4), []byte("v4"))
+		err = db.Put(utils.GetTestKey(1), []byte("v1-newer"))
+		assert.Nil(t, err)
+		err = txn2.Commit()
+		assert.Equal(t, ErrTxnConflict, err)
+
+		txn3 := db.NewTxn(DefaultTxnOptions)
+		_ = txn3.Delete(utils.GetTestKey(1))
+		err = txn3.Commit()
+		assert.Nil(t, err)
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Empty(t, db.txnWrites)
+		assert.Empty(t, db.snapshots)
+
+		destroyDB(db)
+	}
+}
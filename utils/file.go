@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"fmt"
+	"io"
 	"io/fs"
+	"os"
 	"path/filepath"
 	"syscall"
 )
@@ -34,3 +37,72 @@ func AvailableDiskSize() (uint64, error) {
 	}
 	return stat.Bavail * uint64(stat.Bsize), nil
 }
+
+// 拷贝文件中 [offset, size) 的数据，size 小于 0 时拷贝到文件末尾
+func CopyFile(src, dest string, offset, size int64) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	if _, err := srcFile.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if size < 0 {
+		_, err = io.Copy(destFile, srcFile)
+	} else {
+		_, err = io.CopyN(destFile, srcFile, size-offset)
+	}
+	if err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
+
+// 将 src 的内容追加到 dest 的末尾
+func AppendFile(src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
+
+// 优先使用硬链接，不支持时（例如跨文件系统）退化为拷贝整个文件
+func LinkOrCopyFile(src, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return CopyFile(src, dest, 0, -1)
+}
+
+// 获取文件的 inode，文件被替换之后 inode 会发生变化
+func FileInode(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("failed to get inode of %s", path)
+	}
+	return stat.Ino, nil
+}